@@ -0,0 +1,171 @@
+package wasm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheExt is the extension of the files of a Cache.
+const cacheExt = ".wasmer"
+
+// Cache stores compiled modules in a directory, so that modules
+// are compiled once across processes.
+// Artifacts are keyed by the SHA-256 of the module bytes and the engine settings,
+// and authenticated with the key of the cache, so that artifacts written to the
+// directory by anyone else are never loaded.
+// When the directory grows past its size limit, the least recently used artifacts are removed.
+type Cache struct {
+	dir     string
+	maxSize int64
+	key     []byte
+
+	mu sync.Mutex
+}
+
+// NewCache returns a cache storing at most maxSize bytes of artifacts in dir,
+// which is created if needed. A maxSize of 0 means no limit.
+// Artifacts are serialized with key, see CompiledModule.Serialize.
+func NewCache(dir string, maxSize int64, key []byte) (*Cache, error) {
+	if len(key) == 0 {
+		return nil, errSerializationKey
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, maxSize: maxSize, key: append([]byte(nil), key...)}, nil
+}
+
+// WithCache makes the WebAssembly.Module constructor, WebAssembly.compile,
+// WebAssembly.instantiate and NewModule compile modules through c.
+func WithCache(c *Cache) Option {
+	return func(cfg *runtimeConfig) {
+		cfg.cache = c
+	}
+}
+
+// Compile returns the compiled module of b, from the cache if it has been compiled before.
+func (c *Cache) Compile(b []byte) (*CompiledModule, error) {
+	path := c.path(b)
+	if compiled, ok := c.load(path); ok {
+		return compiled, nil
+	}
+
+	compiled, err := Compile(b)
+	if err != nil {
+		return nil, err
+	}
+	// failing to store the artifact only costs a compilation next time
+	if artifact, err := compiled.Serialize(c.key); err == nil {
+		c.store(path, artifact)
+	}
+	return compiled, nil
+}
+
+// path returns the file of the artifact of b.
+func (c *Cache) path(b []byte) string {
+	h := sha256.New()
+	h.Write([]byte(engineSettings()))
+	h.Write([]byte{0})
+	h.Write(b)
+	return filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil))+cacheExt)
+}
+
+// load deserializes the artifact at path, damaged or unauthenticated ones are removed.
+func (c *Cache) load(path string) (*CompiledModule, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	compiled, err := DeserializeCompiled(data, c.key)
+	if err != nil {
+		os.Remove(path)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return compiled, true
+}
+
+// store writes artifact to path and evicts old artifacts.
+func (c *Cache) store(path string, artifact []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(artifact)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	c.evict()
+}
+
+// evict removes the least recently used artifacts until the cache fits in its size limit.
+func (c *Cache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	size := int64(0)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), cacheExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		size += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, info := range files {
+		if size <= c.maxSize {
+			break
+		}
+		if os.Remove(filepath.Join(c.dir, info.Name())) == nil {
+			size -= info.Size()
+		}
+	}
+}
+
+// Clear removes every artifact of the cache.
+func (c *Cache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), cacheExt) {
+			if err := os.Remove(filepath.Join(c.dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package wasm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var cacheKey = []byte("cache key")
+
+// cacheModule returns a module exporting a function named name.
+func cacheModule(t *testing.T, name string) []byte {
+	return wat(t, `(module (func (export "`+name+`")))`)
+}
+
+// exportName returns the name of the only export of compiled.
+func exportName(compiled *CompiledModule) string {
+	exports := compiled.module.Exports()
+	if len(exports) != 1 {
+		return ""
+	}
+	return exports[0].Name()
+}
+
+func TestCacheHit(t *testing.T) {
+	c, err := NewCache(t.TempDir(), 0, cacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := cacheModule(t, "a"), cacheModule(t, "b")
+	if _, err := os.Stat(c.path(a)); !os.IsNotExist(err) {
+		t.Fatalf("artifact exists before the first compilation: %v", err)
+	}
+	if compiled, err := c.Compile(a); err != nil || exportName(compiled) != "a" {
+		t.Fatalf("miss: got %v", err)
+	}
+	if _, err := os.Stat(c.path(a)); err != nil {
+		t.Fatalf("artifact was not stored: %v", err)
+	}
+
+	// a hit loads the artifact rather than compiling, which the artifact of b at the path of a shows
+	compiled, err := Compile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact, err := compiled.Serialize(cacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.path(a), artifact, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if compiled, err := c.Compile(a); err != nil || exportName(compiled) != "b" {
+		t.Errorf("hit: got %v, want the module of the artifact", err)
+	}
+
+	if err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.path(a)); !os.IsNotExist(err) {
+		t.Errorf("artifact exists after Clear: %v", err)
+	}
+}
+
+func TestCacheDamaged(t *testing.T) {
+	c, err := NewCache(t.TempDir(), 0, cacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := cacheModule(t, "a")
+	compiled, err := Compile(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := compiled.Serialize([]byte("other key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := compiled.Serialize(cacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), valid...)
+	flipped[len(flipped)/2] ^= 1
+	for name, artifact := range map[string][]byte{
+		"garbage":   []byte("not an artifact"),
+		"truncated": valid[:len(valid)/2],
+		"flipped":   flipped,
+		"other key": other,
+	} {
+		path := c.path(a)
+		if err := os.WriteFile(path, artifact, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.load(path); ok {
+			t.Errorf("%s: artifact was loaded", name)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: artifact was not removed: %v", name, err)
+		}
+
+		// the module is compiled again and the artifact replaced
+		os.WriteFile(path, artifact, 0o644)
+		if compiled, err := c.Compile(a); err != nil || exportName(compiled) != "a" {
+			t.Errorf("%s: got %v", name, err)
+		}
+		if _, ok := c.load(path); !ok {
+			t.Errorf("%s: artifact was not replaced", name)
+		}
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCache(dir, 0, cacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := map[string][]byte{}
+	size := map[string]int64{}
+	for _, name := range []string{"a", "b", "c"} {
+		modules[name] = cacheModule(t, name)
+		if _, err := c.Compile(modules[name]); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(c.path(modules[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size[name] = info.Size()
+	}
+	// a is the oldest, c the newest
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(c.path(modules[name]), mtime, mtime)
+	}
+	os.WriteFile(filepath.Join(dir, "other"), make([]byte, 1<<20), 0o644)
+
+	// using a makes b the least recently used
+	if _, ok := c.load(c.path(modules["a"])); !ok {
+		t.Fatal("a was not loaded")
+	}
+	modules["d"] = cacheModule(t, "d")
+	compiled, err := Compile(modules["d"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact, err := compiled.Serialize(cacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxSize = size["a"] + size["c"] + int64(len(artifact))
+	if _, err := c.Compile(modules["d"]); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, err := os.Stat(c.path(modules[name])); (err == nil) != want {
+			t.Errorf("artifact of %s: got %v, want kept %v", name, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other")); err != nil {
+		t.Errorf("a file that is not an artifact was removed: %v", err)
+	}
+
+	// without the room for any artifact, all are removed
+	c.maxSize = 1
+	c.store(c.path(modules["b"]), artifact)
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("cache holds %d files, want only the one that is not an artifact", len(entries))
+	}
+}
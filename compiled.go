@@ -0,0 +1,186 @@
+package wasm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// CompiledModule is a module compiled independently of any runtime.
+// It can be attached to any number of runtimes, which share its compiled code.
+type CompiledModule struct {
+	store  *wasmer.Store
+	module *wasmer.Module
+	info   *moduleInfo
+}
+
+// Compile compiles b into a module that can be attached to runtimes with ModuleValue.
+func Compile(b []byte) (*CompiledModule, error) {
+	if !bytes.HasPrefix(b, wasmMagic) {
+		// the text format is compiled to a binary module to be hooked
+		if wasm, err := wasmer.Wat2Wasm(string(b)); err == nil {
+			b = wasm
+		}
+	}
+	if err := checkSections(b); err != nil {
+		return nil, err
+	}
+	lowered, refs, err := lowerExternref(b)
+	if err != nil {
+		return nil, err
+	}
+	lowered, v128, adapted, err := lowerV128(lowered)
+	if err != nil {
+		return nil, err
+	}
+	hooked, offsets := hookMemoryGrow(lowered)
+	store := wasmer.NewStore(newEngine())
+	module, err := wasmer.NewModule(store, hooked)
+	if err != nil {
+		return nil, err
+	}
+	info := newModuleInfo(b, offsets, adapted)
+	info.Externrefs, info.V128 = refs, v128
+	return &CompiledModule{store: store, module: module, info: info}, nil
+}
+
+// serializedMagic starts the artifacts of Serialize, followed by the engine settings
+// on one line, the HMAC-SHA256 of the settings and the rest, the length of the module
+// info as a uvarint, the module info and the wasmer artifact.
+const serializedMagic = "goja-wasm\n"
+
+// errSerializationKey is the error of serializing or deserializing without a key.
+var errSerializationKey = errors.New("serialization needs a key")
+
+// DeserializeCompiled loads a module serialized by CompiledModule.Serialize with key.
+// wasmer runs the native code of artifacts as is, so artifacts are only loaded if they
+// were authenticated with key; it must be kept secret from whoever supplies the artifacts.
+// The artifact must also have been produced with the same engine settings:
+// the same version of this package, wasmer, compiler and target.
+func DeserializeCompiled(b, key []byte) (*CompiledModule, error) {
+	if len(key) == 0 {
+		return nil, errSerializationKey
+	}
+	if !bytes.HasPrefix(b, []byte(serializedMagic)) {
+		return nil, errors.New("not a serialized module")
+	}
+	b = b[len(serializedMagic):]
+	eol := bytes.IndexByte(b, '\n')
+	if eol < 0 || len(b) < eol+1+sha256.Size {
+		return nil, errors.New("serialized module is truncated")
+	}
+	settings := b[:eol]
+	if string(settings) != engineSettings() {
+		return nil, fmt.Errorf("module was serialized by %q, this engine is %q", settings, engineSettings())
+	}
+	sum, rest := b[eol+1:eol+1+sha256.Size], b[eol+1+sha256.Size:]
+	if !hmac.Equal(sum, serializedMAC(key, settings, rest)) {
+		return nil, errors.New("serialized module is damaged or was not serialized with this key")
+	}
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || uint64(len(rest)-size) < n {
+		return nil, errors.New("serialized module is damaged")
+	}
+	info, err := decodeModuleInfo(rest[size : size+int(n)])
+	if err != nil {
+		return nil, err
+	}
+	artifact := rest[size+int(n):]
+
+	store := wasmer.NewStore(newEngine())
+	module, err := wasmer.DeserializeModule(store, artifact)
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledModule{store: store, module: module, info: info}, nil
+}
+
+// Serialize returns the compiled code of c authenticated with key,
+// which DeserializeCompiled loads without compiling the module again.
+func (c *CompiledModule) Serialize(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errSerializationKey
+	}
+	artifact, err := c.module.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.info.encode()
+	if err != nil {
+		return nil, err
+	}
+	rest := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(info)+len(artifact))
+	rest = append(rest[:binary.PutUvarint(rest, uint64(len(info)))], info...)
+	rest = append(rest, artifact...)
+	settings := []byte(engineSettings())
+	sum := serializedMAC(key, settings, rest)
+	b := make([]byte, 0, len(serializedMagic)+len(settings)+1+len(sum)+len(rest))
+	b = append(b, serializedMagic...)
+	b = append(b, settings...)
+	b = append(b, '\n')
+	b = append(b, sum...)
+	return append(b, rest...), nil
+}
+
+// serializedMAC returns the HMAC-SHA256 of an artifact with the given settings line and rest.
+func serializedMAC(key, settings, rest []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(settings)
+	mac.Write([]byte{'\n'})
+	mac.Write(rest)
+	return mac.Sum(nil)
+}
+
+// ModuleValue returns a WebAssembly.Module object of vm for c.
+func ModuleValue(vm *goja.Runtime, c *CompiledModule) goja.Value {
+	return c.attach(vm).Object()
+}
+
+// attach returns the module of vm for c.
+func (c *CompiledModule) attach(vm *goja.Runtime) *WasmModule {
+	return &WasmModule{vm: vm, module: c.module, store: c.store, info: c.info}
+}
+
+// Compiled returns the compiled module of w, to attach it to other runtimes.
+func (w *WasmModule) Compiled() *CompiledModule {
+	return &CompiledModule{store: w.store, module: w.module, info: w.info}
+}
+
+// newEngine returns an engine to compile a module with.
+// Modules may be metered so that guests can be interrupted, and since wasmer's
+// metering serves a single module, each module has its own engine.
+func newEngine() *wasmer.Engine {
+	return wasmer.NewEngineWithConfig(newEngineConfig())
+}
+
+// engineSettings identifies the code generated for modules: artifacts are only
+// compatible with the wasmer version, engine, compiler, middlewares and target that produced them.
+func engineSettings() string {
+	settings := "wasmer-go 1.0.4; engine universal; compiler cranelift; features default; target " + runtime.GOOS + "/" + runtime.GOARCH
+	if meteringEnabled() {
+		settings += "; metering"
+	}
+	return settings + "; memory.grow hook; externref handles; v128 adapters; module info"
+}
+
+var (
+	helpers     *wasmer.Store
+	helpersOnce sync.Once
+)
+
+// helperStore returns the store of the modules generated to link guests, such as
+// trampolines, which are not metered.
+func helperStore() *wasmer.Store {
+	helpersOnce.Do(func() {
+		helpers = wasmer.NewStore(wasmer.NewEngine())
+	})
+	return helpers
+}
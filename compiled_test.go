@@ -0,0 +1,137 @@
+package wasm
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+// counterWat counts the calls of next in a global.
+const counterWat = `(module
+  (global $n (mut i32) (i32.const 0))
+  (func (export "next") (result i32)
+    (global.set $n (i32.add (global.get $n) (i32.const 1)))
+    (global.get $n)))`
+
+func TestModuleValue(t *testing.T) {
+	compiled, err := Compile(wat(t, counterWat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each runtime instantiates the compiled module on its own
+	var vms []*goja.Runtime
+	for i := 0; i < 2; i++ {
+		vm := goja.New()
+		Enable(vm)
+		vm.Set("plugin", ModuleValue(vm, compiled))
+		if _, err := vm.RunString(`var instance = new WebAssembly.Instance(plugin, {})`); err != nil {
+			t.Fatal(err)
+		}
+		vms = append(vms, vm)
+	}
+	for i, want := range []int64{1, 2} {
+		if v, err := vms[0].RunString(`instance.exports.next()`); err != nil || v.ToInteger() != want {
+			t.Errorf("call %d of the first runtime: got %v, %v, want %d", i, v, err, want)
+		}
+	}
+	if v, err := vms[1].RunString(`plugin instanceof WebAssembly.Module && instance.exports.next()`); err != nil || v.ToInteger() != 1 {
+		t.Errorf("the second runtime shares the state of the first: got %v, %v", v, err)
+	}
+
+	// modules compiled by a script can be attached to other runtimes
+	module, err := NewModule(vms[1], wat(t, counterWat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := goja.New()
+	Enable(vm)
+	vm.Set("plugin", ModuleValue(vm, module.Compiled()))
+	if v, err := vm.RunString(`new WebAssembly.Instance(plugin, {}).exports.next()`); err != nil || v.ToInteger() != 1 {
+		t.Errorf("module compiled by another runtime: got %v, %v", v, err)
+	}
+}
+
+func TestDeserializeCompiled(t *testing.T) {
+	key := []byte("secret")
+	compiled, err := Compile(wat(t, counterWat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact, err := compiled.Serialize(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compiled.Serialize(nil); err != errSerializationKey {
+		t.Errorf("Serialize without a key: got %v", err)
+	}
+
+	// an artifact of other engine settings, authenticated with the key
+	settings := []byte(engineSettings() + " other")
+	rest := artifact[len(serializedMagic)+len(engineSettings())+1+sha256.Size:]
+	other := append([]byte(serializedMagic), settings...)
+	other = append(append(other, '\n'), serializedMAC(key, settings, rest)...)
+	other = append(other, rest...)
+
+	for _, c := range []struct {
+		name     string
+		artifact []byte
+		key      []byte
+		err      string
+	}{
+		{"other key", artifact, []byte("other"), "not serialized with this key"},
+		{"no key", artifact, nil, errSerializationKey.Error()},
+		{"other engine", other, key, "module was serialized by"},
+		{"garbage", []byte("garbage"), key, "not a serialized module"},
+	} {
+		if _, err := DeserializeCompiled(c.artifact, c.key); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+
+	loaded, err := DeserializeCompiled(artifact, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := goja.New()
+	Enable(vm)
+	vm.Set("plugin", ModuleValue(vm, loaded))
+	if v, err := vm.RunString(`new WebAssembly.Instance(plugin, {}).exports.next()`); err != nil || v.ToInteger() != 1 {
+		t.Errorf("deserialized module: got %v, %v", v, err)
+	}
+}
+
+func TestModuleSerialize(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	if v, err := vm.RunString(`typeof WebAssembly.Module.serialize + typeof WebAssembly.Module.deserialize`); err != nil || v.String() != "undefinedundefined" {
+		t.Errorf("serialization is defined without a key: %v, %v", v, err)
+	}
+
+	compiled, err := Compile(wat(t, counterWat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := compiled.Serialize([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm = goja.New()
+	Enable(vm, WithSerialization([]byte("secret")))
+	vm.Set("bytes", vm.NewArrayBuffer(wat(t, counterWat)))
+	vm.Set("foreign", vm.NewArrayBuffer(foreign))
+	v, err := vm.RunString(`
+	  const buffer = WebAssembly.Module.serialize(new WebAssembly.Module(bytes));
+	  const module = WebAssembly.Module.deserialize(buffer);
+	  let error;
+	  try { WebAssembly.Module.deserialize(foreign) } catch (e) { error = e }
+	  [buffer instanceof ArrayBuffer, new WebAssembly.Instance(module, {}).exports.next(), error instanceof TypeError].join();
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.String(), "true,1,true"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,138 @@
+package wasm
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// Option configures the WebAssembly support enabled on a runtime.
+type Option func(*runtimeConfig)
+
+// runtimeConfig holds the options given to Enable.
+type runtimeConfig struct {
+	deterministic *Deterministic
+	cache         *Cache
+	interrupts    *interruptWatch
+	ctx           context.Context
+	memories      *memoryBudget
+	imports       ImportPolicy
+	refs          *refTable
+	serialization []byte
+	hostPreopens  bool
+	maxModuleSize int64
+}
+
+// configSymbol keys the runtimeConfig on the WebAssembly object.
+var configSymbol = goja.NewSymbol("WebAssembly.config")
+
+// configOf returns the options vm was enabled with.
+func configOf(vm *goja.Runtime) *runtimeConfig {
+	if wasmObj, ok := vm.Get("WebAssembly").(*goja.Object); ok {
+		if v := wasmObj.GetSymbol(configSymbol); v != nil {
+			if cfg, ok := v.Export().(*runtimeConfig); ok {
+				return cfg
+			}
+		}
+	}
+	return &runtimeConfig{}
+}
+
+// WithSerialization adds WebAssembly.Module.serialize and WebAssembly.Module.deserialize,
+// which authenticate artifacts with key. Scripts cannot load native code otherwise,
+// see DeserializeCompiled.
+func WithSerialization(key []byte) Option {
+	return func(cfg *runtimeConfig) {
+		cfg.serialization = append([]byte(nil), key...)
+	}
+}
+
+// WithHostPreopens lets scripts preopen host directories by path in the WASI constructor,
+// read and write. Scripts can otherwise only preopen the fs.FS values given to them by Go.
+func WithHostPreopens() Option {
+	return func(cfg *runtimeConfig) {
+		cfg.hostPreopens = true
+	}
+}
+
+// WithDeterministic makes every guest of the runtime deterministic,
+// including the Go and WASI objects created in it.
+func WithDeterministic(d Deterministic) Option {
+	return func(cfg *runtimeConfig) {
+		cfg.deterministic = &d
+	}
+}
+
+// Deterministic makes guests reproducible: time is read from a virtual clock
+// and randomness from a PRNG seeded with Seed, so that the same module
+// and inputs always yield the same outputs.
+type Deterministic struct {
+	// Clock is advanced by the embedder and by guests sleeping.
+	// A nil Clock starts a new clock at 2000-01-01 UTC for every guest.
+	Clock *VirtualClock
+	Seed  int64
+}
+
+// system returns the clocks and entropy of a guest.
+func (d Deterministic) system() WASISystem {
+	clock := d.Clock
+	if clock == nil {
+		clock = NewVirtualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
+	return WASISystem{
+		Walltime: clock.Now,
+		Nanotime: clock.Nanotime,
+		Sleep:    clock.Advance,
+		Random:   rand.New(rand.NewSource(d.Seed)),
+	}
+}
+
+// deterministicFromJS reads the deterministic option of the Go and WASI constructors,
+// either true or an object with a seed, and returns nil if it is not set.
+// Guests share the clock of the runtime if it is deterministic.
+func deterministicFromJS(vm *goja.Runtime, v goja.Value) *Deterministic {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) || !v.ToBoolean() {
+		return nil
+	}
+	d := &Deterministic{}
+	if rt := configOf(vm).deterministic; rt != nil {
+		*d = *rt
+	}
+	if o, ok := v.(*goja.Object); ok {
+		if seed := o.Get("seed"); seed != nil && !goja.IsUndefined(seed) {
+			d.Seed = seed.ToInteger()
+		}
+	}
+	return d
+}
+
+// VirtualClock is a clock that only moves when it is advanced.
+type VirtualClock struct {
+	epoch   time.Time
+	elapsed time.Duration
+}
+
+// NewVirtualClock returns a clock reading epoch.
+func NewVirtualClock(epoch time.Time) *VirtualClock {
+	return &VirtualClock{epoch: epoch}
+}
+
+// Now returns the current time of the clock.
+func (c *VirtualClock) Now() time.Time {
+	return c.epoch.Add(c.elapsed)
+}
+
+// Nanotime returns the monotonic time of the clock, the time elapsed since the Unix epoch.
+// Guest runtimes do not expect a monotonic clock reading zero.
+func (c *VirtualClock) Nanotime() time.Duration {
+	return time.Duration(c.Now().UnixNano())
+}
+
+// Advance moves the clock forward by d.
+func (c *VirtualClock) Advance(d time.Duration) {
+	if d > 0 {
+		c.elapsed += d
+	}
+}
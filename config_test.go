@@ -0,0 +1,57 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// clockRandomWat stores the realtime and monotonic clocks at 0 and 8, and 16 random bytes at 16.
+const clockRandomWat = `(module
+  (import "wasi_snapshot_preview1" "clock_time_get" (func $time (param i32 i64 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "random_get" (func $random (param i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "_start")
+    (drop (call $time (i32.const 0) (i64.const 1) (i32.const 0)))
+    (drop (call $time (i32.const 1) (i64.const 1) (i32.const 8)))
+    (drop (call $random (i32.const 16) (i32.const 16)))))`
+
+func TestDeterministic(t *testing.T) {
+	run := func(deterministic string, opts ...Option) []byte {
+		vm := newWASIRuntime(t, clockRandomWat, opts...)
+		v, err := vm.RunString(`
+		  const wasi = new WASI({deterministic: ` + deterministic + `});
+		  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), wasi.getImportObject());
+		  wasi.start(instance);
+		  instance.exports.memory.buffer;
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.Export().([]byte)[:32]
+	}
+
+	first := run(`{seed: 1}`)
+	if !bytes.Equal(run(`{seed: 1}`), first) {
+		t.Errorf("runs with the same seed differ")
+	}
+	if bytes.Equal(run(`{seed: 2}`)[16:], first[16:]) {
+		t.Errorf("runs with different seeds read the same random bytes")
+	}
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if walltime, nanotime := binary.LittleEndian.Uint64(first), binary.LittleEndian.Uint64(first[8:]); walltime != uint64(epoch.UnixNano()) || nanotime != walltime {
+		t.Errorf("clocks read %d and %d, want %d", walltime, nanotime, epoch.UnixNano())
+	}
+
+	// guests of deterministic runtimes read the clock of the runtime
+	clock := NewVirtualClock(epoch)
+	clock.Advance(time.Second)
+	mem := run(`false`, WithDeterministic(Deterministic{Clock: clock, Seed: 1}))
+	if walltime, nanotime := binary.LittleEndian.Uint64(mem), binary.LittleEndian.Uint64(mem[8:]); walltime != uint64(epoch.Add(time.Second).UnixNano()) || nanotime != walltime {
+		t.Errorf("clocks of the runtime read %d and %d", walltime, nanotime)
+	}
+	if !bytes.Equal(mem[16:], first[16:]) {
+		t.Errorf("the runtime seed gives other random bytes than the same guest seed")
+	}
+}
@@ -0,0 +1,344 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// NewModule compiles b into a module of vm.
+// The module is the object scripts see as a WebAssembly.Module, see Object.
+func NewModule(vm *goja.Runtime, b []byte) (*WasmModule, error) {
+	module, err := compile(vm, b)
+	if err != nil {
+		return nil, err
+	}
+	module.this = wasmObject(vm, "Module", module)
+	return module, nil
+}
+
+// NewInstance instantiates mod with imports, an import object as given to
+// the WebAssembly.Instance constructor, such as the importObject of a Go object.
+// imports may be nil.
+func NewInstance(vm *goja.Runtime, mod *WasmModule, imports goja.Value) (instance *WasmInstance, err error) {
+	// import objects throw JS values when they cannot link the module
+	defer func() {
+		if r := recover(); r != nil {
+			v, ok := r.(goja.Value)
+			if !ok {
+				panic(r)
+			}
+			err = errors.New(v.String())
+		}
+	}()
+	if imports == nil {
+		imports = goja.Undefined()
+	}
+	instance, err = instantiate(vm, mod, imports)
+	if err != nil {
+		return nil, err
+	}
+	instance.this = wasmObject(vm, "Instance", instance)
+	return instance, nil
+}
+
+// compile compiles b into a module of vm, through the cache of vm if any.
+func compile(vm *goja.Runtime, b []byte) (*WasmModule, error) {
+	compileFn := Compile
+	if cache := configOf(vm).cache; cache != nil {
+		compileFn = cache.Compile
+	}
+	c, err := compileFn(b)
+	if err != nil {
+		return nil, err
+	}
+	return c.attach(vm), nil
+}
+
+// instantiate creates an instance of module with the import object imports.
+func instantiate(vm *goja.Runtime, module *WasmModule, imports goja.Value) (_ *WasmInstance, err error) {
+	store := module.store
+	if policy := configOf(vm).imports; policy != nil {
+		// checked before the import object sets up the guest
+		if err := policy.check(module.module); err != nil {
+			return nil, err
+		}
+	}
+	// checked before wasmer allocates the memories
+	if err := checkMemories(vm, module); err != nil {
+		return nil, err
+	}
+
+	instance := &WasmInstance{
+		vm:   vm,
+		info: module.info,
+	}
+	if module.info.externrefs() != nil {
+		instance.refs = newRefHolder(configOf(vm).refs)
+	}
+
+	var importObject *wasmer.ImportObject
+	var wasiEnv *wasmer.WasiEnvironment
+	switch imp := imports.Export().(type) {
+
+	case *GoImportObject:
+		importObject = imp.InitModule(store, module.module)
+
+	case *WASIImportObject:
+		importObject, err = imp.Init(store, module.module, instance)
+		if err != nil {
+			return nil, err
+		}
+		// the WASI object can be used again if the instance is not created
+		defer func() {
+			if err != nil {
+				imp.wasi.unbind(instance)
+			}
+		}()
+		wasiEnv = instance.wasi
+
+	case map[string]interface{}:
+		namespaces, err := instance.jsImports(store, module.module, imports.ToObject(vm))
+		if err != nil {
+			return nil, err
+		}
+		importObject = wasmer.NewImportObject()
+		for name, funcs := range namespaces {
+			importObject.Register(name, instance.link(funcs))
+		}
+
+	default:
+		if wasmer.GetWasiVersion(module.module) == wasmer.WASI_VERSION_INVALID {
+			importObject = wasmer.NewImportObject()
+			break
+		}
+		// wasmer reads the host clocks and entropy, deterministic runtimes use the native implementation
+		if d := configOf(vm).deterministic; d != nil && wasmer.GetWasiVersion(module.module) == wasmer.WASI_VERSION_SNAPSHOT1 {
+			instance.wasiFS = newWasiFS(instance.streams, instance.tracedMemory(), nil)
+			importObject = wasmer.NewImportObject()
+			importObject.Register(wasmer.WASI_VERSION_SNAPSHOT1.String(), instance.link(wasiRuntime(store, instance, d.system(), []string{module.module.Name()}, nil)))
+			break
+		}
+		builder := wasmer.NewWasiStateBuilder(module.module.Name()).
+			CaptureStdout().
+			CaptureStderr()
+		var err error
+		wasiEnv, err = builder.Finalize()
+		if err != nil {
+			return nil, err
+		}
+		importObject, err = wasiEnv.GenerateImportObject(store, module.module)
+		if err != nil {
+			return nil, err
+		}
+		instance.wasiFS = newWasiFS(instance.streams, instance.tracedMemory(), nil)
+	}
+	if wasiEnv != nil {
+		version := wasmer.GetWasiVersion(module.module).String()
+		// every function taking file descriptors is overridden, so the guest only sees those of wasiFS
+		importObject.Register(version, instance.link(instance.wasiFS.functions(store, WASISystem{}.withDefaults())))
+		importObject.Register(version, map[string]wasmer.IntoExtern{
+			"proc_exit": instance.wasiProcExit(store, nil),
+		})
+	}
+	ins, err := wasmer.NewInstance(module.module, importObject)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.instance = ins
+	instance.wasi = wasiEnv
+	if err := limitMemory(vm, module, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// wasmObject returns the JS object of d, an instance of WebAssembly[name].
+func wasmObject(vm *goja.Runtime, name string, d goja.DynamicObject) *goja.Object {
+	obj := vm.NewDynamicObject(d)
+	if wasmObj, ok := vm.Get("WebAssembly").(*goja.Object); ok {
+		if ctor, ok := wasmObj.Get(name).(*goja.Object); ok {
+			if proto, ok := ctor.Get("prototype").(*goja.Object); ok {
+				obj.SetPrototype(proto)
+			}
+		}
+	}
+	return obj
+}
+
+// bufferSourceBytes returns the bytes of an ArrayBuffer, a typed array or a DataView,
+// or nil if v is none of them.
+func bufferSourceBytes(vm *goja.Runtime, v goja.Value) []byte {
+	if v == nil {
+		return nil
+	}
+	if ab, ok := v.Export().(goja.ArrayBuffer); ok {
+		return ab.Bytes()
+	}
+	return typedArrayBytes(vm, v)
+}
+
+// Object returns the WebAssembly.Module object of w.
+func (w *WasmModule) Object() *goja.Object {
+	if w.this == nil {
+		w.this = wasmObject(w.vm, "Module", w)
+	}
+	return w.this
+}
+
+// Object returns the WebAssembly.Instance object of w.
+func (w *WasmInstance) Object() *goja.Object {
+	if w.this == nil {
+		w.this = wasmObject(w.vm, "Instance", w)
+	}
+	return w.this
+}
+
+// Call calls the exported function name with args, which are Go numbers
+// converted to the types of its parameters, goja values for externref parameters
+// and [16]byte for v128 parameters.
+// It returns nil for functions without results and a slice for multiple results,
+// with externref results as goja values and v128 results as [16]byte,
+// and a *Trap if the guest traps. The call stops when the default context of the runtime is done, see WithContext.
+func (w *WasmInstance) Call(name string, args ...interface{}) (interface{}, error) {
+	return CallContext(runtimeContext(w.vm), w, name, args...)
+}
+
+// CallContext calls the exported function name of w like Call, and stops the guest
+// when ctx is done. It then returns the error of ctx.
+// Running guests can only be stopped once EnableMetering has been called: without it,
+// ctx is only checked before the guest is entered.
+func CallContext(ctx context.Context, w *WasmInstance, name string, args ...interface{}) (interface{}, error) {
+	if w.closed {
+		return nil, errClosed
+	}
+	fn, err := w.instance.Exports.GetRawFunction(name)
+	if err != nil {
+		return nil, err
+	}
+	if hasRefs(fn.Type()) {
+		return nil, fmt.Errorf("%s: %s", name, errReferenceTypes)
+	}
+	kinds := fn.Type().Params()
+	// v128 values are passed to the adapter of the function as two i64
+	lanes := w.info.v128().export(name)
+	count := len(kinds)
+	if lanes.any() {
+		count = len(lanes.Params)
+	}
+	if len(args) != count {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, count, len(args))
+	}
+	sig := w.info.externrefs().export(name)
+	params := make([]interface{}, 0, len(kinds))
+	for i, arg := range args {
+		switch {
+		case lanes.param(i):
+			v, ok := arg.([16]byte)
+			if !ok {
+				return nil, fmt.Errorf("%s: argument %d must be a [16]byte", name, i)
+			}
+			lo, hi := v128Halves(v)
+			params = append(params, lo, hi)
+			continue
+		case sig.param(i):
+			v, ok := arg.(goja.Value)
+			if !ok && arg != nil {
+				v = w.vm.ToValue(arg)
+			}
+			params = append(params, w.refs.lower(v))
+			continue
+		}
+		p, ok := goParam(arg, kinds[len(params)].Kind())
+		if !ok {
+			return nil, fmt.Errorf("%s: argument %d must be a number", name, i)
+		}
+		params = append(params, p)
+	}
+	r, err := w.call(ctx, fn, params)
+	if err != nil {
+		return nil, err
+	}
+	return w.refs.liftResults(sig, joinV128(lanes, r)), nil
+}
+
+// call calls fn, an exported function, with params.
+// It returns ErrInterrupted if the runtime of w was interrupted during the call,
+// or the error of ctx if it was done.
+func (w *WasmInstance) call(ctx context.Context, fn *wasmer.Function, params []interface{}) (interface{}, error) {
+	done, err := interruptible(w.vm, ctx, w.instance)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fn.Call(params...)
+	stopped := done()
+	w.finishCall()
+	if err != nil && stopped != nil {
+		return nil, stopped
+	}
+	if err != nil && w.exited {
+		err = exitError(w.exitCode)
+	} else {
+		err = guestError(w.guard, err)
+	}
+	if trap, ok := err.(*wasmer.TrapError); ok {
+		err = newTrap(trap, w.info)
+	}
+	return r, err
+}
+
+// errClosed is the error of calling a closed instance.
+var errClosed = errors.New("instance is closed")
+
+// Close releases what the runtime accounts to w: its memory no longer counts
+// against the memory limits of the runtime, and the JS values it was given as
+// externref are released. Its exports cannot be called afterwards.
+// Instances that are not closed are released when they are collected.
+func (w *WasmInstance) Close() {
+	w.closed = true
+	w.memoryHandle.release()
+	w.memoryHandle = nil
+	w.refs.release()
+}
+
+// ReleaseRef releases v, a JS value w was given as externref, once the guest no longer
+// needs it: the handles of v the guest kept read as null afterwards.
+func (w *WasmInstance) ReleaseRef(v goja.Value) {
+	w.refs.releaseValue(v)
+}
+
+// goParam converts the Go number v to a value of kind.
+func goParam(v interface{}, kind wasmer.ValueKind) (interface{}, bool) {
+	var i int64
+	var f float64
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i = rv.Int()
+		f = float64(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i = int64(rv.Uint())
+		f = float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = rv.Float()
+		i = int64(f)
+	default:
+		return nil, false
+	}
+	switch kind {
+	case wasmer.I32:
+		return int32(i), true
+	case wasmer.I64:
+		return i, true
+	case wasmer.F32:
+		return float32(f), true
+	case wasmer.F64:
+		return f, true
+	}
+	return nil, false
+}
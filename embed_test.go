@@ -0,0 +1,83 @@
+package wasm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestEmbedding(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	if _, err := NewModule(vm, []byte("\x00asm\x01\x00\x00\x00\xff")); err == nil {
+		t.Error("NewModule compiled an invalid module")
+	}
+	module, err := NewModule(vm, wat(t, `(module
+	  (import "env" "add" (func $add (param i32 i32) (result i32)))
+	  (func (export "add") (param i32 i32) (result i32) (call $add (local.get 0) (local.get 1)))
+	  (func (export "pair") (param f64) (result f64 i64) (local.get 0) (i64.const 7))
+	  (func (export "nothing"))
+	  (func (export "trap") unreachable))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imports, err := vm.RunString(`({env: {add: (a, b) => a + b}})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewInstance(vm, module, nil); err == nil {
+		t.Error("NewInstance linked a module without its imports")
+	}
+	instance, err := NewInstance(vm, module, imports)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		args []interface{}
+		want interface{}
+		err  string
+	}{
+		{"add", []interface{}{2, int64(3)}, int32(5), ""},
+		{"pair", []interface{}{1.5}, []interface{}{1.5, int64(7)}, ""},
+		{"nothing", nil, nil, ""},
+		{"add", []interface{}{1}, nil, "add expects 2 arguments, got 1"},
+		{"add", []interface{}{1, "2"}, nil, "add: argument 1 must be a number"},
+		{"missing", nil, nil, "missing"},
+	} {
+		got, err := instance.Call(c.name, c.args...)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s%v: got error %v, want %q", c.name, c.args, err, c.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s%v = %#v, %v, want %#v", c.name, c.args, got, err, c.want)
+		}
+	}
+	if _, err := instance.Call("trap"); !isTrap(err, "unreachable") {
+		t.Errorf("trap: got %v, want an unreachable *Trap", err)
+	}
+
+	// scripts see the objects of the module and the instance
+	vm.Set("module", module.Object())
+	vm.Set("instance", instance.Object())
+	v, err := vm.RunString(`module instanceof WebAssembly.Module && instance instanceof WebAssembly.Instance && instance.exports.add(1, 2) === 3`)
+	if err != nil || !v.ToBoolean() {
+		t.Errorf("the objects are not usable from scripts: %v, %v", v, err)
+	}
+
+	instance.Close()
+	if _, err := instance.Call("add", 1, 2); err != errClosed {
+		t.Errorf("call after Close: got %v, want %v", err, errClosed)
+	}
+}
+
+func isTrap(err error, kind string) bool {
+	trap, ok := err.(*Trap)
+	return ok && trap.Kind == kind
+}
@@ -0,0 +1,59 @@
+package wasm
+
+import (
+	"errors"
+
+	"github.com/dop251/goja"
+)
+
+// errorClasses are the error constructors of the WebAssembly object.
+var errorClasses = []string{"CompileError", "LinkError", "RuntimeError"}
+
+// enableErrors defines the error constructors on wasmObj, which inherit from Error.
+func enableErrors(vm *goja.Runtime, wasmObj *goja.Object) {
+	errorProto := vm.Get("Error").ToObject(vm).Get("prototype").ToObject(vm)
+	for _, name := range errorClasses {
+		wasmObj.Set(name, func(c goja.ConstructorCall, vm *goja.Runtime) *goja.Object {
+			if msg := c.Argument(0); !goja.IsUndefined(msg) {
+				c.This.DefineDataProperty("message", vm.ToValue(msg.String()), goja.FLAG_TRUE, goja.FLAG_FALSE, goja.FLAG_TRUE)
+			}
+			return nil
+		})
+		proto := wasmObj.Get(name).ToObject(vm).Get("prototype").ToObject(vm)
+		proto.SetPrototype(errorProto)
+		proto.DefineDataProperty("name", vm.ToValue(name), goja.FLAG_TRUE, goja.FLAG_FALSE, goja.FLAG_TRUE)
+		proto.DefineDataProperty("message", vm.ToValue(""), goja.FLAG_TRUE, goja.FLAG_FALSE, goja.FLAG_TRUE)
+	}
+}
+
+// instantiateError returns the error thrown by method when err prevents instantiation.
+func instantiateError(vm *goja.Runtime, method string, err error) *goja.Object {
+	switch err.(type) {
+	case *memoryLimitError:
+		return rangeError(vm, method+": "+err.Error())
+	case *ImportError:
+		return wasmError(vm, "LinkError", method+": "+err.Error())
+	}
+	return vm.NewTypeError(method + ": " + err.Error())
+}
+
+// wasmError returns a WebAssembly[name] error of vm with message msg,
+// or a Go error if WebAssembly is not enabled on vm.
+func wasmError(vm *goja.Runtime, name, msg string) *goja.Object {
+	if wasmObj, ok := vm.Get("WebAssembly").(*goja.Object); ok {
+		if ctor, ok := wasmObj.Get(name).(*goja.Object); ok {
+			if obj, err := vm.New(ctor, vm.ToValue(msg)); err == nil {
+				return obj
+			}
+		}
+	}
+	return vm.NewGoError(errors.New(msg))
+}
+
+// rangeError returns a RangeError of vm with message msg.
+func rangeError(vm *goja.Runtime, msg string) *goja.Object {
+	if obj, err := vm.New(vm.Get("RangeError"), vm.ToValue(msg)); err == nil {
+		return obj
+	}
+	return vm.NewTypeError(msg)
+}
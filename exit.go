@@ -0,0 +1,71 @@
+package wasm
+
+import (
+	"sync"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// exitModule implements proc_exit in wasm: it records the exit code and traps.
+// Host functions cannot stop a guest themselves, wasmer-go frees the trap
+// returned by a failing host function twice.
+const exitModule = `(module
+  (global $exited (export "exited") (mut i32) (i32.const 0))
+  (global $code (export "code") (mut i32) (i32.const 0))
+  (func (export "proc_exit") (param i32)
+    (global.set $exited (i32.const 1))
+    (global.set $code (local.get 0))
+    unreachable))`
+
+var (
+	exitModuleOnce  sync.Once
+	exitModuleBytes []byte
+	exitModuleErr   error
+)
+
+// exitTrap is the proc_exit function of a guest.
+type exitTrap struct {
+	instance *wasmer.Instance
+
+	fn     *wasmer.Function
+	exited *wasmer.Global
+	code   *wasmer.Global
+}
+
+func newExitTrap() (*exitTrap, error) {
+	exitModuleOnce.Do(func() {
+		exitModuleBytes, exitModuleErr = wasmer.Wat2Wasm(exitModule)
+	})
+	if exitModuleErr != nil {
+		return nil, exitModuleErr
+	}
+	module, err := wasmer.NewModule(helperStore(), exitModuleBytes)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := wasmer.NewInstance(module, wasmer.NewImportObject())
+	if err != nil {
+		return nil, err
+	}
+	e := &exitTrap{instance: instance}
+	if e.fn, err = instance.Exports.GetRawFunction("proc_exit"); err != nil {
+		return nil, err
+	}
+	if e.exited, err = instance.Exports.GetGlobal("exited"); err != nil {
+		return nil, err
+	}
+	if e.code, err = instance.Exports.GetGlobal("code"); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// status reports whether proc_exit was called and with which code.
+func (e *exitTrap) status() (bool, int32) {
+	exited, _ := e.exited.Get()
+	if exited.(int32) == 0 {
+		return false, 0
+	}
+	code, _ := e.code.Get()
+	return true, code.(int32)
+}
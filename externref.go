@@ -0,0 +1,456 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// wasmer 1.0.4 aborts the process when reference values cross its C API, so Compile
+// lowers externref to i32: the guest holds handles to the JS values it was given,
+// which the runtime maps back to the values when they cross back to JS.
+//
+// Since the guest can store handles anywhere, including its linear memory, the runtime
+// cannot tell when it drops one: an instance holds every distinct value it was given
+// until it is closed or collected, or until the embedder releases the value with
+// WasmInstance.ReleaseRef.
+
+// errReferenceTypes is the error of calling a function taking or returning
+// references that were not lowered, such as funcref.
+const errReferenceTypes = "reference types are not supported by this runtime"
+
+// errExternrefTables is the error of compiling a module with externref tables,
+// whose values wasm would read without the runtime mapping handles.
+var errExternrefTables = errors.New("externref tables are not supported by this runtime")
+
+// valueMarks marks parameters and results of a function, or the value of a global
+// as its only result, such as those that are externref in the original module.
+type valueMarks struct {
+	Params, Results []bool
+}
+
+func (s valueMarks) param(i int) bool {
+	return i < len(s.Params) && s.Params[i]
+}
+
+func (s valueMarks) result(i int) bool {
+	return i < len(s.Results) && s.Results[i]
+}
+
+func (s valueMarks) any() bool {
+	for _, marks := range [][]bool{s.Params, s.Results} {
+		for _, ref := range marks {
+			if ref {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// externrefs are the signatures of the exports and imports of a lowered module
+// using externref, exports by name and imports by importKey.
+type externrefs struct {
+	Exports map[string]valueMarks
+	Imports map[string]valueMarks
+}
+
+func importKey(module, name string) string {
+	return module + "\x00" + name
+}
+
+// export returns the signature of the export name. r may be nil.
+func (r *externrefs) export(name string) valueMarks {
+	if r == nil {
+		return valueMarks{}
+	}
+	return r.Exports[name]
+}
+
+// imported returns the signature of the import module.name. r may be nil.
+func (r *externrefs) imported(module, name string) valueMarks {
+	if r == nil {
+		return valueMarks{}
+	}
+	return r.Imports[importKey(module, name)]
+}
+
+// lowerExternref returns the binary module b with externref values replaced by
+// i32 handles, and the signatures using them. It returns b and nil if b has no
+// externref values, or if they cannot be lowered since ref.is_null would not tell
+// null funcref values from null handles once both are tested as i32.
+// It returns an error if b is invalid or has externref tables.
+func lowerExternref(b []byte) ([]byte, *externrefs, error) {
+	if len(b) < 8 || !bytes.Equal(b[:4], wasmMagic) {
+		return b, nil, nil
+	}
+	out := append([]byte(nil), b...)
+	var (
+		types     []valueMarks
+		funcTypes []uint32
+		globals   []bool
+		isNull    []int
+		funcrefs  bool
+		lowered   bool
+	)
+	refs := &externrefs{Exports: map[string]valueMarks{}, Imports: map[string]valueMarks{}}
+
+	// valType reads a value type, patching externref to i32.
+	valType := func(r *wasmReader) bool {
+		off := r.off
+		switch r.byte() {
+		case 0x6f:
+			if r.err == nil {
+				out[off] = 0x7f
+				lowered = true
+				return true
+			}
+		case 0x70:
+			funcrefs = true
+		}
+		return false
+	}
+	// refNull reads the operand of ref.null, patching ref.null extern to i32.const 0.
+	refNull := func(r *wasmReader) {
+		off := r.off
+		switch r.byte() {
+		case 0x6f:
+			out[off-1], out[off] = 0x41, 0x00
+			lowered = true
+		default:
+			funcrefs = true
+		}
+	}
+	constExpr := func(r *wasmReader) {
+		for r.err == nil {
+			switch op := r.byte(); op {
+			case 0x0b:
+				return
+			case 0xd0:
+				refNull(r)
+			default:
+				r.immediates(op)
+			}
+		}
+	}
+
+	r := &wasmReader{b: b, off: 8}
+	for !r.done() && r.err == nil {
+		id := r.byte()
+		size := int(r.u32())
+		start := r.off
+		r.bytes(size)
+		if r.err != nil {
+			break
+		}
+		s := &wasmReader{b: b[:start+size], off: start}
+		switch id {
+		case typeSection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				if s.byte() != 0x60 {
+					return b, nil, nil
+				}
+				var sig valueMarks
+				for c := s.u32(); c > 0 && s.err == nil; c-- {
+					sig.Params = append(sig.Params, valType(s))
+				}
+				for c := s.u32(); c > 0 && s.err == nil; c-- {
+					sig.Results = append(sig.Results, valType(s))
+				}
+				types = append(types, sig)
+			}
+		case importSection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				module := string(s.bytes(int(s.u32())))
+				name := string(s.bytes(int(s.u32())))
+				switch s.byte() {
+				case 0:
+					typ := s.u32()
+					if int(typ) >= len(types) {
+						return b, nil, nil
+					}
+					funcTypes = append(funcTypes, typ)
+					if types[typ].any() {
+						refs.Imports[importKey(module, name)] = types[typ]
+					}
+				case 1:
+					if s.byte() == 0x6f {
+						return nil, nil, errExternrefTables
+					}
+					s.limits()
+				case 2:
+					s.limits()
+				case 3:
+					ref := valType(s)
+					globals = append(globals, ref)
+					s.byte()
+					if ref {
+						refs.Imports[importKey(module, name)] = valueMarks{Results: []bool{true}}
+					}
+				default:
+					return b, nil, nil
+				}
+			}
+		case functionSection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				funcTypes = append(funcTypes, s.u32())
+			}
+		case tableSection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				if s.byte() == 0x6f {
+					return nil, nil, errExternrefTables
+				}
+				s.limits()
+			}
+		case globalSection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				globals = append(globals, valType(s))
+				s.byte()
+				constExpr(s)
+			}
+		case exportSection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				name := string(s.bytes(int(s.u32())))
+				kind := s.byte()
+				index := int(s.u32())
+				switch {
+				case kind == 0 && index < len(funcTypes) && int(funcTypes[index]) < len(types):
+					if sig := types[funcTypes[index]]; sig.any() {
+						refs.Exports[name] = sig
+					}
+				case kind == 3 && index < len(globals) && globals[index]:
+					refs.Exports[name] = valueMarks{Results: []bool{true}}
+				}
+			}
+		case codeSection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				size := int(s.u32())
+				body := &wasmReader{b: b[:s.off+size], off: s.off}
+				s.bytes(size)
+				for c := body.u32(); c > 0 && body.err == nil; c-- {
+					body.u32()
+					valType(body)
+				}
+				for !body.done() && body.err == nil {
+					op := body.byte()
+					switch op {
+					case 0x02, 0x03, 0x04, 0x06:
+						if !body.done() && (body.b[body.off] == 0x6f || body.b[body.off] == 0x70) {
+							valType(body)
+							continue
+						}
+					case 0x1c:
+						for c := body.u32(); c > 0 && body.err == nil; c-- {
+							valType(body)
+						}
+						continue
+					case 0xd0:
+						refNull(body)
+						continue
+					case 0xd1:
+						isNull = append(isNull, body.off-1)
+					case 0xd2, 0x25:
+						funcrefs = true
+					}
+					body.immediates(op)
+				}
+				if body.err != nil {
+					s.err = body.err
+				}
+			}
+		}
+		if s.err != nil {
+			r.err = s.err
+		}
+	}
+	if r.err != nil || !lowered || funcrefs && len(isNull) > 0 {
+		return b, nil, nil
+	}
+	for _, off := range isNull {
+		// i32.eqz
+		out[off] = 0x45
+	}
+
+	// i32 instructions would accept the externref values of an invalid module
+	if err := wasmer.ValidateModule(helperStore(), b); err != nil {
+		return nil, nil, err
+	}
+	if wasmer.ValidateModule(helperStore(), out) != nil {
+		return b, nil, nil
+	}
+	return out, refs, nil
+}
+
+// refTable maps the handles of the guests of a runtime to the JS values they stand for.
+// A value keeps its handle while an instance holds it.
+type refTable struct {
+	mu      sync.Mutex
+	entries map[uint32]*refEntry
+	handles map[interface{}]uint32
+	next    uint32
+}
+
+type refEntry struct {
+	value   goja.Value
+	key     interface{}
+	holders int
+}
+
+func newRefTable() *refTable {
+	return &refTable{entries: map[uint32]*refEntry{}, handles: map[interface{}]uint32{}}
+}
+
+// refUndefined keys undefined, which exports as nil like null.
+type refUndefined struct{}
+
+// refNaN and refNegativeZero key the numbers that are not equal to themselves,
+// or equal to another number, as map keys.
+type (
+	refNaN          struct{}
+	refNegativeZero struct{}
+)
+
+// externKey returns the key of v: objects by identity, primitives by value.
+func externKey(v goja.Value) interface{} {
+	if obj, ok := v.(*goja.Object); ok {
+		return obj
+	}
+	if goja.IsUndefined(v) {
+		return refUndefined{}
+	}
+	key := v.Export()
+	if f, ok := key.(float64); ok {
+		switch {
+		case math.IsNaN(f):
+			return refNaN{}
+		case f == 0 && math.Signbit(f):
+			return refNegativeZero{}
+		}
+	}
+	return key
+}
+
+// refHolder holds the handles given to an instance, and releases them when it is
+// released or collected. It must only be referenced by the instance, so that it is collected with it.
+type refHolder struct {
+	table   *refTable
+	handles map[uint32]bool
+}
+
+// newRefHolder returns a holder of handles of table, or of its own table if nil.
+func newRefHolder(table *refTable) *refHolder {
+	if table == nil {
+		table = newRefTable()
+	}
+	h := &refHolder{table: table, handles: map[uint32]bool{}}
+	// a backstop for instances that are never closed
+	runtime.SetFinalizer(h, (*refHolder).release)
+	return h
+}
+
+// release releases every handle of h. h may be nil.
+func (h *refHolder) release() {
+	if h == nil {
+		return
+	}
+	t := h.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for handle := range h.handles {
+		t.drop(handle)
+	}
+	h.handles = map[uint32]bool{}
+	runtime.SetFinalizer(h, nil)
+}
+
+// releaseValue releases the handle of v if h holds it. h may be nil.
+func (h *refHolder) releaseValue(v goja.Value) {
+	if h == nil || v == nil || goja.IsNull(v) {
+		return
+	}
+	t := h.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if handle, ok := t.handles[externKey(v)]; ok && h.handles[handle] {
+		delete(h.handles, handle)
+		t.drop(handle)
+	}
+}
+
+// drop removes a holder of handle, and the handle once it has none. t.mu must be held.
+func (t *refTable) drop(handle uint32) {
+	e := t.entries[handle]
+	if e.holders--; e.holders == 0 {
+		delete(t.entries, handle)
+		delete(t.handles, e.key)
+	}
+}
+
+// lower returns the handle of v, 0 for null.
+func (h *refHolder) lower(v goja.Value) int32 {
+	if v == nil || goja.IsNull(v) {
+		return 0
+	}
+	t := h.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := externKey(v)
+	handle, ok := t.handles[key]
+	if !ok {
+		if t.next++; t.next == 0 {
+			t.next++
+		}
+		handle = t.next
+		t.handles[key] = handle
+		t.entries[handle] = &refEntry{value: v, key: key}
+	}
+	if !h.handles[handle] {
+		h.handles[handle] = true
+		t.entries[handle].holders++
+	}
+	return int32(handle)
+}
+
+// lift returns the value of handle, null for 0 and for handles the instance was not given.
+func (h *refHolder) lift(handle int32) goja.Value {
+	if !h.handles[uint32(handle)] {
+		return goja.Null()
+	}
+	t := h.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.entries[uint32(handle)].value
+}
+
+// liftResults converts the handles in r, the results of a call with signature sig, to their values.
+func (h *refHolder) liftResults(sig valueMarks, r interface{}) interface{} {
+	if results, ok := r.([]interface{}); ok {
+		for i, v := range results {
+			if sig.result(i) {
+				results[i] = h.lift(v.(int32))
+			}
+		}
+		return results
+	}
+	if sig.result(0) {
+		return h.lift(r.(int32))
+	}
+	return r
+}
+
+// hasRefs reports whether typ has parameters or results wasmer cannot pass.
+func hasRefs(typ *wasmer.FunctionType) bool {
+	for _, kinds := range [][]*wasmer.ValueType{typ.Params(), typ.Results()} {
+		for _, kind := range kinds {
+			if kind.Kind() == wasmer.AnyRef || kind.Kind() == wasmer.FuncRef {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+const externrefWat = `(module
+  (import "env" "echo" (func $echo (param externref) (result externref)))
+  (global $g (export "g") (mut externref) (ref.null extern))
+  (func (export "id") (param externref) (result externref) local.get 0)
+  (func (export "viaHost") (param externref) (result externref) local.get 0 call $echo)
+  (func (export "isNull") (param externref) (result i32) local.get 0 ref.is_null)
+  (func (export "null") (result externref) ref.null extern)
+  (func (export "store") (param externref) local.get 0 global.set $g)
+  (func (export "load") (result externref) global.get $g)
+  (func (export "local") (param externref) (result externref) (local externref)
+    local.get 0 local.set 1 local.get 1)
+  (func (export "pick") (param externref externref i32) (result externref)
+    local.get 0 local.get 1 local.get 2 select (result externref)))`
+
+func wat(t *testing.T, src string) []byte {
+	t.Helper()
+	b, err := wasmer.Wat2Wasm(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLowerExternref(t *testing.T) {
+	b := wat(t, externrefWat)
+	lowered, refs, err := lowerExternref(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs == nil {
+		t.Fatal("module was not lowered")
+	}
+	if len(lowered) != len(b) {
+		t.Errorf("lowered module is %d bytes, want %d", len(lowered), len(b))
+	}
+	if err := wasmer.ValidateModule(helperStore(), lowered); err != nil {
+		t.Fatalf("lowered module is invalid: %v", err)
+	}
+	if bytes.Contains(lowered, []byte{0xd0, 0x6f}) {
+		t.Error("lowered module still has ref.null extern")
+	}
+
+	for name, want := range map[string]valueMarks{
+		"g":      {Results: []bool{true}},
+		"id":     {Params: []bool{true}, Results: []bool{true}},
+		"isNull": {Params: []bool{true}, Results: []bool{false}},
+		"null":   {Results: []bool{true}},
+		"store":  {Params: []bool{true}},
+		"pick":   {Params: []bool{true, true, false}, Results: []bool{true}},
+	} {
+		if got := refs.export(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("export %s is %+v, want %+v", name, got, want)
+		}
+	}
+	want := valueMarks{Params: []bool{true}, Results: []bool{true}}
+	if got := refs.imported("env", "echo"); !reflect.DeepEqual(got, want) {
+		t.Errorf("import echo is %+v, want %+v", got, want)
+	}
+
+	_, refs, err = lowerExternref(wat(t, `(module (import "env" "g" (global externref)) (global (export "h") i32 (i32.const 0)))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := refs.imported("env", "g"); !got.result(0) {
+		t.Errorf("imported global is %+v, want an externref result", got)
+	}
+	if got := refs.export("h"); got.any() {
+		t.Errorf("i32 global is %+v, want no externref", got)
+	}
+}
+
+func TestLowerExternrefUnchanged(t *testing.T) {
+	for _, src := range []string{
+		`(module (func (export "f") (param i32) (result i32) local.get 0))`,
+		// null funcref values cannot be told from null handles
+		`(module
+		  (func (export "f") (param externref) (result i32) local.get 0 ref.is_null)
+		  (func (export "g") (param funcref) (result i32) local.get 0 ref.is_null))`,
+	} {
+		b := wat(t, src)
+		lowered, refs, err := lowerExternref(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refs != nil || !bytes.Equal(lowered, b) {
+			t.Errorf("%s was lowered", src)
+		}
+	}
+}
+
+func TestLowerExternrefTables(t *testing.T) {
+	for _, src := range []string{
+		`(module (table (export "t") 1 externref))`,
+		`(module (import "env" "t" (table 1 externref)))`,
+	} {
+		if _, _, err := lowerExternref(wat(t, src)); !errors.Is(err, errExternrefTables) {
+			t.Errorf("%s: got %v, want %v", src, err, errExternrefTables)
+		}
+		if _, err := Compile(wat(t, src)); !errors.Is(err, errExternrefTables) {
+			t.Errorf("Compile(%s): got %v, want %v", src, err, errExternrefTables)
+		}
+	}
+}
+
+func newExternrefInstance(t *testing.T, vm *goja.Runtime) *WasmInstance {
+	t.Helper()
+	module, err := Compile(wat(t, externrefWat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imports := vm.NewObject()
+	env := vm.NewObject()
+	env.Set("echo", func(v goja.Value) goja.Value { return v })
+	imports.Set("env", env)
+	instance, err := NewInstance(vm, module.attach(vm), imports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func TestExternrefFromJS(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	vm.Set("instance", newExternrefInstance(t, vm).Object())
+	v, err := vm.RunString(`
+	  const e = instance.exports;
+	  const o = {}, f = () => 1, s = Symbol("s");
+	  const checks = {
+	    object: e.id(o) === o,
+	    function: e.id(f) === f,
+	    symbol: e.id(s) === s,
+	    string: e.id("str") === "str",
+	    number: e.id(42) === 42,
+	    nan: Number.isNaN(e.id(NaN)),
+	    negativeZero: Object.is(e.id(-0), -0),
+	    zero: Object.is(e.id(0), 0),
+	    undefined: e.id(undefined) === undefined,
+	    null: e.id(null) === null,
+	    host: e.viaHost(o) === o,
+	    local: e.local(f) === f,
+	    select: e.pick(o, f, 1) === o && e.pick(o, f, 0) === f,
+	    isNull: e.isNull(null) === 1 && e.isNull(o) === 0 && e.isNull(undefined) === 0,
+	    refNull: e.null() === null,
+	  };
+	  e.store(o);
+	  checks.global = e.load() === o && e.g.value === o;
+	  e.g.value = s;
+	  checks.globalFromJS = e.load() === s;
+	  Object.keys(checks).filter(k => !checks[k]).join(",");
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := v.String(); failed != "" {
+		t.Errorf("failed checks: %s", failed)
+	}
+}
+
+func TestExternrefFromGo(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	instance := newExternrefInstance(t, vm)
+	obj := vm.NewObject()
+	for i := 0; i < 2; i++ {
+		r, err := instance.Call("id", obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != goja.Value(obj) {
+			t.Errorf("call %d: got %v, want the object passed", i, r)
+		}
+	}
+	if r, err := instance.Call("null"); err != nil || !goja.IsNull(r.(goja.Value)) {
+		t.Errorf("null: got %v, %v", r, err)
+	}
+	if r, err := instance.Call("isNull", nil); err != nil || r != int32(1) {
+		t.Errorf("isNull(nil): got %v, %v", r, err)
+	}
+	if r, err := instance.Call("id", "go string"); err != nil || r.(goja.Value).String() != "go string" {
+		t.Errorf("id(string): got %v, %v", r, err)
+	}
+}
+
+func TestExternrefHandles(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	table := configOf(vm).refs
+	entries := func() int {
+		table.mu.Lock()
+		defer table.mu.Unlock()
+		return len(table.entries)
+	}
+	a, b := newExternrefInstance(t, vm), newExternrefInstance(t, vm)
+	obj := vm.NewObject()
+	for _, instance := range []*WasmInstance{a, b} {
+		for i := 0; i < 10; i++ {
+			if _, err := instance.Call("id", obj); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := instance.Call("id", math.NaN()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the instances share the handles of the same values
+	if n := entries(); n != 2 {
+		t.Fatalf("%d handles, want 2", n)
+	}
+
+	if _, err := a.Call("store", obj); err != nil {
+		t.Fatal(err)
+	}
+	a.ReleaseRef(obj)
+	if r, err := a.Call("load"); err != nil || !goja.IsNull(r.(goja.Value)) {
+		t.Errorf("released value: got %v, %v, want null", r, err)
+	}
+	if n := entries(); n != 2 {
+		t.Errorf("%d handles after releasing a value held by another instance, want 2", n)
+	}
+
+	a.Close()
+	if _, err := a.Call("id", obj); err != errClosed {
+		t.Errorf("call after Close: got %v, want %v", err, errClosed)
+	}
+	b.ReleaseRef(obj)
+	if n := entries(); n != 1 {
+		t.Errorf("%d handles, want 1", n)
+	}
+	b.Close()
+	if n := entries(); n != 0 {
+		t.Errorf("%d handles after Close, want 0", n)
+	}
+}
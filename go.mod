@@ -2,6 +2,8 @@ module github.com/YC-Lammy/goja_webassembly
 
 go 1.16
 
+// EnableMetering reads unexported fields of goja.Runtime and wasmer.Config,
+// see interrupt_test.go before updating either.
 require (
 	github.com/dop251/goja v0.0.0-20211203105952-bf6af58bbcc8
 	github.com/wasmerio/wasmer-go v1.0.4
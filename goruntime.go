@@ -28,9 +28,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math"
-	"os"
 	"strconv"
 	"time"
 	"unicode/utf8"
@@ -48,8 +47,55 @@ type GoInstance struct {
 	mem    *wasmer.Memory
 	getsp  wasmer.NativeFunction
 	resume wasmer.NativeFunction
+	// wasm is the WebAssembly.Instance running the program
+	wasm *WasmInstance
+
+	// values are the JS values that Go currently has references to, indexed by reference id
 	values map[uint32]goja.Value
-	ids    map[goja.Value]uint32
+	// goRefCounts is the number of references that Go has to a JS value, indexed by reference id
+	goRefCounts map[uint32]int
+	// ids maps JS values to reference ids, keyed by refKey
+	ids map[interface{}]uint32
+	// idPool holds unused ids that have been finalized by Go
+	idPool []uint32
+
+	// exited reports whether the Go program has exited
+	exited   bool
+	exitCode int32
+
+	// tinygo reports whether the program was compiled by TinyGo
+	tinygo bool
+	// exitTrap is the proc_exit function of TinyGo programs
+	exitTrap *exitTrap
+	// sleep is the timeout after which the scheduler of a TinyGo program must run, nil if none
+	sleep *time.Duration
+	// deterministic reports whether the program reads time from a virtual clock
+	deterministic bool
+
+	// system provides the clocks and entropy of the program
+	system WASISystem
+	// host records or replays the host calls of the program if set
+	host hostInterceptor
+	// guard calls the host functions, through host
+	guard *hostGuard
+	// trace is the memory of the program as host functions access it, marked by the memory helpers
+	trace *memoryTrace
+	// imports keeps the host functions alive, wasmer-go releases them when they are collected
+	imports []map[string]wasmer.IntoExtern
+	// global is the object the program sees as globalThis, the global object of vm if nil
+	global *goja.Object
+	// shims are the fs, process and path objects the program sees when global lacks them
+	shims map[string]goja.Value
+
+	stdio *stdio
+}
+
+// globalObject returns the object the program sees as globalThis.
+func (d *GoInstance) globalObject() *goja.Object {
+	if d.global != nil {
+		return d.global
+	}
+	return d.vm.GlobalObject()
 }
 
 // Get return Go value specified by name
@@ -58,28 +104,45 @@ func (d *GoInstance) Get(name string) goja.Value {
 }
 
 func (d *GoInstance) getInt32(addr int32) int32 {
+	d.trace.read(int64(addr), 4)
 	return int32(binary.LittleEndian.Uint32(d.mem.Data()[addr+0:]))
 }
 
 func (d *GoInstance) getInt64(addr int32) int64 {
+	d.trace.read(int64(addr), 8)
 	low := binary.LittleEndian.Uint32(d.mem.Data()[addr+0:])
 	high := binary.LittleEndian.Uint32(d.mem.Data()[addr+4:])
 	return int64(low) + int64(high)*4294967296
 }
 
 func (d *GoInstance) setInt32(addr int32, v int64) {
+	d.trace.write(int64(addr), 4)
 	binary.LittleEndian.PutUint32(d.mem.Data()[addr+0:], uint32(v))
 }
 
 func (d *GoInstance) setInt64(addr int32, v int64) {
+	d.trace.write(int64(addr), 8)
 	binary.LittleEndian.PutUint32(d.mem.Data()[addr+0:], uint32(v))
 	binary.LittleEndian.PutUint32(d.mem.Data()[addr+4:], uint32(v/4294967296))
 }
 
 func (d *GoInstance) setUint8(addr int32, v uint8) {
+	d.trace.write(int64(addr), 1)
 	d.mem.Data()[addr] = v
 }
 
+// readBytes returns n bytes at addr, which the host reads.
+func (d *GoInstance) readBytes(addr, n int64) []byte {
+	d.trace.read(addr, n)
+	return d.mem.Data()[addr : addr+n]
+}
+
+// writeBytes returns n bytes at addr, which the host writes.
+func (d *GoInstance) writeBytes(addr, n int64) []byte {
+	d.trace.write(addr, n)
+	return d.mem.Data()[addr : addr+n]
+}
+
 func (d *GoInstance) reflectSet(v *goja.Object, key string, value goja.Value) {
 	if v == nil {
 		panic(d.values[5])
@@ -98,31 +161,186 @@ func (d *GoInstance) reflectGet(v *goja.Object, key string) goja.Value {
 	if v == nil {
 		v = d.values[5].(*goja.Object)
 	}
-	return v.Get(key)
+	return d.get(v, key)
+}
+
+// get returns the property key of v. The global object of the program has
+// the Node shims as properties it lacks, without the runtime seeing them.
+func (d *GoInstance) get(v *goja.Object, key string) goja.Value {
+	value := v.Get(key)
+	if value == nil && v == d.globalObject() {
+		if d.shims == nil {
+			d.shims = nodeShims(d.vm)
+		}
+		value = d.shims[key]
+	}
+	return value
+}
+
+// makeFuncWrapper returns the JS function backing the js.Func with the given id.
+// Calling it records the pending event on the Go object, resumes the program
+// so that it handles the event and returns the result set by the handler.
+// Handlers may call back into JS, which may in turn call other wrappers.
+func (d *GoInstance) makeFuncWrapper(id goja.Value) goja.Value {
+	return d.vm.ToValue(func(call goja.FunctionCall) goja.Value {
+		args := make([]interface{}, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			args[i] = arg
+		}
+		event := d.vm.NewObject()
+		event.Set("id", id)
+		event.Set("this", call.This)
+		event.Set("args", d.vm.NewArray(args...))
+
+		d.this.Set("_pendingEvent", event)
+		d.resumeGuest()
+		return event.Get("result")
+	})
+}
+
+// resumeGuest resumes the execution of the Go program.
+func (d *GoInstance) resumeGuest() {
+	if d.exited {
+		panic(d.vm.NewGoError(errors.New("Go program has already exited")))
+	}
+	if d.resume == nil {
+		panic(d.vm.NewGoError(errors.New("Go program cannot be resumed")))
+	}
+	d.runGuest("resume", d.resume)
+}
+
+// runGuest calls fn, the export name of the Go program, when the host calls back into it.
+func (d *GoInstance) runGuest(name string, fn wasmer.NativeFunction) {
+	ctx := runtimeContext(d.vm)
+	done, err := interruptible(d.vm, ctx, d.inst)
+	if err != nil {
+		// the program did not see the event
+		d.this.Set("_pendingEvent", goja.Null())
+		stoppedResult(d.vm, err)
+		return
+	}
+	defer d.enter()()
+	defer d.guard.reenter(name, d.trace)()
+	// TinyGo programs stop with a trap when they exit from a callback
+	_, err = fn()
+	if err == nil {
+		err = d.tinyGoWake(func() bool { return isInterrupted(d.vm) || ctx.Err() != nil })
+	}
+	if stopped := done(); stopped != nil && err != nil {
+		// the program is left in the middle of its execution
+		d.exited = true
+		stoppedResult(d.vm, stopped)
+		return
+	}
+	d.checkExit()
+	if err != nil && !d.exited {
+		err = guestError(d.guard, err)
+		if ex := hostThrow(d.vm, err); ex != nil {
+			panic(ex)
+		}
+		panic(d.vm.NewGoError(err))
+	}
+}
+
+// enter marks d as the running Go program until the returned function is called,
+// so that the fs object uses its standard streams.
+func (d *GoInstance) enter() func() {
+	o, ok := d.get(d.globalObject(), "fs").(*goja.Object)
+	if !ok {
+		return func() {}
+	}
+	nodefs, ok := o.Export().(*NodeFS)
+	if !ok {
+		return func() {}
+	}
+	nodefs.active = append(nodefs.active, d)
+	return func() {
+		nodefs.active = nodefs.active[:len(nodefs.active)-1]
+	}
+}
+
+// memory returns the linear memory of the program, nil before it runs.
+func (d *GoInstance) memory() []byte {
+	if d.mem == nil {
+		return nil
+	}
+	return d.mem.Data()
+}
+
+// link returns the host functions of an import namespace of the program,
+// guarded and routed through the interceptor of d if set.
+func (d *GoInstance) link(store *wasmer.Store, funcs map[string]wasmer.IntoExtern) map[string]wasmer.IntoExtern {
+	if d.guard == nil {
+		d.guard = &hostGuard{h: d.host}
+		d.trace = &memoryTrace{data: d.memory, callback: d.callback}
+	}
+	var err error
+	if funcs, err = intercept(d.guard, funcs, d.trace, "runtime.wasmExit"); err != nil {
+		panic(d.vm.NewGoError(err))
+	}
+	d.imports = append(d.imports, funcs)
+	return funcs
+}
+
+// callback calls the export name of the program as the host does when it calls back into it.
+func (d *GoInstance) callback(name string) error {
+	fn, err := d.inst.Exports.GetFunction(name)
+	if err != nil {
+		return err
+	}
+	d.runGuest(name, fn)
+	return nil
+}
+
+func (d *GoInstance) streams() *stdio {
+	if d.stdio == nil {
+		d.stdio = &stdio{}
+	}
+	return d.stdio
+}
+
+// errorValue returns the JS value thrown as err.
+func (d *GoInstance) errorValue(err error) goja.Value {
+	switch err := err.(type) {
+	case *goja.Exception:
+		return err.Value()
+	case *thrownValue:
+		return err.value
+	}
+	return d.vm.NewGoError(err)
 }
 
 func (d *GoInstance) loadString(addr int32) string {
+	return string(d.loadSlice(addr))
+}
+
+func (d *GoInstance) loadSlice(addr int32) []byte {
 	array := d.getInt64(addr + 0)
 	alen := d.getInt64(addr + 8)
-	return string(d.mem.Data()[array : array+alen])
+	return d.readBytes(array, alen)
 }
 
-func (d *GoInstance) loadSlice(addr int32) []byte {
+// storeSlice returns the Go slice at addr, which the host fills.
+func (d *GoInstance) storeSlice(addr int32) []byte {
 	array := d.getInt64(addr + 0)
 	alen := d.getInt64(addr + 8)
-	return d.mem.Data()[array : array+alen]
+	return d.writeBytes(array, alen)
 }
 
 func (d *GoInstance) loadValue(addr int32) goja.Value {
-	bits := binary.LittleEndian.Uint64(d.mem.Data()[addr+0:])
-	fv := math.Float64frombits(bits)
+	return d.unboxValue(binary.LittleEndian.Uint64(d.readBytes(int64(addr), 8)))
+}
+
+// unboxValue returns the JS value referenced by ref.
+func (d *GoInstance) unboxValue(ref uint64) goja.Value {
+	fv := math.Float64frombits(ref)
 	if fv == 0 {
 		return goja.Undefined()
 	}
 	if !math.IsNaN(fv) {
 		return d.vm.ToValue(fv)
 	}
-	id := binary.LittleEndian.Uint32(d.mem.Data()[addr+0:])
+	id := uint32(ref)
 	//fmt.Println("loadValue", id, data.values[id])
 	return d.values[id]
 }
@@ -138,40 +356,46 @@ func (d *GoInstance) loadSliceOfValues(addr int32) []goja.Value {
 }
 
 func (d *GoInstance) storeValue(addr int32, v goja.Value) {
-	nanHead := 0x7FF80000
+	ref := d.boxValue(v)
+	binary.LittleEndian.PutUint64(d.writeBytes(int64(addr), 8), ref)
+}
 
-	switch val := v.Export().(type) {
-	case int64:
-		v = d.vm.ToValue(float64(val))
+// boxValue returns the reference to v passed to Go,
+// either a float64 or a NaN-boxed id with a type flag.
+func (d *GoInstance) boxValue(v goja.Value) uint64 {
+	nanHead := uint64(0x7FF80000)
+
+	if v == nil || goja.IsUndefined(v) {
+		return math.Float64bits(0)
 	}
 	//fmt.Printf("storeValue %v %v\n", addr, v)
-	switch t := v.Export().(type) {
-	case float64:
+	switch v.Export().(type) {
+	case int64, float64:
+		t := v.ToFloat()
 		if t != 0 {
 			if math.IsNaN(t) {
-				binary.LittleEndian.PutUint32(d.mem.Data()[addr+4:], uint32(nanHead))
-				binary.LittleEndian.PutUint32(d.mem.Data()[addr+0:], 0)
-				return
+				return nanHead << 32
 			}
-			bits := math.Float64bits(t)
-			binary.LittleEndian.PutUint64(d.mem.Data()[addr+0:], bits)
-			return
+			return math.Float64bits(t)
 		}
-	case nil:
-		bits := math.Float64bits(0)
-		binary.LittleEndian.PutUint64(d.mem.Data()[addr+0:], bits)
-		return
-	default:
 	}
 
-	id, ok := d.ids[v]
+	key := refKey(v)
+	id, ok := d.ids[key]
 	if !ok {
-		id = uint32(len(d.values))
-		d.ids[v] = id
+		if n := len(d.idPool); n > 0 {
+			id = d.idPool[n-1]
+			d.idPool = d.idPool[:n-1]
+		} else {
+			id = uint32(len(d.values))
+		}
+		d.values[id] = v
+		d.goRefCounts[id] = 0
+		d.ids[key] = id
 	}
-	d.values[id] = v
+	d.goRefCounts[id]++
 
-	typeFlag := 0
+	typeFlag := uint64(0)
 	_, ok = goja.AssertFunction(v)
 	if !ok {
 		if _, ok := v.(*goja.Object); ok {
@@ -180,6 +404,8 @@ func (d *GoInstance) storeValue(addr int32, v goja.Value) {
 			switch v.Export().(type) {
 			case string:
 				typeFlag = 2
+			case *goja.Symbol:
+				typeFlag = 3
 			}
 		}
 
@@ -187,59 +413,109 @@ func (d *GoInstance) storeValue(addr int32, v goja.Value) {
 		typeFlag = 4
 	}
 
-	binary.LittleEndian.PutUint32(d.mem.Data()[addr+4:], uint32(nanHead|typeFlag))
-	binary.LittleEndian.PutUint32(d.mem.Data()[addr:], id)
+	return (nanHead|typeFlag)<<32 | uint64(id)
+}
+
+// finalizeRef drops one Go reference to the value with the given id,
+// recycling the id once Go holds no more references to it.
+// Predefined values, unknown ids and the references of exited programs,
+// which released them all, are left alone.
+func (d *GoInstance) finalizeRef(id uint32) {
+	if n, ok := d.goRefCounts[id]; d.exited || !ok || n <= 0 || n == math.MaxInt32 {
+		return
+	}
+	d.goRefCounts[id]--
+	if d.goRefCounts[id] == 0 {
+		v := d.values[id]
+		d.values[id] = nil
+		delete(d.ids, refKey(v))
+		d.idPool = append(d.idPool, id)
+	}
+}
+
+// refKey returns the key used to look up the reference id of v.
+// Objects are identified by pointer, primitives by their exported value,
+// so that equal strings share an id like they do in wasm_exec.js.
+func refKey(v goja.Value) interface{} {
+	if o, ok := v.(*goja.Object); ok {
+		return o
+	}
+	switch e := v.Export().(type) {
+	case int64:
+		return float64(e)
+	default:
+		return e
+	}
 }
 
 var preCompiledInstanceOf = goja.MustCompile("", `
-function(a,b){
+(function(a,b){
 	return a instanceof b
-}
+})
 `, false)
 
-func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExtern {
-	data.this = data.vm.ToValue(map[string]interface{}{
-		"_pendingEvent": map[string]interface{}{
-			"id":   0,
-			"this": nil,
-		},
-		"_makeFuncWrapper": data.vm.ToValue(func(args goja.FunctionCall) goja.Value {
-			id := args.Arguments[0]
-			return data.vm.ToValue(func(args goja.FunctionCall) goja.Value {
-				event := data.vm.ToValue(map[string]interface{}{
-					"id":   id,
-					"this": nil,
-					"args": args,
-				})
-				data.values[6].ToObject(data.vm).Set("_pendingEvent", event)
-				_, err := data.resume()
-				if err != nil {
-					log.Print("err", err)
-				}
-				return event.(*goja.Object).Get("result")
-			})
-		}),
-	}).(*goja.Object)
-	data.values = map[uint32]goja.Value{
+// reset prepares d to run a new Go program.
+func (d *GoInstance) reset() {
+	d.system = d.system.withDefaults()
+	d.imports = nil
+	d.this = d.vm.NewObject()
+	d.this.Set("_pendingEvent", goja.Null())
+	d.this.Set("_makeFuncWrapper", func(call goja.FunctionCall) goja.Value {
+		return d.makeFuncWrapper(call.Argument(0))
+	})
+	d.exited = false
+	d.sleep = nil
+	d.values = map[uint32]goja.Value{
 		0: goja.NaN(),
-		1: data.vm.ToValue(0),
+		1: d.vm.ToValue(0),
 		2: goja.Null(),
-		3: data.vm.ToValue(true),
-		4: data.vm.ToValue(false),
-		5: data.vm.GlobalObject(),
-		6: data.this,
+		3: d.vm.ToValue(true),
+		4: d.vm.ToValue(false),
+		5: d.globalObject(),
+		6: d.this,
+	}
+	d.goRefCounts = map[uint32]int{}
+	for id := range d.values {
+		// predefined values are never finalized
+		d.goRefCounts[id] = math.MaxInt32
+	}
+	d.ids = map[interface{}]uint32{
+		refKey(d.vm.ToValue(0)):     1,
+		refKey(goja.Null()):         2,
+		refKey(d.vm.ToValue(true)):  3,
+		refKey(d.vm.ToValue(false)): 4,
+		refKey(d.globalObject()):    5,
+		refKey(d.this):              6,
+	}
+	d.idPool = nil
+}
+
+// checkExit records the exit status of TinyGo programs that called proc_exit.
+func (d *GoInstance) checkExit() {
+	if d.exitTrap == nil || d.exited {
+		return
 	}
-	data.ids = map[goja.Value]uint32{
-		data.vm.ToValue(0):     1,
-		goja.Null():            2,
-		data.vm.ToValue(true):  3,
-		data.vm.ToValue(false): 4,
-		data.vm.GlobalObject(): 5,
-		data.this:              6,
+	if exited, code := d.exitTrap.status(); exited {
+		d.exit(code)
 	}
+}
+
+// exit records that the Go program exited with code and releases its references.
+func (d *GoInstance) exit(code int32) {
+	d.exitCode = code
+	d.exited = true
+	d.streams().Flush()
+	d.values = nil
+	d.goRefCounts = nil
+	d.ids = nil
+	d.idPool = nil
+}
+
+func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExtern {
+	data.reset()
 
 	return map[string]wasmer.IntoExtern{
-		"debug": wasmer.NewFunction(
+		"debug": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -248,7 +524,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"runtime.resetMemoryDataView": wasmer.NewFunction(
+		"runtime.resetMemoryDataView": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -256,18 +532,18 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"runtime.wasmExit": wasmer.NewFunction(
+		"runtime.wasmExit": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
 				//println("runtime.wasmExit")
 				sp := args[0].I32()
 				sp >>= 0
-				os.Exit(int(data.getInt32(sp + 8)))
+				data.exit(data.getInt32(sp + 8))
 				return []wasmer.Value{}, nil
 			},
 		),
-		"runtime.wasmWrite": wasmer.NewFunction(
+		"runtime.wasmWrite": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -276,40 +552,37 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				fd := data.getInt64(sp + 8)
 				p := data.getInt64(sp + 16)
 				n := data.getInt32(sp + 24)
-				switch fd {
-				case 1:
-					os.Stdout.Write(data.mem.Data()[p : p+int64(n)])
-				case 2:
-					os.Stderr.Write(data.mem.Data()[p : p+int64(n)])
+				if w := data.streams().writer(fd); w != nil {
+					w.Write(data.readBytes(p, int64(n)))
 				}
 				return []wasmer.Value{}, nil
 			},
 		),
-		"runtime.nanotime1": wasmer.NewFunction(
+		"runtime.nanotime1": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
 				//println("runtime.nanotime1")
 				sp := args[0].I32()
 				sp >>= 0
-				data.setInt64(sp+8, time.Now().UnixNano())
+				data.setInt64(sp+8, int64(data.system.Nanotime()))
 				return []wasmer.Value{}, nil
 			},
 		),
-		"runtime.walltime": wasmer.NewFunction(
+		"runtime.walltime": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
 				//println("runtime.walltime")
 				sp := args[0].I32()
 				sp >>= 0
-				msec := time.Now().UnixNano() / int64(time.Millisecond)
-				data.setInt64(sp+8, msec/1000)
-				data.setInt32(sp+16, (msec%1000)*1000000)
+				now := data.system.Walltime()
+				data.setInt64(sp+8, now.Unix())
+				data.setInt32(sp+16, int64(now.Nanosecond()))
 				return []wasmer.Value{}, nil
 			},
 		),
-		"runtime.scheduleTimeoutEvent": wasmer.NewFunction(
+		"runtime.scheduleTimeoutEvent": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -317,7 +590,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"runtime.clearTimeoutEvent": wasmer.NewFunction(
+		"runtime.clearTimeoutEvent": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -325,26 +598,31 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"runtime.getRandomData": wasmer.NewFunction(
+		"runtime.getRandomData": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
 				//println("runtime.getRandomData")
 				sp := args[0].I32()
 				sp >>= 0
-				data.loadSlice(sp + 8)
+				if _, err := io.ReadFull(data.system.Random, data.storeSlice(sp+8)); err != nil {
+					return nil, err
+				}
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.finalizeRef": wasmer.NewFunction(
+		"syscall/js.finalizeRef": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
 				//println("syscall/js.finalizeRef")
+				sp := args[0].I32()
+				sp >>= 0
+				data.finalizeRef(binary.LittleEndian.Uint32(data.readBytes(int64(sp+8), 4)))
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.stringVal": wasmer.NewFunction(
+		"syscall/js.stringVal": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -355,7 +633,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valueGet": wasmer.NewFunction(
+		"syscall/js.valueGet": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) (vals []wasmer.Value, err error) {
@@ -379,7 +657,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return vals, nil
 			},
 		),
-		"syscall/js.valueSet": wasmer.NewFunction(
+		"syscall/js.valueSet": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) (vals []wasmer.Value, err error) {
@@ -398,7 +676,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return vals, nil
 			},
 		),
-		"syscall/js.valueDelete": wasmer.NewFunction(
+		"syscall/js.valueDelete": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) (vals []wasmer.Value, err error) {
@@ -419,7 +697,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return vals, nil
 			},
 		),
-		"syscall/js.valueIndex": wasmer.NewFunction(
+		"syscall/js.valueIndex": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) (vals []wasmer.Value, err error) {
@@ -440,7 +718,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valueSetIndex": wasmer.NewFunction(
+		"syscall/js.valueSetIndex": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) (vals []wasmer.Value, err error) {
@@ -462,7 +740,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valueInvoke": wasmer.NewFunction(
+		"syscall/js.valueInvoke": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) (vals []wasmer.Value, err error) {
@@ -478,15 +756,15 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				}
 
 				arg := data.loadSliceOfValues(sp + 16)
-				result, err := method(goja.Undefined(), arg...)
+				result, callErr := method(goja.Undefined(), arg...)
 
-				if err != nil {
+				if callErr != nil {
 					if v, err := data.getsp(); err == nil {
 						sp = v.(int32)
 						sp >>= 0
-						data.storeValue(sp+40, data.vm.NewGoError(err))
+						data.storeValue(sp+40, data.errorValue(callErr))
 
-						data.mem.Data()[sp+48] = 0
+						data.setUint8(sp+48, 0)
 					}
 				} else {
 					if v, err := data.getsp(); err == nil {
@@ -494,14 +772,14 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 						sp >>= 0
 						data.storeValue(sp+40, result)
 
-						data.mem.Data()[sp+48] = 1
+						data.setUint8(sp+48, 1)
 					}
 				}
 
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valueCall": wasmer.NewFunction(
+		"syscall/js.valueCall": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -523,15 +801,15 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				}
 				arg := data.loadSliceOfValues(sp + 32)
 
-				result, err := method(v, arg...)
+				result, callErr := method(v, arg...)
 
-				if err != nil {
+				if callErr != nil {
 					if v, err := data.getsp(); err == nil {
 						sp = v.(int32)
 						sp >>= 0
 
-						data.storeValue(sp+56, data.vm.NewGoError(err))
-						data.mem.Data()[sp+64] = 0
+						data.storeValue(sp+56, data.errorValue(callErr))
+						data.setUint8(sp+64, 0)
 					}
 				} else {
 					if v, err := data.getsp(); err == nil {
@@ -539,14 +817,14 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 						sp >>= 0
 
 						data.storeValue(sp+56, result)
-						data.mem.Data()[sp+64] = 1
+						data.setUint8(sp+64, 1)
 					}
 				}
 
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valueNew": wasmer.NewFunction(
+		"syscall/js.valueNew": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(arg []wasmer.Value) ([]wasmer.Value, error) {
@@ -556,7 +834,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 
 				v := data.loadValue(sp + 8)
 				args := data.loadSliceOfValues(sp + 16)
-				result, err := data.vm.New(v, args...)
+				result, newErr := data.vm.New(v, args...)
 
 				s, err := data.getsp() // see comment above
 				if err != nil {
@@ -564,18 +842,18 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				}
 				sp = s.(int32)
 				sp >>= 0
-				if err != nil {
+				if newErr == nil {
 					data.storeValue(sp+40, result)
-					data.mem.Data()[sp+48] = 1
+					data.setUint8(sp+48, 1)
 				} else {
-					data.storeValue(sp+40, data.vm.NewGoError(err))
-					data.mem.Data()[sp+48] = 0
+					data.storeValue(sp+40, data.errorValue(newErr))
+					data.setUint8(sp+48, 0)
 				}
 
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valueLength": wasmer.NewFunction(
+		"syscall/js.valueLength": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -598,7 +876,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valuePrepareString": wasmer.NewFunction(
+		"syscall/js.valuePrepareString": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -616,7 +894,7 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valueLoadString": wasmer.NewFunction(
+		"syscall/js.valueLoadString": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -627,22 +905,17 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				if str == goja.Undefined() || str == goja.NaN() || str == goja.Null() {
 					return []wasmer.Value{}, nil
 				}
-				b := str.ToObject(data.vm)
-				var buf []byte
-				ar, ok := b.Export().(goja.ArrayBuffer)
-				if !ok {
-					if b, ok := str.Export().(goja.ArrayBuffer); ok {
-						buf = b.Bytes()
-					}
+				b := str.ToObject(data.vm).Get("buffer")
+				if b == nil {
+					return []wasmer.Value{}, nil
 				}
-				buf = ar.Bytes()
-				if buf != nil {
-					copy(data.loadSlice(sp+16), buf)
+				if ar, ok := b.Export().(goja.ArrayBuffer); ok {
+					copy(data.storeSlice(sp+16), ar.Bytes())
 				}
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.valueInstanceOf": wasmer.NewFunction(
+		"syscall/js.valueInstanceOf": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
@@ -656,67 +929,49 @@ func goRuntime(store *wasmer.Store, data *GoInstance) map[string]wasmer.IntoExte
 				isInstanceof, _ := c(goja.Null(), v1, v2)
 
 				if isInstanceof.ToBoolean() {
-					data.mem.Data()[sp+24] = 1
+					data.setUint8(sp+24, 1)
 				} else {
-					data.mem.Data()[sp+24] = 0
+					data.setUint8(sp+24, 0)
 				}
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.copyBytesToGo": wasmer.NewFunction(
+		"syscall/js.copyBytesToGo": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
 				//println("syscall/js.copyBytesToJS")
 				sp := args[0].I32()
 				sp >>= 0
-				dst := data.loadSlice(sp + 8)
-				src := data.loadValue(sp + 32)
-
-				obj, ok := src.(*goja.Object)
-				if !ok {
-					data.setUint8(sp+48, 0)
-					return []wasmer.Value{}, nil
-				}
-				ar := obj.Get("buffer").Export()
-				arr, ok := ar.(goja.ArrayBuffer)
-				if !ok {
+				src := typedArrayBytes(data.vm, data.loadValue(sp+32))
+				if src == nil {
 					data.setUint8(sp+48, 0)
 					return []wasmer.Value{}, nil
 				}
 
-				copy(dst, arr.Bytes()[:len(dst)])
-				data.setInt64(sp+40, int64(len(dst)))
+				n := copy(data.storeSlice(sp+8), src)
+				data.setInt64(sp+40, int64(n))
 				data.setUint8(sp+48, 1)
 
 				return []wasmer.Value{}, nil
 			},
 		),
-		"syscall/js.copyBytesToJS": wasmer.NewFunction(
+		"syscall/js.copyBytesToJS": newHostFunction(
 			store,
 			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
 			func(args []wasmer.Value) ([]wasmer.Value, error) {
 				//println("syscall/js.copyBytesToJS")
 				sp := args[0].I32()
 				sp >>= 0
-				dst := data.loadValue(sp + 8)
-				src := data.loadSlice(sp + 32)
-
-				obj, ok := dst.(*goja.Object)
-				if !ok {
-					data.setUint8(sp+48, 0)
-					return []wasmer.Value{}, nil
-				}
-				ar := obj.Get("buffer").Export()
-				arr, ok := ar.(goja.ArrayBuffer)
-				if !ok {
+				dst := typedArrayBytes(data.vm, data.loadValue(sp+8))
+				src := data.loadSlice(sp + 16)
+				if dst == nil {
 					data.setUint8(sp+48, 0)
 					return []wasmer.Value{}, nil
 				}
 
-				d := arr.Bytes()
-				copy(d, src[:len(d)])
-				data.setInt64(sp+40, int64(len(d)))
+				n := copy(dst, src)
+				data.setInt64(sp+40, int64(n))
 				data.setUint8(sp+48, 1)
 
 				return []wasmer.Value{}, nil
@@ -0,0 +1,202 @@
+package wasm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func newGoInstance(vm *goja.Runtime) *GoInstance {
+	d := &GoInstance{vm: vm}
+	d.reset()
+	return d
+}
+
+// refID returns the id of the NaN-boxed reference ref.
+func refID(ref uint64) uint32 {
+	return uint32(ref)
+}
+
+func TestGoRefCounts(t *testing.T) {
+	vm := goja.New()
+	d := newGoInstance(vm)
+	a, b := vm.NewObject(), vm.NewObject()
+
+	id := refID(d.boxValue(a))
+	if id != 7 {
+		t.Fatalf("first id is %d, want 7 after the predefined values", id)
+	}
+	if again := refID(d.boxValue(a)); again != id || d.goRefCounts[id] != 2 {
+		t.Fatalf("a has id %d and %d references, want %d and 2", again, d.goRefCounts[id], id)
+	}
+	// equal strings share an id
+	if s1, s2 := refID(d.boxValue(vm.ToValue("s"))), refID(d.boxValue(vm.ToValue("s"))); s1 != s2 {
+		t.Errorf("equal strings have ids %d and %d", s1, s2)
+	}
+
+	d.finalizeRef(id)
+	if d.values[id] != a {
+		t.Fatal("a was released while Go holds a reference")
+	}
+	d.finalizeRef(id)
+	if d.values[id] != nil || len(d.idPool) != 1 {
+		t.Fatalf("a was not released: %v, pool %v", d.values[id], d.idPool)
+	}
+	// further finalizations of a released id are ignored
+	d.finalizeRef(id)
+	if d.goRefCounts[id] != 0 || len(d.idPool) != 1 {
+		t.Fatalf("released id was finalized again: %d references, pool %v", d.goRefCounts[id], d.idPool)
+	}
+	if reused := refID(d.boxValue(b)); reused != id || d.values[id] != b {
+		t.Errorf("b has id %d, want the recycled id %d", reused, id)
+	}
+	if fresh := refID(d.boxValue(a)); fresh == id {
+		t.Errorf("a has the id of b")
+	}
+
+	// predefined values are never released
+	for id := uint32(1); id <= 6; id++ {
+		v := d.values[id]
+		d.finalizeRef(id)
+		if d.values[id] != v || len(d.idPool) != 0 {
+			t.Errorf("predefined value %d was released", id)
+		}
+	}
+	if global := refID(d.boxValue(vm.GlobalObject())); global != 5 {
+		t.Errorf("the global object has id %d, want 5", global)
+	}
+
+	// programs may finalize references after they exit
+	d.exit(0)
+	d.finalizeRef(id)
+	d.finalizeRef(5)
+}
+
+// funcOfWat is a TinyGo program that sets cb to the js.Func with id 1 when it starts,
+// and resumes with the body of resume.
+const funcOfWat = `(module
+  (import "gojs" "syscall/js.valueGet" (func $valueGet (param i64 i32 i32) (result i64)))
+  (import "gojs" "syscall/js.valueSet" (func $valueSet (param i64 i32 i32 i64)))
+  (import "gojs" "syscall/js.valueCall" (func $valueCall (param i32 i64 i32 i32 i32 i32 i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 0) "_makeFuncWrapper")
+  (data (i32.const 16) "cb")
+  (data (i32.const 24) "\00\00\00\00\00\00\f0\3f")
+  (data (i32.const 32) "_pendingEvent")
+  (data (i32.const 48) "this")
+  (data (i32.const 56) "args")
+  (data (i32.const 64) "result")
+  (data (i32.const 72) "handle")
+  (func $start (export "_start")
+    (call $valueCall (i32.const 200) (i64.const 0x7FF8000100000006) (i32.const 0) (i32.const 16) (i32.const 24) (i32.const 1) (i32.const 1))
+    (call $valueSet (i64.const ` + tinyGoGlobal + `) (i32.const 16) (i32.const 2) (i64.load (i32.const 200))))
+  %s)`
+
+func TestFuncOfDispatch(t *testing.T) {
+	vm := newTinyGoRuntime(t, fmt.Sprintf(funcOfWat, dispatchWat))
+	v, err := vm.RunString(`
+	  // each handler calls back into the program until depth reaches 0
+	  var handle = (self, args) => args[0] === 0
+	    ? self.name + args[1]
+	    : self.name + cb.call({name: self.name + ">"}, args[0] - 1, args[1]);
+	  const go = new Go();
+	  go.run(new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject));
+	  cb.call({name: "a"}, 2, "!");
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.String(), "aa>a>>!"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// dispatchWat handles the events of funcOfWat: it clears the pending event
+// and sets its result to handle(this, args), like the handler of syscall/js.
+// It counts the events in handled.
+const dispatchWat = `(global $handled (export "handled") (mut i32) (i32.const 0))
+	(func (export "resume") (local $event i64)
+	  (global.set $handled (i32.add (global.get $handled) (i32.const 1)))
+	  (local.set $event (call $valueGet (i64.const 0x7FF8000100000006) (i32.const 32) (i32.const 13)))
+	  (call $valueSet (i64.const 0x7FF8000100000006) (i32.const 32) (i32.const 13) (i64.const 0x7FF8000000000002))
+	  (i64.store (i32.const 300) (call $valueGet (local.get $event) (i32.const 48) (i32.const 4)))
+	  (i64.store (i32.const 308) (call $valueGet (local.get $event) (i32.const 56) (i32.const 4)))
+	  (call $valueCall (i32.const 320) (i64.const ` + tinyGoGlobal + `) (i32.const 72) (i32.const 6) (i32.const 300) (i32.const 2) (i32.const 2))
+	  (call $valueSet (local.get $event) (i32.const 64) (i32.const 6) (i64.load (i32.const 320))))`
+
+func TestFuncOfAfterExit(t *testing.T) {
+	for _, c := range []struct {
+		resume string
+		want   string
+	}{
+		// the program exits when it handles the first event
+		{`(func (export "resume") (call $exit (i32.const 3)))`, "undefined,Go program has already exited"},
+		// the program does not handle events
+		{``, "Go program cannot be resumed,Go program cannot be resumed"},
+	} {
+		vm := newTinyGoRuntime(t, fmt.Sprintf(funcOfWat, c.resume))
+		v, err := vm.RunString(`
+		  const go = new Go();
+		  go.run(new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject));
+		  const call = () => { try { return String(cb()) } catch (e) { return e.message } };
+		  [call(), call()].join();
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := v.String(); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestGoGlobal(t *testing.T) {
+	// the program copies x to seen on its global object
+	const src = `(module
+	  (import "gojs" "syscall/js.valueGet" (func $valueGet (param i64 i32 i32) (result i64)))
+	  (import "gojs" "syscall/js.valueSet" (func $valueSet (param i64 i32 i32 i64)))
+	  (memory (export "memory") 1)
+	  (data (i32.const 0) "x")
+	  (data (i32.const 8) "seen")
+	  (func (export "_start")
+	    (call $valueSet (i64.const ` + tinyGoGlobal + `) (i32.const 8) (i32.const 4)
+	      (call $valueGet (i64.const ` + tinyGoGlobal + `) (i32.const 0) (i32.const 1)))))`
+	vm := newTinyGoRuntime(t, src)
+	v, err := vm.RunString(`
+	  var x = "runtime";
+	  const sandbox = {x: "sandbox"};
+	  const go = new Go({global: sandbox});
+	  go.run(new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject));
+	  [sandbox.seen, typeof seen].join();
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.String(), "sandbox,undefined"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// from Go
+	vm = newTinyGoRuntime(t, src)
+	sandbox := vm.NewObject()
+	sandbox.Set("x", "from Go")
+	g, err := vm.RunString(`new Go()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Export().(*GoClass).SetGlobal(sandbox)
+	vm.Set("go", g)
+	if _, err := vm.RunString(`go.run(new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject))`); err != nil {
+		t.Fatal(err)
+	}
+	if got := sandbox.Get("seen"); got == nil || got.String() != "from Go" {
+		t.Errorf("SetGlobal: the program saw %v", got)
+	}
+
+	if _, err := vm.RunString(`new Go({global: 1})`); err == nil || !strings.Contains(err.Error(), "TypeError: Go: option global must be an object") {
+		t.Errorf("global that is not an object: got %v", err)
+	}
+}
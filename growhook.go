@@ -0,0 +1,501 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Guests grow their memory with the memory.grow instruction, which wasmer does not let
+// embedders intercept. Modules are rewritten when they are compiled so that the instruction
+// calls a function appended to the module, which fails like memory.grow when the memory
+// would grow past the number of pages held by an appended global. Runtimes with memory
+// limits keep the global of their instances up to date, see memoryBudget.
+
+const (
+	// hiddenPrefix starts the names of the exports added to modules.
+	hiddenPrefix = "__goja_"
+	// growLimitExport is the global holding the pages a memory can grow to.
+	growLimitExport = hiddenPrefix + "memory_limit"
+	// growMemoryExport exports the memory of the module, which it may not export itself.
+	growMemoryExport = hiddenPrefix + "memory"
+)
+
+// maxPages is the number of pages of the largest memory, the initial limit of modules.
+const maxPages = 65536
+
+// blockTypes are the block types encoded in one byte: empty and the value types.
+var blockTypes = []byte{0x40, 0x7f, 0x7e, 0x7d, 0x7c, 0x7b, 0x70, 0x6f}
+
+var errMalformed = errors.New("malformed module")
+
+// section ids, in the order of the binary format
+const (
+	customSection    = 0
+	typeSection      = 1
+	importSection    = 2
+	functionSection  = 3
+	tableSection     = 4
+	memorySection    = 5
+	globalSection    = 6
+	exportSection    = 7
+	startSection     = 8
+	elementSection   = 9
+	codeSection      = 10
+	dataSection      = 11
+	dataCountSection = 12
+	tagSection       = 13
+)
+
+// sectionOrder ranks the sections, whose ids are not in order.
+var sectionOrder = map[byte]int{
+	typeSection: 1, importSection: 2, functionSection: 3, tableSection: 4, memorySection: 5,
+	tagSection: 6, globalSection: 7, exportSection: 8, startSection: 9, elementSection: 10,
+	dataCountSection: 11, codeSection: 12, dataSection: 13,
+}
+
+type wasmSection struct {
+	id   byte
+	data []byte
+	// off is the offset of data in the original module, -1 for added sections
+	off int
+}
+
+// hookMemoryGrow returns the binary module b with memory.grow calling the limit check,
+// or b if it has no memory or cannot be rewritten, in which case its memory is only
+// checked at instantiation and when it is grown by the host. The offsets map the
+// code of the returned module to the code of b.
+func hookMemoryGrow(b []byte) ([]byte, offsetMap) {
+	hooked, offsets, err := rewriteMemoryGrow(b)
+	if err != nil {
+		return b, nil
+	}
+	return hooked, offsets
+}
+
+func rewriteMemoryGrow(b []byte) ([]byte, offsetMap, error) {
+	sections, err := splitSections(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	growType := -1
+	var types, importedFuncs, importedGlobals, memories, funcs, globals, exports, bodies uint32
+	find := func(id byte) []byte {
+		for _, s := range sections {
+			if s.id == id {
+				return s.data
+			}
+		}
+		return nil
+	}
+	if data := find(typeSection); data != nil {
+		r := &wasmReader{b: data}
+		types = r.u32()
+		for i := uint32(0); i < types; i++ {
+			if r.byte() != 0x60 {
+				return nil, nil, errMalformed
+			}
+			params := r.bytes(int(r.u32()))
+			results := r.bytes(int(r.u32()))
+			if growType < 0 && bytes.Equal(params, []byte{0x7f}) && bytes.Equal(results, []byte{0x7f}) {
+				growType = int(i)
+			}
+		}
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+	}
+	if data := find(importSection); data != nil {
+		r := &wasmReader{b: data}
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			r.bytes(int(r.u32()))
+			r.bytes(int(r.u32()))
+			switch r.byte() {
+			case 0:
+				r.u32()
+				importedFuncs++
+			case 1:
+				r.byte()
+				r.limits()
+			case 2:
+				r.limits()
+				memories++
+			case 3:
+				r.byte()
+				r.byte()
+				importedGlobals++
+			case 4:
+				r.byte()
+				r.u32()
+			default:
+				return nil, nil, errMalformed
+			}
+		}
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+	}
+	for _, c := range []struct {
+		id    byte
+		count *uint32
+	}{{functionSection, &funcs}, {memorySection, &memories}, {globalSection, &globals}, {exportSection, &exports}, {codeSection, &bodies}} {
+		if data := find(c.id); data != nil {
+			r := &wasmReader{b: data}
+			n := r.u32()
+			if r.err != nil {
+				return nil, nil, r.err
+			}
+			*c.count += n
+		}
+	}
+	if memories != 1 || funcs != bodies {
+		return nil, nil, errMalformed
+	}
+
+	growFunc := importedFuncs + funcs
+	limitGlobal := importedGlobals + globals
+
+	// type of the check, (param i32) (result i32)
+	if growType < 0 {
+		growType = int(types)
+		sections = appendEntry(sections, typeSection, types, []byte{0x60, 1, 0x7f, 1, 0x7f})
+	}
+	sections = appendEntry(sections, functionSection, funcs, appendU32(nil, uint32(growType)))
+	// (global (mut i32) (i32.const 65536))
+	global := []byte{0x7f, 1, 0x41}
+	global = appendS32(global, maxPages)
+	sections = appendEntry(sections, globalSection, globals, append(global, 0x0b))
+	export := appendName(nil, growLimitExport)
+	export = appendU32(append(export, 3), limitGlobal)
+	export = appendName(export, growMemoryExport)
+	export = append(export, 2, 0)
+	sections = appendEntries(sections, exportSection, exports, 2, export)
+
+	code := []byte{0}
+	code = append(code,
+		0x20, 0, 0xad, // delta as i64
+		0x3f, 0, 0xad, 0x7c, // plus the current size
+		0x23)
+	code = appendU32(code, limitGlobal)
+	code = append(code, 0xad, 0x56, // greater than the limit
+		0x04, 0x7f, 0x41, 0x7f, // then -1
+		0x05, 0x20, 0, 0x40, 0, // else grow
+		0x0b, 0x0b)
+	body := appendU32(nil, uint32(len(code)))
+	body = append(body, code...)
+
+	sections, shifts, err := rewriteCode(sections, func(fn []byte) ([]byte, offsetMap, error) {
+		return rewriteBody(fn, growFunc)
+	}, 1, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, offsets := assembleModule(b[:8], sections, shifts)
+	return out, offsets, nil
+}
+
+// splitSections returns the sections of the binary module b.
+func splitSections(b []byte) ([]wasmSection, error) {
+	if len(b) < 8 || !bytes.Equal(b[:4], wasmMagic) {
+		return nil, errMalformed
+	}
+	var sections []wasmSection
+	r := &wasmReader{b: b, off: 8}
+	for !r.done() {
+		id := r.byte()
+		size := int(r.u32())
+		off := r.off
+		data := r.bytes(size)
+		if r.err != nil {
+			return nil, r.err
+		}
+		sections = append(sections, wasmSection{id: id, data: data, off: off})
+	}
+	return sections, nil
+}
+
+// rewriteCode rewrites the function bodies of the code section with rewrite, and appends
+// n functions whose bodies, prefixed with their sizes, are bodies. The shifts map the
+// rewritten code section to the original one, relative to their starts.
+func rewriteCode(sections []wasmSection, rewrite func([]byte) ([]byte, offsetMap, error), n uint32, bodies []byte) ([]wasmSection, offsetMap, error) {
+	var shifts offsetMap
+	for i, s := range sections {
+		if s.id != codeSection {
+			continue
+		}
+		r := &wasmReader{b: s.data}
+		count := r.u32()
+		rewritten := appendU32(nil, count+n)
+		for ; count > 0 && r.err == nil; count-- {
+			size := int(r.u32())
+			start := r.off
+			fn, moved, err := rewrite(r.bytes(size))
+			if err != nil {
+				return nil, nil, err
+			}
+			rewritten = appendU32(rewritten, uint32(len(fn)))
+			shifts.add(len(rewritten), start)
+			for _, p := range moved {
+				shifts.add(len(rewritten)+int(p.New), start+int(p.Orig))
+			}
+			rewritten = append(rewritten, fn...)
+		}
+		if r.err != nil || !r.done() {
+			return nil, nil, errMalformed
+		}
+		sections[i].data = append(rewritten, bodies...)
+		return sections, shifts, nil
+	}
+	return insertSection(sections, wasmSection{id: codeSection, data: append(appendU32(nil, n), bodies...), off: -1}), nil, nil
+}
+
+// assembleModule returns the binary module with the header and sections, and the map of its
+// code to the module the sections come from, given the shifts of the code section.
+func assembleModule(header []byte, sections []wasmSection, shifts offsetMap) ([]byte, offsetMap) {
+	out := append([]byte(nil), header...)
+	var offsets offsetMap
+	for _, s := range sections {
+		out = append(out, s.id)
+		out = appendU32(out, uint32(len(s.data)))
+		if s.id == codeSection && s.off >= 0 {
+			for _, p := range shifts {
+				offsets.add(len(out)+int(p.New), s.off+int(p.Orig))
+			}
+		}
+		out = append(out, s.data...)
+	}
+	return out, offsets
+}
+
+// appendEntry appends entry to the vector of the section id, which has count entries.
+func appendEntry(sections []wasmSection, id byte, count uint32, entry []byte) []wasmSection {
+	return appendEntries(sections, id, count, 1, entry)
+}
+
+// appendEntries appends n entries to the vector of the section id, which has count entries.
+func appendEntries(sections []wasmSection, id byte, count, n uint32, entries []byte) []wasmSection {
+	for i, s := range sections {
+		if s.id == id {
+			r := &wasmReader{b: s.data}
+			r.u32()
+			data := appendU32(nil, count+n)
+			data = append(data, s.data[r.off:]...)
+			sections[i].data = append(data, entries...)
+			return sections
+		}
+	}
+	return insertSection(sections, wasmSection{id: id, data: append(appendU32(nil, n), entries...), off: -1})
+}
+
+// insertSection inserts s before the first section that follows it in the binary format.
+func insertSection(sections []wasmSection, s wasmSection) []wasmSection {
+	at := len(sections)
+	for i, other := range sections {
+		if other.id != customSection && sectionOrder[other.id] > sectionOrder[s.id] {
+			at = i
+			break
+		}
+	}
+	sections = append(sections, wasmSection{})
+	copy(sections[at+1:], sections[at:])
+	sections[at] = s
+	return sections
+}
+
+// rewriteBody replaces the memory.grow instructions of a function body with calls to growFunc.
+// The offsets map the rewritten body to body after each replacement.
+func rewriteBody(body []byte, growFunc uint32) ([]byte, offsetMap, error) {
+	r := &wasmReader{b: body}
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		r.u32()
+		r.byte()
+	}
+	out := append([]byte(nil), body[:r.off]...)
+	var moved offsetMap
+	for !r.done() && r.err == nil {
+		start := r.off
+		op := r.byte()
+		if op == 0x40 {
+			if r.u32() != 0 {
+				return nil, nil, errMalformed
+			}
+			out = appendU32(append(out, 0x10), growFunc)
+			moved.add(len(out), r.off)
+			continue
+		}
+		r.immediates(op)
+		out = append(out, body[start:r.off]...)
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return out, moved, nil
+}
+
+// wasmReader decodes a binary module. Errors are sticky: after one, reads return zero values.
+type wasmReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *wasmReader) done() bool {
+	return r.off >= len(r.b)
+}
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil || r.off >= len(r.b) {
+		r.err = errMalformed
+		return 0
+	}
+	c := r.b[r.off]
+	r.off++
+	return c
+}
+
+func (r *wasmReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.off+n > len(r.b) {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+// u32 reads an unsigned LEB128 number.
+func (r *wasmReader) u32() uint32 {
+	var v uint32
+	for shift := 0; shift < 35; shift += 7 {
+		c := r.byte()
+		v |= uint32(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+	r.err = errMalformed
+	return 0
+}
+
+// skipLEB skips a signed or unsigned LEB128 number of up to 64 bits.
+func (r *wasmReader) skipLEB() {
+	for i := 0; i < 10; i++ {
+		if r.byte()&0x80 == 0 {
+			return
+		}
+	}
+	r.err = errMalformed
+}
+
+func (r *wasmReader) limits() {
+	flags := r.byte()
+	r.skipLEB()
+	if flags&1 != 0 {
+		r.skipLEB()
+	}
+}
+
+func (r *wasmReader) memarg() {
+	r.u32()
+	r.skipLEB()
+}
+
+// immediates skips the immediates of the instruction op.
+func (r *wasmReader) immediates(op byte) {
+	switch {
+	case op == 0x02 || op == 0x03 || op == 0x04 || op == 0x06:
+		// block type: empty, a value type or a type index
+		if r.off < len(r.b) && bytes.IndexByte(blockTypes, r.b[r.off]) >= 0 {
+			r.byte()
+		} else {
+			r.skipLEB()
+		}
+	case op == 0x07 || op == 0x08 || op == 0x09 || op == 0x18 ||
+		op == 0x0c || op == 0x0d || op == 0x10 || op == 0x12 ||
+		op >= 0x20 && op <= 0x26 || op == 0xd2:
+		r.u32()
+	case op == 0x0e:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			r.u32()
+		}
+		r.u32()
+	case op == 0x11 || op == 0x13:
+		r.u32()
+		r.u32()
+	case op == 0x1c:
+		r.bytes(int(r.u32()))
+	case op >= 0x28 && op <= 0x3e:
+		r.memarg()
+	case op == 0x3f:
+		r.u32()
+	case op == 0x41 || op == 0x42:
+		r.skipLEB()
+	case op == 0x43:
+		r.bytes(4)
+	case op == 0x44:
+		r.bytes(8)
+	case op == 0xd0:
+		r.byte()
+	case op == 0xfc:
+		switch sub := r.u32(); {
+		case sub <= 7:
+		case sub == 8 || sub == 10 || sub == 12 || sub == 14:
+			r.u32()
+			r.u32()
+		case sub <= 17:
+			r.u32()
+		default:
+			r.err = errMalformed
+		}
+	case op == 0xfd:
+		switch sub := r.u32(); {
+		case sub <= 11 || sub == 92 || sub == 93:
+			r.memarg()
+		case sub == 12 || sub == 13:
+			r.bytes(16)
+		case sub >= 21 && sub <= 34:
+			r.byte()
+		case sub >= 84 && sub <= 91:
+			r.memarg()
+			r.byte()
+		case sub > 255:
+			r.err = errMalformed
+		}
+	case op == 0xfe:
+		if sub := r.u32(); sub == 3 {
+			r.byte()
+		} else {
+			r.memarg()
+		}
+	case op <= 0x01 || op == 0x05 || op == 0x0b || op == 0x0f || op == 0x19 ||
+		op == 0x1a || op == 0x1b || op >= 0x45 && op <= 0xc4 || op == 0xd1:
+	default:
+		r.err = errMalformed
+	}
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendS32(b []byte, v int32) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 && c&0x40 == 0 || v == -1 && c&0x40 != 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendName(b []byte, name string) []byte {
+	return append(appendU32(b, uint32(len(name))), name...)
+}
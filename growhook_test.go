@@ -0,0 +1,177 @@
+package wasm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// growMarker is an instruction the modules of the tests place around memory.grow,
+// to check that the offsets of the hooked module map back to the original.
+const growMarker = "(drop (i32.const 0x5a5a5))"
+
+func TestHookMemoryGrow(t *testing.T) {
+	marker := appendS32([]byte{0x41}, 0x5a5a5)
+	for name, src := range map[string]string{
+		"nested blocks": `(module
+		  (memory 1)
+		  (func (export "grow") (param i32) (result i32)
+		    ` + growMarker + `
+		    (block (result i32)
+		      (loop (result i32)
+		        (if (result i32) (local.get 0)
+		          (then (block (result i32) (memory.grow (local.get 0))))
+		          (else (i32.const 0)))))
+		    ` + growMarker + `
+		    (br_table 0 0 (i32.const 0) (i32.const 1))))`,
+		"simd": `(module
+		  (memory 1)
+		  (func (export "f") (result i32)
+		    (i8x16.extract_lane_u 0
+		      (i8x16.shuffle 0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15
+		        (v128.const i32x4 0x40004000 0x40004000 0x40004000 0x40004000)
+		        (v128.load offset=64 (i32.const 0))))
+		    ` + growMarker + `
+		    (drop (memory.grow (i32.const 1)))
+		    ` + growMarker + `
+		    (v128.store (i32.const 0) (i32x4.splat (memory.grow (i32.const 0))))))`,
+		"bulk memory": `(module
+		  (memory 1)
+		  (data $d "\40\00\40\00")
+		  (func (export "f") (result i32)
+		    (memory.init $d (i32.const 0) (i32.const 0) (i32.const 4))
+		    (memory.copy (i32.const 8) (i32.const 0) (i32.const 4))
+		    (memory.fill (i32.const 16) (i32.const 0x40) (i32.const 4))
+		    (data.drop $d)
+		    ` + growMarker + `
+		    (memory.grow (i32.const 1))))`,
+		"atomics": `(module
+		  (memory 1 2 shared)
+		  (func (export "f") (result i32)
+		    (drop (i32.atomic.rmw.add offset=64 (i32.const 0) (i32.const 0x40)))
+		    (drop (memory.atomic.notify (i32.const 0) (i32.const 1)))
+		    (atomic.fence)
+		    ` + growMarker + `
+		    (memory.grow (i32.const 1))))`,
+		"imported memory": `(module
+		  (import "env" "memory" (memory 1))
+		  (func (export "f") (result i32)
+		    ` + growMarker + `
+		    (memory.grow (i32.const 1))))`,
+		"existing globals and exports": `(module
+		  (import "env" "f" (func $f (param i32) (result i32)))
+		  (import "env" "g" (global $g i32))
+		  (memory (export "mem") 1)
+		  (global $h (export "h") (mut i32) (i32.const 7))
+		  (func (export "f") (result i32)
+		    (global.set $h (call $f (global.get $g)))
+		    ` + growMarker + `
+		    (memory.grow (global.get $h))))`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := wat(t, src)
+			hooked, offsets := hookMemoryGrow(b)
+			if bytes.Equal(hooked, b) {
+				t.Fatal("module was not hooked")
+			}
+			if name == "atomics" {
+				// wasmer cannot validate threads, the instruction after the marker must call the hook
+				if err := wasmer.ValidateModule(helperStore(), hooked); err == nil || !strings.Contains(err.Error(), "threads must be enabled") {
+					t.Errorf("got %v, want an error about threads", err)
+				}
+				if call := append(marker, 0x1a, 0x41, 1, 0x10, 1); !bytes.Contains(hooked, call) {
+					t.Error("memory.grow does not call the hook")
+				}
+			} else {
+				if err := wasmer.ValidateModule(helperStore(), hooked); err != nil {
+					t.Fatalf("hooked module is invalid: %v", err)
+				}
+				module, err := wasmer.NewModule(helperStore(), hooked)
+				if err != nil {
+					t.Fatal(err)
+				}
+				exports := map[string]wasmer.ExternKind{}
+				for _, export := range module.Exports() {
+					exports[export.Name()] = export.Type().Kind()
+				}
+				if exports[growLimitExport] != wasmer.GLOBAL || exports[growMemoryExport] != wasmer.MEMORY {
+					t.Errorf("hooked module exports %v", exports)
+				}
+				original, err := wasmer.NewModule(helperStore(), b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, export := range original.Exports() {
+					if exports[export.Name()] != export.Type().Kind() {
+						t.Errorf("export %s is missing", export.Name())
+					}
+				}
+			}
+
+			// the markers are where they were in the original module
+			var original []int
+			for i := 0; ; i++ {
+				n := bytes.Index(b[i:], marker)
+				if n < 0 {
+					break
+				}
+				i += n
+				original = append(original, i)
+			}
+			i := 0
+			for _, want := range original {
+				n := bytes.Index(hooked[i:], marker)
+				if n < 0 {
+					t.Fatalf("marker at %#x is missing", want)
+				}
+				i += n
+				if got := offsets.original(uint32(i)); got != uint32(want) {
+					t.Errorf("marker at %#x maps to %#x, want %#x", i, got, want)
+				}
+				i++
+			}
+		})
+	}
+}
+
+func TestHookMemoryGrowUnchanged(t *testing.T) {
+	for _, src := range []string{
+		`(module (func (export "f") (result i32) i32.const 0))`,
+		`(module (memory 1) (memory 1))`,
+	} {
+		b := wat(t, src)
+		if hooked, offsets := hookMemoryGrow(b); !bytes.Equal(hooked, b) || offsets != nil {
+			t.Errorf("%s was hooked", src)
+		}
+	}
+}
+
+func TestMemoryGrowLimit(t *testing.T) {
+	vm := goja.New()
+	Enable(vm, WithMemoryLimits(MemoryLimits{MaxPages: 2}))
+	module, err := NewModule(vm, wat(t, `(module
+	  (memory 1)
+	  (func (export "grow") (param i32) (result i32)
+	    (block (result i32)
+	      (if (result i32) (local.get 0)
+	        (then (memory.grow (local.get 0)))
+	        (else (memory.size))))))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := NewInstance(vm, module, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+	for _, c := range []struct {
+		delta, want int32
+	}{{1, 1}, {1, -1}, {0, 2}} {
+		if r, err := instance.Call("grow", c.delta); err != nil || r != c.want {
+			t.Errorf("grow(%d): got %v, %v, want %d", c.delta, r, err, c.want)
+		}
+	}
+}
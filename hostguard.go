@@ -0,0 +1,108 @@
+package wasm
+
+import (
+	"fmt"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// Host functions can fail neither by returning an error, see trappingFunction, nor by
+// panicking, which would unwind through the frames of wasmer. Guests call them through
+// a hostGuard, which makes the guest trap and keeps the error to report it to the caller
+// of the guest: scripts see the JS value thrown by the host, or a RuntimeError if it panicked.
+
+// hostGuard calls the host functions of a guest, through h if set.
+type hostGuard struct {
+	h   hostInterceptor
+	err error
+}
+
+func (g *hostGuard) call(name string, fn *hostFunction, args []wasmer.Value, memory *memoryTrace) (results []wasmer.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = hostPanic(name, r)
+		}
+		if err != nil {
+			g.err = err
+		}
+	}()
+	if g.h != nil {
+		return g.h.call(name, fn, args, memory)
+	}
+	return fn.fn(args)
+}
+
+// reenter is called when the host calls the export of the guest, and returns
+// the function to call once the guest returns. g may be nil.
+func (g *hostGuard) reenter(export string, memory *memoryTrace) func() {
+	if g == nil || g.h == nil {
+		return func() {}
+	}
+	return g.h.reenter(export, memory)
+}
+
+// failure returns the error of the host function that made the guest trap, and forgets it. g may be nil.
+func (g *hostGuard) failure() error {
+	if g == nil {
+		return nil
+	}
+	if g.h != nil {
+		if err := g.h.failure(); err != nil {
+			return err
+		}
+	}
+	err := g.err
+	g.err = nil
+	return err
+}
+
+// HostPanicError is the error of a guest whose host function panicked.
+type HostPanicError struct {
+	// Import is the name of the host function.
+	Import string
+	Value  interface{}
+}
+
+func (e *HostPanicError) Error() string {
+	return fmt.Sprintf("host function %s panicked: %v", e.Import, e.Value)
+}
+
+// thrownValue is the error of a host function that panicked with a JS value, as goja functions throw.
+type thrownValue struct {
+	value goja.Value
+}
+
+func (e *thrownValue) Error() string {
+	return e.value.String()
+}
+
+// hostPanic returns the error of the host function name that panicked with r.
+func hostPanic(name string, r interface{}) error {
+	switch r := r.(type) {
+	case *goja.Exception:
+		return r
+	case *goja.InterruptedError:
+		return r
+	case goja.Value:
+		return &thrownValue{value: r}
+	}
+	return &HostPanicError{Import: name, Value: r}
+}
+
+// hostThrow returns what to throw for err, the error of a guest, when a host function
+// of the guest failed: the JS value it threw, or a RuntimeError if it panicked.
+// It returns nil for other errors.
+func hostThrow(vm *goja.Runtime, err error) interface{} {
+	switch err := err.(type) {
+	case *goja.Exception:
+		return err
+	case *goja.InterruptedError:
+		return err
+	case *thrownValue:
+		return err.value
+	case *HostPanicError:
+		return wasmError(vm, "RuntimeError", err.Error())
+	}
+	return nil
+}
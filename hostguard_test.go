@@ -0,0 +1,38 @@
+package wasm
+
+import (
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestHostExceptions(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	vm.Set("bytes", vm.NewArrayBuffer(wat(t, `(module
+	  (import "env" "call" (func $call))
+	  (import "env" "fail" (func $fail))
+	  (func (export "fail") call $fail)
+	  (func (export "outer") call $call))`)))
+	vm.Set("panics", func() { panic("oops") })
+	v, err := vm.RunString(`
+	  const thrown = {reason: "mine"};
+	  const results = [];
+	  const check = (fail, test) => {
+	    // outer calls into JS, which calls fail, so the exception unwinds through two wasm frames
+	    const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes),
+	      {env: {call: () => instance.exports.fail(), fail}});
+	    try { instance.exports.outer(); results.push("returned") } catch (e) { results.push(test(e)) }
+	  };
+	  check(() => { throw thrown }, (e) => e === thrown);
+	  check(() => { throw new TypeError("bad") }, (e) => e instanceof TypeError && e.message === "bad");
+	  check(panics, (e) => e instanceof WebAssembly.RuntimeError && e.message === "host function fail panicked: oops");
+	  results.join();
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.String(), "true,true,true"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package wasm
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// jsImports returns the host functions calling the functions of the import object
+// imports that module requests, by namespace. Missing imports are left for wasmer to report.
+func (w *WasmInstance) jsImports(store *wasmer.Store, module *wasmer.Module, imports *goja.Object) (map[string]map[string]wasmer.IntoExtern, error) {
+	namespaces := map[string]map[string]wasmer.IntoExtern{}
+	for _, imp := range module.Imports() {
+		if imp.Type().Kind() != wasmer.FUNCTION {
+			continue
+		}
+		ns, ok := imports.Get(imp.Module()).(*goja.Object)
+		if !ok {
+			continue
+		}
+		fn, ok := goja.AssertFunction(ns.Get(imp.Name()))
+		if !ok {
+			continue
+		}
+		typ := imp.Type().IntoFunctionType()
+		if hasRefs(typ) {
+			return nil, fmt.Errorf("import %s.%s: %s", imp.Module(), imp.Name(), errReferenceTypes)
+		}
+		if namespaces[imp.Module()] == nil {
+			namespaces[imp.Module()] = map[string]wasmer.IntoExtern{}
+		}
+		if w.info.v128().imported(imp.Module(), imp.Name()).any() {
+			namespaces[imp.Module()][imp.Name()] = v128Function(w.vm, store, typ)
+			continue
+		}
+		sig := w.info.externrefs().imported(imp.Module(), imp.Name())
+		namespaces[imp.Module()][imp.Name()] = w.jsFunction(store, fn, typ, sig)
+	}
+	return namespaces, nil
+}
+
+// jsFunction returns a host function with signature typ calling fn, passing
+// the values of the externref handles marked by sig.
+// Exceptions thrown by fn make the guest trap and are thrown again to its caller.
+// It does not reference w, see WasmInstance.link.
+func (w *WasmInstance) jsFunction(store *wasmer.Store, fn goja.Callable, typ *wasmer.FunctionType, sig valueMarks) *hostFunction {
+	vm, refs := w.vm, w.refs
+	return newHostFunction(store, typ, func(args []wasmer.Value) ([]wasmer.Value, error) {
+		params := make([]goja.Value, len(args))
+		for i, arg := range args {
+			if sig.param(i) {
+				params[i] = refs.lift(arg.I32())
+				continue
+			}
+			params[i] = vm.ToValue(arg.Unwrap())
+		}
+		result, err := fn(goja.Undefined(), params...)
+		if err != nil {
+			return nil, err
+		}
+		kinds := typ.Results()
+		switch len(kinds) {
+		case 0:
+			return []wasmer.Value{}, nil
+		case 1:
+			return []wasmer.Value{resultValue(refs, result, kinds[0].Kind(), sig.result(0))}, nil
+		}
+		// multiple results are returned as an array
+		obj := result.ToObject(vm)
+		results := make([]wasmer.Value, len(kinds))
+		for i, kind := range kinds {
+			results[i] = resultValue(refs, obj.Get(strconv.Itoa(i)), kind.Kind(), sig.result(i))
+		}
+		return results, nil
+	})
+}
+
+// v128Function returns the host function with signature typ standing for a JS function
+// imported with v128 values, which throws a TypeError instead of calling it.
+func v128Function(vm *goja.Runtime, store *wasmer.Store, typ *wasmer.FunctionType) *hostFunction {
+	return newHostFunction(store, typ, func([]wasmer.Value) ([]wasmer.Value, error) {
+		panic(vm.NewTypeError("WebAssembly.FunctionCall: " + errV128))
+	})
+}
+
+// resultValue converts the JS value v to a value of kind, or to its handle in refs if ref is set.
+func resultValue(refs *refHolder, v goja.Value, kind wasmer.ValueKind, ref bool) wasmer.Value {
+	if ref {
+		return wasmer.NewI32(refs.lower(v))
+	}
+	return wasmValue(v, kind)
+}
+
+// wasmValue converts the JS value v to a value of kind.
+func wasmValue(v goja.Value, kind wasmer.ValueKind) wasmer.Value {
+	switch kind {
+	case wasmer.I64:
+		return wasmer.NewI64(v.ToInteger())
+	case wasmer.F32:
+		return wasmer.NewF32(float32(v.ToFloat()))
+	case wasmer.F64:
+		return wasmer.NewF64(v.ToFloat())
+	}
+	return wasmer.NewI32(int32(v.ToInteger()))
+}
@@ -0,0 +1,279 @@
+package wasm
+
+/*
+#cgo linux LDFLAGS: -ldl
+#define _GNU_SOURCE
+#include <dlfcn.h>
+#include <stdint.h>
+
+// the metering middleware of the wasmer library linked by wasmer-go, which wasmer-go does not wrap
+typedef void *(*metering_new_t)(uint64_t, uint64_t (*)(int));
+typedef void *(*metering_as_middleware_t)(void *);
+typedef void (*config_push_middleware_t)(void *, void *);
+
+static uint64_t metering_cost(int op) {
+	return 1;
+}
+
+static int metering_supported(void) {
+	return dlsym(RTLD_DEFAULT, "wasmer_metering_new") &&
+		dlsym(RTLD_DEFAULT, "wasmer_metering_as_middleware") &&
+		dlsym(RTLD_DEFAULT, "wasm_config_push_middleware");
+}
+
+static void push_metering(void *config) {
+	metering_new_t metering_new = (metering_new_t)dlsym(RTLD_DEFAULT, "wasmer_metering_new");
+	metering_as_middleware_t as_middleware = (metering_as_middleware_t)dlsym(RTLD_DEFAULT, "wasmer_metering_as_middleware");
+	config_push_middleware_t push_middleware = (config_push_middleware_t)dlsym(RTLD_DEFAULT, "wasm_config_push_middleware");
+	push_middleware(config, as_middleware(metering_new(UINT64_MAX, metering_cost)));
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// Guests are interrupted with wasmer's metering, once enabled with EnableMetering:
+// every instruction costs a point of a budget that is never exhausted, until the runtime
+// is interrupted or the context of the call is done, and the budget of the instance is set to zero.
+
+// meteringPrefix starts the names of the globals the metering middleware exports.
+const meteringPrefix = "wasmer_metering_"
+
+// interruptInterval is how often running guests check whether their runtime is interrupted.
+const interruptInterval = 10 * time.Millisecond
+
+// ErrInterrupted is returned by calls from Go to guests stopped by goja's Interrupt.
+var ErrInterrupted = errors.New("wasm execution interrupted")
+
+// metering is set once modules are compiled with metering, see EnableMetering.
+var metering int32
+
+// meteringEnabled reports whether modules are compiled with metering.
+func meteringEnabled() bool {
+	return atomic.LoadInt32(&metering) != 0
+}
+
+// EnableMetering compiles the modules compiled afterwards with wasmer's metering, so that
+// their guests stop when their runtime is interrupted or the context of their call is done.
+// Metered code updates a counter for every instruction it runs, which slows it down.
+//
+// Metering is experimental. It looks up the metering middleware of the wasmer library
+// with dlsym, as wasmer-go does not wrap it, and relies on the memory layout of types
+// of goja and wasmer-go that they do not export, as of the versions in go.mod.
+// EnableMetering returns an error if the layout is not the expected one, or if the wasmer
+// library lacks the middleware. Guests are stopped by a timer goroutine that empties
+// their budget while they run on another goroutine.
+func EnableMetering() error {
+	if C.metering_supported() == 0 {
+		return errors.New("the wasmer library has no metering middleware")
+	}
+	if interruptedFlag == nil {
+		return errors.New("goja.Runtime does not have the layout this package expects, see go.mod for the supported version")
+	}
+	if !configLayout() {
+		return errors.New("wasmer.Config does not have the layout this package expects, see go.mod for the supported version")
+	}
+	atomic.StoreInt32(&metering, 1)
+	return nil
+}
+
+// configLayout reports whether wasmer.Config only holds the pointer to its wasm_config_t.
+func configLayout() bool {
+	typ := reflect.TypeOf(wasmer.Config{})
+	return typ.NumField() == 1 && typ.Field(0).Type.Kind() == reflect.Ptr && typ.Size() == unsafe.Sizeof(uintptr(0))
+}
+
+// newEngineConfig returns the configuration of an engine, with metering if it is enabled.
+func newEngineConfig() *wasmer.Config {
+	config := wasmer.NewConfig()
+	if meteringEnabled() {
+		// checked by configLayout
+		C.push_metering(*(*unsafe.Pointer)(unsafe.Pointer(config)))
+	}
+	return config
+}
+
+// isStopped reports whether err is the error of a guest stopped by an interrupt or a context.
+func isStopped(err error) bool {
+	return err == ErrInterrupted || err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// stoppedResult is the result of a native function whose guest was stopped by err, from interruptible:
+// goja throws its InterruptedError when the function returns, the errors of contexts are thrown as RuntimeError.
+func stoppedResult(vm *goja.Runtime, err error) goja.Value {
+	if err == ErrInterrupted {
+		return goja.Undefined()
+	}
+	panic(wasmError(vm, "RuntimeError", err.Error()))
+}
+
+// WithContext sets the default context of the runtime: guests called from scripts,
+// with WasmInstance.Call and Go programs resumed by callbacks stop when it is done.
+// As with CallContext, running guests are only stopped once EnableMetering has been
+// called; without it, guests are not entered once the context is done.
+func WithContext(ctx context.Context) Option {
+	return func(cfg *runtimeConfig) {
+		cfg.ctx = ctx
+	}
+}
+
+// SetContext replaces the default context of vm, see WithContext.
+// It has no effect if WebAssembly is not enabled on vm.
+func SetContext(vm *goja.Runtime, ctx context.Context) {
+	configOf(vm).ctx = ctx
+}
+
+// runtimeContext returns the default context of vm.
+func runtimeContext(vm *goja.Runtime) context.Context {
+	if ctx := configOf(vm).ctx; ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// isHiddenExport reports whether name is exported by the metering middleware
+// or the memory.grow hook rather than the module.
+func isHiddenExport(name string) bool {
+	return strings.HasPrefix(name, meteringPrefix) || strings.HasPrefix(name, hiddenPrefix)
+}
+
+// interruptedFlag locates the interrupt flag of goja runtimes, which goja does not export.
+// It is nil if goja.Runtime does not have the expected layout.
+var interruptedFlag = func() func(vm *goja.Runtime) *uint32 {
+	vmField, ok := reflect.TypeOf(goja.Runtime{}).FieldByName("vm")
+	if !ok || vmField.Type.Kind() != reflect.Ptr {
+		return nil
+	}
+	flagField, ok := vmField.Type.Elem().FieldByName("interrupted")
+	if !ok || flagField.Type.Kind() != reflect.Uint32 {
+		return nil
+	}
+	return func(vm *goja.Runtime) *uint32 {
+		inner := *(*unsafe.Pointer)(unsafe.Pointer(uintptr(unsafe.Pointer(vm)) + vmField.Offset))
+		return (*uint32)(unsafe.Pointer(uintptr(inner) + flagField.Offset))
+	}
+}()
+
+// isInterrupted reports whether vm has been interrupted.
+func isInterrupted(vm *goja.Runtime) bool {
+	if interruptedFlag == nil {
+		return false
+	}
+	return atomic.LoadUint32(interruptedFlag(vm)) != 0
+}
+
+// interruptWatch stops the guests running in a runtime when it is interrupted
+// or when the context of their call is done.
+type interruptWatch struct {
+	mu      sync.Mutex
+	running []runningGuest
+	timer   *time.Timer
+	gen     int
+}
+
+// runningGuest is a call into a guest.
+type runningGuest struct {
+	points *wasmer.Global
+	ctx    context.Context
+}
+
+// stopped reports whether g must stop.
+func (g runningGuest) stopped(vm *goja.Runtime) bool {
+	return isInterrupted(vm) || g.ctx.Err() != nil
+}
+
+// stopError returns ErrInterrupted if vm is interrupted, or the error of ctx.
+func stopError(vm *goja.Runtime, ctx context.Context) error {
+	if isInterrupted(vm) {
+		return ErrInterrupted
+	}
+	return ctx.Err()
+}
+
+// interruptible makes the code of inst stop when vm is interrupted or ctx is done, until done is called.
+// done returns ErrInterrupted or the error of ctx if the code was stopped, nil otherwise.
+// If vm is interrupted or ctx is done already, interruptible returns the error instead,
+// and inst must not be entered: without metering, this is the only check.
+func interruptible(vm *goja.Runtime, ctx context.Context, inst *wasmer.Instance) (done func() error, err error) {
+	if err := stopError(vm, ctx); err != nil {
+		return nil, err
+	}
+	cfg := configOf(vm)
+	// memories of the runtime may have grown since the guest last ran, and the guest may grow its own
+	cfg.memories.refreshLimits()
+	points, err := inst.Exports.GetGlobal(meteringPrefix + "remaining_points")
+	if err != nil {
+		return func() error {
+			cfg.memories.refreshLimits()
+			return nil
+		}, nil
+	}
+	w := cfg.interrupts
+	if w == nil {
+		w = &interruptWatch{}
+	}
+	w.enter(vm, runningGuest{points: points, ctx: ctx})
+	return func() error {
+		w.leave()
+		cfg.memories.refreshLimits()
+		return stopError(vm, ctx)
+	}, nil
+}
+
+func (w *interruptWatch) enter(vm *goja.Runtime, guest runningGuest) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// the budget emptied by a stopped call is refilled
+	guest.points.Set(int64(math.MaxInt64), wasmer.I64)
+	w.running = append(w.running, guest)
+	if len(w.running) > 1 {
+		return
+	}
+	w.gen++
+	gen := w.gen
+	var poll func()
+	poll = func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if gen != w.gen || len(w.running) == 0 {
+			return
+		}
+		// guests write their budget back after each block, which can undo a reset:
+		// it is reset until they return
+		for _, guest := range w.running {
+			if guest.stopped(vm) {
+				guest.points.Set(int64(0), wasmer.I64)
+			}
+		}
+		w.timer = time.AfterFunc(interruptInterval, poll)
+	}
+	w.timer = time.AfterFunc(interruptInterval, poll)
+}
+
+func (w *interruptWatch) leave() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.running = w.running[:len(w.running)-1]
+	if len(w.running) == 0 {
+		w.gen++
+		if w.timer != nil {
+			w.timer.Stop()
+			w.timer = nil
+		}
+	}
+}
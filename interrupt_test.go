@@ -0,0 +1,203 @@
+package wasm
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// TestInterruptedFlag checks that goja.Runtime has the layout interruptedFlag reads,
+// which only holds for the goja version pinned in go.mod.
+func TestInterruptedFlag(t *testing.T) {
+	if interruptedFlag == nil {
+		t.Fatal("goja.Runtime has no interrupted flag")
+	}
+	vm := goja.New()
+	if isInterrupted(vm) {
+		t.Fatal("new runtime is interrupted")
+	}
+	vm.Interrupt("stop")
+	if !isInterrupted(vm) {
+		t.Fatal("interrupted runtime is not interrupted")
+	}
+	vm.ClearInterrupt()
+	if isInterrupted(vm) {
+		t.Fatal("cleared runtime is interrupted")
+	}
+}
+
+func TestEnableMetering(t *testing.T) {
+	if !configLayout() {
+		t.Fatal("wasmer.Config does not only hold a pointer")
+	}
+	if err := EnableMetering(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(engineSettings(), "; metering") {
+		t.Errorf("engine settings %q do not mention metering", engineSettings())
+	}
+}
+
+const spinWat = `(module (func (export "spin") (loop br 0)) (func (export "one") (result i32) i32.const 1))`
+
+func newSpinInstance(t *testing.T, vm *goja.Runtime) *WasmInstance {
+	t.Helper()
+	if err := EnableMetering(); err != nil {
+		t.Fatal(err)
+	}
+	module, err := NewModule(vm, wat(t, spinWat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := NewInstance(vm, module, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func TestInterrupt(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	instance := newSpinInstance(t, vm)
+	vm.Set("instance", instance.Object())
+
+	time.AfterFunc(50*time.Millisecond, func() { vm.Interrupt("stop") })
+	_, err := vm.RunString(`try { instance.exports.spin() } catch (e) { "caught" }`)
+	if _, ok := err.(*goja.InterruptedError); !ok {
+		t.Fatalf("got %v, want an InterruptedError", err)
+	}
+	vm.ClearInterrupt()
+	if v, err := vm.RunString(`instance.exports.one()`); err != nil || v.ToInteger() != 1 {
+		t.Fatalf("after ClearInterrupt: got %v, %v", v, err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { vm.Interrupt("stop") })
+	if _, err := instance.Call("spin"); err != ErrInterrupted {
+		t.Fatalf("Call: got %v, want %v", err, ErrInterrupted)
+	}
+	vm.ClearInterrupt()
+
+	// interrupted before the call
+	vm.Interrupt("stop")
+	if _, err := instance.Call("spin"); err != ErrInterrupted {
+		t.Fatalf("Call on an interrupted runtime: got %v, want %v", err, ErrInterrupted)
+	}
+	vm.ClearInterrupt()
+	if r, err := instance.Call("one"); err != nil || r != int32(1) {
+		t.Fatalf("after ClearInterrupt: got %v, %v", r, err)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	instance := newSpinInstance(t, vm)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := CallContext(ctx, instance, "spin"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestContextWithoutMetering(t *testing.T) {
+	// other tests enable metering, which only applies to the modules compiled afterwards
+	enabled := atomic.SwapInt32(&metering, 0)
+	defer atomic.StoreInt32(&metering, enabled)
+
+	vm := goja.New()
+	Enable(vm)
+	module, err := NewModule(vm, wat(t, `(module
+	  (global $calls (mut i32) (i32.const 0))
+	  (func (export "count") (result i32)
+	    (global.set $calls (i32.add (global.get $calls) (i32.const 1)))
+	    (global.get $calls)))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := NewInstance(vm, module, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.instance.Exports.GetGlobal(meteringPrefix + "remaining_points"); err == nil {
+		t.Fatal("module was compiled with metering")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the guest is not entered once the context is done
+	if r, err := CallContext(ctx, instance, "count"); err != context.Canceled {
+		t.Errorf("CallContext: got %v, %v, want %v", r, err, context.Canceled)
+	}
+	SetContext(vm, ctx)
+	vm.Set("instance", instance.Object())
+	v, err := vm.RunString(`
+	  let caught;
+	  try { instance.exports.count() } catch (e) { caught = e }
+	  caught instanceof WebAssembly.RuntimeError;
+	`)
+	if err != nil || !v.ToBoolean() {
+		t.Errorf("exported function: got %v, %v, want a RuntimeError", v, err)
+	}
+	SetContext(vm, context.Background())
+	if r, err := instance.Call("count"); err != nil || r != int32(1) {
+		t.Errorf("count: got %v, %v, want 1", r, err)
+	}
+
+	vm = newTinyGoRuntime(t, `(module
+	  (import "gojs" "runtime.ticks" (func (result f64)))
+	  (memory (export "memory") 1)
+	  (global (export "started") (mut i32) (i32.const 0))
+	  (func (export "_start") (global.set 0 (i32.const 1))))`)
+	SetContext(vm, ctx)
+	v, err = vm.RunString(`
+	  const go = new Go();
+	  const goInstance = new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject);
+	  let error;
+	  try { go.run(goInstance) } catch (e) { error = e }
+	  [error instanceof WebAssembly.RuntimeError, goInstance.exports.started.value].join();
+	`)
+	if err != nil || v.String() != "true,0" {
+		t.Errorf("Go.run: got %v, %v, want a RuntimeError without starting the program", v, err)
+	}
+}
+
+func TestInterruptGoProgram(t *testing.T) {
+	if err := EnableMetering(); err != nil {
+		t.Fatal(err)
+	}
+	// the program sets cb to a callback, then spins
+	vm := newTinyGoRuntime(t, `(module
+	  (import "gojs" "syscall/js.valueCall" (func $valueCall (param i32 i64 i32 i32 i32 i32 i32)))
+	  (import "gojs" "syscall/js.valueSet" (func $valueSet (param i64 i32 i32 i64)))
+	  (memory (export "memory") 1)
+	  (data (i32.const 0) "_makeFuncWrapper")
+	  (data (i32.const 16) "cb")
+	  (data (i32.const 24) "\00\00\00\00\00\00\f0\3f")
+	  (func (export "_start")
+	    (call $valueCall (i32.const 32) (i64.const 0x7FF8000100000006) (i32.const 0) (i32.const 16) (i32.const 24) (i32.const 1) (i32.const 1))
+	    (call $valueSet (i64.const `+tinyGoGlobal+`) (i32.const 16) (i32.const 2) (i64.load (i32.const 32)))
+	    (loop br 0))
+	  (func (export "resume")))`)
+	time.AfterFunc(50*time.Millisecond, func() { vm.Interrupt("stop") })
+	_, err := vm.RunString(`
+	  var go = new Go();
+	  go.run(new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject));
+	`)
+	if _, ok := err.(*goja.InterruptedError); !ok {
+		t.Fatalf("got %v, want an InterruptedError", err)
+	}
+	vm.ClearInterrupt()
+
+	// the program was left in the middle of its execution and cannot be resumed
+	v, err := vm.RunString(`
+	  try { cb(); "resumed" } catch (e) { e.message }
+	`)
+	if err != nil || !strings.Contains(v.String(), "already exited") {
+		t.Errorf("callback after the interrupt: got %v, %v, want an error about the exited program", v, err)
+	}
+}
@@ -0,0 +1,246 @@
+package wasm
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// pageSize is the size of a page of linear memory.
+const pageSize = 64 * 1024
+
+// MemoryLimits caps the linear memories of a runtime. Instantiating a module
+// or growing a memory past a limit fails with a RangeError, while guests see
+// memory.grow fail.
+type MemoryLimits struct {
+	// MaxPages caps every memory, in pages of 64 KiB. 0 means no limit.
+	MaxPages uint32
+	// MaxBytes caps the memories of the runtime together. 0 means no limit.
+	MaxBytes uint64
+}
+
+// WithMemoryLimits caps the memories of the runtime.
+func WithMemoryLimits(limits MemoryLimits) Option {
+	return func(cfg *runtimeConfig) {
+		cfg.memories = &memoryBudget{limits: limits, memories: map[*budgetEntry]struct{}{}}
+	}
+}
+
+// memoryLimitError is the error of an allocation past a limit.
+type memoryLimitError struct {
+	msg string
+}
+
+func (e *memoryLimitError) Error() string {
+	return e.msg
+}
+
+// memoryBudget accounts for the memories of a runtime.
+// Memories are released when the objects owning them are collected.
+type memoryBudget struct {
+	limits MemoryLimits
+
+	mu       sync.Mutex
+	memories map[*budgetEntry]struct{}
+}
+
+// budgetEntry is a memory of the runtime.
+type budgetEntry struct {
+	// memory is the memory of an instance, nil for memories created by scripts, whose size is bytes.
+	memory *wasmer.Memory
+	bytes  uint64
+	// limit is the global of the hooked memory.grow, nil for memories only grown by the host.
+	limit *wasmer.Global
+}
+
+func (e *budgetEntry) size() uint64 {
+	if e.memory != nil {
+		return uint64(e.memory.DataSize())
+	}
+	return e.bytes
+}
+
+// budgetHandle releases its memory when it is released or collected. It must only be
+// referenced by the owner of the memory, so that it is collected with it.
+type budgetHandle struct {
+	budget *memoryBudget
+	entry  *budgetEntry
+}
+
+// release stops accounting for the memory of h. h may be nil.
+func (h *budgetHandle) release() {
+	if h == nil {
+		return
+	}
+	m := h.budget
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.memories, h.entry)
+	runtime.SetFinalizer(h, nil)
+}
+
+// check checks that memories, those of a module about to be instantiated, fit in the limits.
+// Imported memories are accounted for already.
+func (m *memoryBudget) check(memories []memoryDecl) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	defined := uint64(0)
+	for _, memory := range memories {
+		if m.limits.MaxPages != 0 && memory.Min > m.limits.MaxPages {
+			return &memoryLimitError{fmt.Sprintf("memory of %d pages exceeds the limit of %d pages", memory.Min, m.limits.MaxPages)}
+		}
+		if !memory.Imported {
+			defined += uint64(memory.Min) * pageSize
+		}
+	}
+	if m.limits.MaxBytes != 0 && m.used()+defined > m.limits.MaxBytes {
+		return m.budgetError()
+	}
+	return nil
+}
+
+// add accounts for the memory of entry and returns a handle releasing it,
+// or an error if the memory does not fit in the limits.
+func (m *memoryBudget) add(entry *budgetEntry) (*budgetHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pages := entry.size() / pageSize
+	if m.limits.MaxPages != 0 && pages > uint64(m.limits.MaxPages) {
+		return nil, &memoryLimitError{fmt.Sprintf("memory of %d pages exceeds the limit of %d pages", pages, m.limits.MaxPages)}
+	}
+	if m.limits.MaxBytes != 0 && m.used()+entry.size() > m.limits.MaxBytes {
+		return nil, m.budgetError()
+	}
+	m.memories[entry] = struct{}{}
+	m.refresh()
+
+	h := &budgetHandle{budget: m, entry: entry}
+	// a backstop for owners that are never released
+	runtime.SetFinalizer(h, (*budgetHandle).release)
+	return h, nil
+}
+
+// grow checks that a memory of pages can grow by delta pages.
+// The size of the memories created by scripts, whose handle is h, is updated.
+func (m *memoryBudget) grow(h *budgetHandle, pages, delta uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.limits.MaxPages != 0 && uint64(pages)+uint64(delta) > uint64(m.limits.MaxPages) {
+		return &memoryLimitError{fmt.Sprintf("memory of %d pages cannot grow past the limit of %d pages", pages, m.limits.MaxPages)}
+	}
+	if m.limits.MaxBytes != 0 && m.used()+uint64(delta)*pageSize > m.limits.MaxBytes {
+		return m.budgetError()
+	}
+	if h != nil && h.entry.memory == nil {
+		h.entry.bytes += uint64(delta) * pageSize
+	}
+	return nil
+}
+
+// refreshLimits updates the number of pages the memories of guests can grow to,
+// after memories of the runtime have grown. m may be nil.
+func (m *memoryBudget) refreshLimits() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refresh()
+}
+
+func (m *memoryBudget) refresh() {
+	used := m.used()
+	for entry := range m.memories {
+		if entry.limit == nil {
+			continue
+		}
+		limit := uint64(maxPages)
+		if m.limits.MaxPages != 0 && uint64(m.limits.MaxPages) < limit {
+			limit = uint64(m.limits.MaxPages)
+		}
+		if m.limits.MaxBytes != 0 {
+			left := uint64(0)
+			if used < m.limits.MaxBytes {
+				left = m.limits.MaxBytes - used
+			}
+			if pages := (entry.size() + left) / pageSize; pages < limit {
+				limit = pages
+			}
+		}
+		entry.limit.Set(int32(limit), wasmer.I32)
+	}
+}
+
+// used returns the bytes of the memories of the runtime.
+func (m *memoryBudget) used() uint64 {
+	used := uint64(0)
+	for entry := range m.memories {
+		used += entry.size()
+	}
+	return used
+}
+
+func (m *memoryBudget) budgetError() error {
+	return &memoryLimitError{fmt.Sprintf("memories of the runtime exceed the limit of %d bytes", m.limits.MaxBytes)}
+}
+
+// checkMemories checks that the memories declared by module fit in the limits of vm,
+// before they are allocated by instantiating it.
+func checkMemories(vm *goja.Runtime, module *WasmModule) error {
+	budget := configOf(vm).memories
+	if budget == nil {
+		return nil
+	}
+	memories := module.info.memories()
+	if memories == nil {
+		// modules that were not compiled by this package only describe the memories they import and export
+		for _, imp := range module.module.Imports() {
+			if imp.Type().Kind() == wasmer.MEMORY {
+				memories = append(memories, memoryDecl{Min: imp.Type().IntoMemoryType().Limits().Minimum(), Imported: true})
+			}
+		}
+		for _, export := range module.module.Exports() {
+			if export.Type().Kind() == wasmer.MEMORY && len(memories) == 0 {
+				memories = append(memories, memoryDecl{Min: export.Type().IntoMemoryType().Limits().Minimum()})
+			}
+		}
+	}
+	return budget.check(memories)
+}
+
+// limitMemory accounts for the memory of instance, a new instance of module, if vm has memory limits.
+func limitMemory(vm *goja.Runtime, module *WasmModule, instance *WasmInstance) error {
+	budget := configOf(vm).memories
+	if budget == nil {
+		return nil
+	}
+	exports := instance.instance.Exports
+	entry := &budgetEntry{}
+	if limit, err := exports.GetGlobal(growLimitExport); err == nil {
+		entry.limit = limit
+		entry.memory, _ = exports.GetMemory(growMemoryExport)
+	} else {
+		// modules that were not compiled by this package are not hooked
+		for _, export := range module.module.Exports() {
+			if export.Type().Kind() == wasmer.MEMORY {
+				entry.memory, _ = exports.GetMemory(export.Name())
+				break
+			}
+		}
+	}
+	if entry.memory == nil {
+		return nil
+	}
+	h, err := budget.add(entry)
+	if err != nil {
+		return err
+	}
+	instance.memoryHandle = h
+	return nil
+}
@@ -17,14 +17,43 @@ func RequireModuleLoader(vm *goja.Runtime, module *goja.Object) {
 				vm: vm,
 			},
 		}
+		class.instance.stdio = &class.stdio
+		if d := configOf(vm).deterministic; d != nil {
+			class.SetDeterministic(*d)
+		}
+		if opts, ok := c.Argument(0).(*goja.Object); ok {
+			for _, key := range []string{"stdin", "stdout", "stderr"} {
+				if v := opts.Get(key); v != nil {
+					class.setFromJS(vm, key, v)
+				}
+			}
+			if d := deterministicFromJS(vm, opts.Get("deterministic")); d != nil {
+				class.SetDeterministic(*d)
+			}
+			if v := opts.Get("global"); v != nil && !goja.IsUndefined(v) && !goja.IsNull(v) {
+				global, ok := v.(*goja.Object)
+				if !ok {
+					panic(vm.NewTypeError("Go: option global must be an object"))
+				}
+				class.SetGlobal(global)
+			}
+		}
 		obj := vm.NewDynamicObject(class)
 		obj.SetPrototype(c.This.Prototype())
 		return obj
 	})
+
+	exports.Set("WASI", func(c goja.ConstructorCall, vm *goja.Runtime) *goja.Object {
+		opts, _ := c.Argument(0).(*goja.Object)
+		obj := vm.NewDynamicObject(newWASIClass(vm, opts))
+		obj.SetPrototype(c.This.Prototype())
+		return obj
+	})
 }
 
 type GoClass struct {
 	vm *goja.Runtime
+	stdio
 
 	instance *GoInstance
 
@@ -34,6 +63,38 @@ type GoClass struct {
 	run  goja.Value
 }
 
+// SetDeterministic makes the program read time from the virtual clock
+// and randomness from the seeded PRNG of d.
+func (g *GoClass) SetDeterministic(d Deterministic) {
+	g.instance.system = d.system()
+	g.instance.deterministic = true
+}
+
+// SetGlobal makes the program see global as globalThis instead of the global object
+// of the runtime, which curates the API js.Global() offers. It is not a security boundary:
+// the program still reaches the rest of the runtime through the values it is given,
+// for example through the Function constructor behind any function.
+// The Go runtime reads Object, Array, Uint8Array, fs, process and crypto from it;
+// the program sees default fs, process and path objects when global lacks them.
+// It must be called before the instance is created.
+func (g *GoClass) SetGlobal(global *goja.Object) {
+	g.instance.global = global
+}
+
+// Record logs the host calls of the program to r.
+// It must be called before the instance is created.
+func (g *GoClass) Record(r *Recorder) {
+	g.instance.host = r
+}
+
+// Replay runs the program with the host calls recorded by a Recorder instead of the host.
+// The callbacks the host made into the program during a call are made again by the replay,
+// but not the events scheduled with setTimeout or made by scripts outside of host calls.
+// It must be called before the instance is created.
+func (g *GoClass) Replay(r *Replayer) {
+	g.instance.host = r
+}
+
 func (g *GoClass) Get(key string) goja.Value {
 	switch key {
 	case "importObject":
@@ -63,7 +124,16 @@ func (g *GoClass) Get(key string) goja.Value {
 					panic(vm.NewTypeError("Go.run: argument 1 must be WebAssembly.Instance"))
 				}
 
+				// the program of the instance replaced cannot be resumed anymore
+				if prev := g.instance.wasm; prev != nil && prev != instance {
+					prev.Close()
+				}
+				g.instance.wasm = instance
 				g.instance.inst = instance.instance
+				if g.instance.tinygo {
+					g.runTinyGo(vm)
+					return goja.Undefined()
+				}
 
 				mem, err := g.instance.inst.Exports.GetMemory("mem")
 				if err != nil {
@@ -108,8 +178,24 @@ func (g *GoClass) Get(key string) goja.Value {
 					panic(vm.NewTypeError("Go.run: " + err.Error()))
 				}
 
+				done, err := interruptible(vm, runtimeContext(vm), g.instance.inst)
+				if err != nil {
+					return stoppedResult(vm, err)
+				}
+				leave := g.instance.enter()
 				_, err = run(1, 4104)
+				stopped := done()
+				leave()
+				if err != nil && stopped != nil {
+					// the program is left in the middle of its execution
+					g.instance.exited = true
+					return stoppedResult(vm, stopped)
+				}
 				if err != nil {
+					err = guestError(g.instance.guard, err)
+					if ex := hostThrow(vm, err); ex != nil {
+						panic(ex)
+					}
 					panic(vm.NewTypeError("Go.run: " + err.Error()))
 				}
 
@@ -121,8 +207,57 @@ func (g *GoClass) Get(key string) goja.Value {
 	return goja.Undefined()
 }
 
+// runTinyGo starts a program compiled by TinyGo.
+func (g *GoClass) runTinyGo(vm *goja.Runtime) {
+	mem, err := g.instance.inst.Exports.GetMemory("memory")
+	if err != nil {
+		panic(vm.NewTypeError("Go.run: " + err.Error()))
+	}
+	g.instance.mem = mem
+
+	// programs that export resume return from main and handle callbacks afterwards
+	if resume, err := g.instance.inst.Exports.GetFunction("resume"); err == nil {
+		g.instance.resume = resume
+	}
+
+	start, err := g.instance.inst.Exports.GetFunction("_initialize")
+	if err != nil {
+		start, err = g.instance.inst.Exports.GetFunction("_start")
+		if err != nil {
+			panic(vm.NewTypeError("Go.run: " + err.Error()))
+		}
+	}
+
+	ctx := runtimeContext(vm)
+	done, err := interruptible(vm, ctx, g.instance.inst)
+	if err != nil {
+		stoppedResult(vm, err)
+		return
+	}
+	leave := g.instance.enter()
+	_, err = start()
+	if err == nil {
+		err = g.instance.tinyGoWake(func() bool { return isInterrupted(vm) || ctx.Err() != nil })
+	}
+	stopped := done()
+	leave()
+	if err != nil && stopped != nil {
+		g.instance.exited = true
+		stoppedResult(vm, stopped)
+		return
+	}
+	g.instance.checkExit()
+	if err != nil && !g.instance.exited {
+		err = guestError(g.instance.guard, err)
+		if ex := hostThrow(vm, err); ex != nil {
+			panic(ex)
+		}
+		panic(g.instance.errorValue(err))
+	}
+}
+
 func (g *GoClass) Set(key string, val goja.Value) bool {
-	return false
+	return g.setFromJS(g.vm, key, val)
 }
 
 func (g *GoClass) Delete(key string) bool {
@@ -148,12 +283,27 @@ type GoImportObject struct {
 	goclass *GoClass
 }
 
+// Init returns the imports of programs compiled by the Go toolchain.
+// See InitModule for programs that may be compiled by TinyGo.
 func (g *GoImportObject) Init(store *wasmer.Store) *wasmer.ImportObject {
+	g.goclass.instance.tinygo = false
 	importObject := wasmer.NewImportObject()
-	importObject.Register("go", goRuntime(store, g.goclass.instance))
+	funcs := g.goclass.instance.link(store, goRuntime(store, g.goclass.instance))
+	// Go 1.21 renamed the import module from "go" to "gojs"
+	importObject.Register("go", funcs)
+	importObject.Register("gojs", funcs)
 	return importObject
 }
 
+// InitModule returns the imports of module, which may be compiled by the Go toolchain or TinyGo.
+func (g *GoImportObject) InitModule(store *wasmer.Store, module *wasmer.Module) *wasmer.ImportObject {
+	if isTinyGo(module) {
+		g.goclass.instance.tinygo = true
+		return tinyGoImports(store, module, g.goclass.instance)
+	}
+	return g.Init(store)
+}
+
 func (g *GoImportObject) Get(key string) goja.Value {
 	switch key {
 	}
@@ -0,0 +1,217 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+)
+
+// moduleInfo describes a module beyond what wasmer knows: the code of the module,
+// to report the frames of traps, and the values it rewrote. It is serialized with
+// the module, see CompiledModule.Serialize.
+type moduleInfo struct {
+	// Names are the names of functions, from the name section of the module.
+	Names map[uint32]string
+	// Offsets map the code of the compiled module to the module it was compiled from,
+	// through each rewrite of the module, the last one first.
+	Offsets []offsetMap
+	// Externrefs are the signatures using externref, nil if it was not lowered.
+	Externrefs *externrefs
+	// V128 are the signatures using v128 given adapters, nil if none.
+	V128 *v128Signatures
+	// Memories are the memories of the module, imported ones first.
+	Memories []memoryDecl
+}
+
+// memoryDecl is a memory declared by a module.
+type memoryDecl struct {
+	// Min is the initial number of pages of the memory.
+	Min      uint32
+	Imported bool
+}
+
+// newModuleInfo returns the info of the module b, whose compiled code is mapped to b by offsets.
+func newModuleInfo(b []byte, offsets ...offsetMap) *moduleInfo {
+	return &moduleInfo{Names: functionNames(b), Offsets: offsets, Memories: memoryDecls(b)}
+}
+
+// name returns the name of the function index, or "" if it has none. d may be nil.
+func (d *moduleInfo) name(index uint32) string {
+	if d == nil {
+		return ""
+	}
+	return d.Names[index]
+}
+
+// externrefs returns the signatures using lowered externref values, nil if none. d may be nil.
+func (d *moduleInfo) externrefs() *externrefs {
+	if d == nil {
+		return nil
+	}
+	return d.Externrefs
+}
+
+// v128 returns the signatures using v128, nil if none. d may be nil.
+func (d *moduleInfo) v128() *v128Signatures {
+	if d == nil {
+		return nil
+	}
+	return d.V128
+}
+
+// memories returns the memories of the module, nil if unknown. d may be nil.
+func (d *moduleInfo) memories() []memoryDecl {
+	if d == nil {
+		return nil
+	}
+	return d.Memories
+}
+
+// offset returns the offset in the original module of off, an offset in the compiled module. d may be nil.
+func (d *moduleInfo) offset(off uint32) uint32 {
+	if d == nil {
+		return off
+	}
+	for _, m := range d.Offsets {
+		off = m.original(off)
+	}
+	return off
+}
+
+func (d *moduleInfo) encode() ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(d); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeModuleInfo(b []byte) (*moduleInfo, error) {
+	d := &moduleInfo{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// offsetPoint maps the offset New of a rewritten module to the offset Orig of the original one.
+type offsetPoint struct {
+	New, Orig uint32
+}
+
+// offsetMap maps the offsets of a rewritten module to the original one, by the
+// points where the code moved. Offsets past a point move by the same amount.
+type offsetMap []offsetPoint
+
+// add maps newOff to orig, if the offsets do not already move by the same amount.
+func (m *offsetMap) add(newOff, orig int) {
+	if n := len(*m); n > 0 {
+		last := (*m)[n-1]
+		if int(last.Orig)-int(last.New) == orig-newOff {
+			return
+		}
+	}
+	*m = append(*m, offsetPoint{New: uint32(newOff), Orig: uint32(orig)})
+}
+
+// original returns the offset in the original module of off.
+func (m offsetMap) original(off uint32) uint32 {
+	i := sort.Search(len(m), func(i int) bool { return m[i].New > off })
+	if i == 0 {
+		return off
+	}
+	p := m[i-1]
+	return p.Orig + off - p.New
+}
+
+// memoryDecls returns the memories of the binary module b, nil if it is malformed.
+func memoryDecls(b []byte) []memoryDecl {
+	if len(b) < 8 || !bytes.Equal(b[:4], wasmMagic) {
+		return nil
+	}
+	memories := []memoryDecl{}
+	// min reads limits, returning their minimum
+	min := func(r *wasmReader) uint32 {
+		flags := r.byte()
+		n := r.u32()
+		if flags&1 != 0 {
+			r.skipLEB()
+		}
+		return n
+	}
+	r := &wasmReader{b: b, off: 8}
+	for !r.done() && r.err == nil {
+		id := r.byte()
+		s := &wasmReader{b: r.bytes(int(r.u32()))}
+		switch id {
+		case importSection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				s.bytes(int(s.u32()))
+				s.bytes(int(s.u32()))
+				switch s.byte() {
+				case 0:
+					s.u32()
+				case 1:
+					s.byte()
+					s.limits()
+				case 2:
+					memories = append(memories, memoryDecl{Min: min(s), Imported: true})
+				case 3:
+					s.byte()
+					s.byte()
+				case 4:
+					s.byte()
+					s.u32()
+				}
+			}
+		case memorySection:
+			for n := s.u32(); n > 0 && s.err == nil; n-- {
+				memories = append(memories, memoryDecl{Min: min(s)})
+			}
+		}
+		if s.err != nil {
+			return nil
+		}
+	}
+	if r.err != nil {
+		return nil
+	}
+	return memories
+}
+
+// functionNames returns the function names of the name section of the binary module b.
+func functionNames(b []byte) map[uint32]string {
+	if len(b) < 8 || !bytes.Equal(b[:4], wasmMagic) {
+		return nil
+	}
+	r := &wasmReader{b: b, off: 8}
+	for !r.done() && r.err == nil {
+		id := r.byte()
+		data := r.bytes(int(r.u32()))
+		if id != customSection {
+			continue
+		}
+		s := &wasmReader{b: data}
+		if string(s.bytes(int(s.u32()))) != "name" {
+			continue
+		}
+		for !s.done() && s.err == nil {
+			sub := s.byte()
+			payload := s.bytes(int(s.u32()))
+			if sub != 1 {
+				continue
+			}
+			p := &wasmReader{b: payload}
+			names := map[uint32]string{}
+			for n := p.u32(); n > 0 && p.err == nil; n-- {
+				index := p.u32()
+				names[index] = string(p.bytes(int(p.u32())))
+			}
+			if p.err != nil {
+				return nil
+			}
+			return names
+		}
+	}
+	return nil
+}
@@ -0,0 +1,735 @@
+package wasm
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/dop251/goja"
+)
+
+// WritableFS is a file system that can be modified by the guest.
+// Files opened for writing must implement io.Writer, and may implement
+// io.WriterAt, Truncate(int64) error and Sync() error.
+type WritableFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	Mkdir(name string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+}
+
+// DirFS returns a WritableFS for the host directory dir.
+// Names are resolved inside dir: symbolic links are followed,
+// but names resolving to files outside dir are rejected.
+func DirFS(dir string) WritableFS {
+	return dirFS{dir: dir}
+}
+
+type dirFS struct {
+	dir string
+}
+
+// resolve returns the host path of name with symbolic links resolved, the last
+// element only if follow is set, and an error if it is outside the directory.
+func (d dirFS) resolve(op, name string, follow bool) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := filepath.EvalSymlinks(d.dir)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: hostError(err)}
+	}
+	if name == "." {
+		return root, nil
+	}
+	parent, base := filepath.Split(filepath.Join(root, filepath.FromSlash(name)))
+	if parent, err = filepath.EvalSymlinks(parent); err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: hostError(err)}
+	}
+	p := filepath.Join(parent, base)
+	if _, err := os.Lstat(p); err == nil && follow {
+		// links to missing files are not followed when creating them either
+		if p, err = filepath.EvalSymlinks(p); err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: hostError(err)}
+		}
+	}
+	if rel, err := filepath.Rel(root, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return p, nil
+}
+
+// hostError returns the cause of err without the host path it names.
+func hostError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	p, err := d.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (d dirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	p, err := d.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (d dirFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := d.resolve("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+// Remove and Rename act on links themselves, like os.Remove and os.Rename.
+
+func (d dirFS) Remove(name string) error {
+	p, err := d.resolve("remove", name, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d dirFS) Rename(oldname, newname string) error {
+	oldpath, err := d.resolve("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+	newpath, err := d.resolve("rename", newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// EnableNodeFS exposes fsys to Go guests through the global fs, process and path
+// objects, the way wasm_exec.js expects Node.js to provide them.
+// fsys may be nil, a read-only fs.FS or a WritableFS.
+func EnableNodeFS(vm *goja.Runtime, fsys fs.FS) *NodeFS {
+	nodefs := NewNodeFS(vm, fsys)
+	vm.Set("fs", vm.NewDynamicObject(nodefs))
+	vm.Set("process", vm.NewDynamicObject(&NodeProcess{vm: vm, fs: nodefs}))
+	vm.Set("path", nodefs.pathObject())
+	return nodefs
+}
+
+// nodeShims returns the default fs, process and path objects of a Go program,
+// which it sees on its global object when the global object does not have them,
+// like wasm_exec.js provides them.
+func nodeShims(vm *goja.Runtime) map[string]goja.Value {
+	nodefs := NewNodeFS(vm, nil)
+	return map[string]goja.Value{
+		"fs":      vm.NewDynamicObject(nodefs),
+		"process": vm.NewDynamicObject(&NodeProcess{vm: vm, fs: nodefs}),
+		"path":    nodefs.pathObject(),
+	}
+}
+
+// NodeFS implements the subset of the Node.js fs module used by Go guests.
+type NodeFS struct {
+	vm   *goja.Runtime
+	fsys fs.FS
+
+	cwd    string
+	files  map[int64]*nodeFile
+	nextFd int64
+
+	funcs map[string]goja.Value
+
+	// active holds the Go programs currently running, innermost last
+	active []*GoInstance
+}
+
+// nodeDirectory is the O_DIRECTORY flag given to guests,
+// it is not passed on to the file system.
+const nodeDirectory = 1 << 30
+
+type nodeFile struct {
+	file fs.File
+	flag int
+}
+
+// NewNodeFS returns a fs object backed by fsys.
+// File descriptors 0, 1 and 2 are the standard streams of the running Go program.
+func NewNodeFS(vm *goja.Runtime, fsys fs.FS) *NodeFS {
+	return &NodeFS{
+		vm:     vm,
+		fsys:   fsys,
+		cwd:    "/",
+		files:  map[int64]*nodeFile{},
+		nextFd: 3,
+	}
+}
+
+func (n *NodeFS) Get(key string) goja.Value {
+	if key == "constants" {
+		return n.vm.ToValue(map[string]interface{}{
+			"O_WRONLY": os.O_WRONLY,
+			"O_RDWR":   os.O_RDWR,
+			"O_CREAT":  os.O_CREATE,
+			"O_TRUNC":  os.O_TRUNC,
+			"O_APPEND": os.O_APPEND,
+			"O_EXCL":   os.O_EXCL,
+
+			"O_DIRECTORY": nodeDirectory,
+		})
+	}
+	if v, ok := n.funcs[key]; ok {
+		return v
+	}
+	var f func(goja.FunctionCall) goja.Value
+	switch key {
+	case "writeSync":
+		f = func(call goja.FunctionCall) goja.Value {
+			written, err := n.write(call.Argument(0).ToInteger(), typedArrayBytes(n.vm, call.Argument(1)), goja.Null())
+			if err != nil {
+				panic(n.newError(err))
+			}
+			return n.vm.ToValue(written)
+		}
+	case "write":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			buf, err := n.window(call.Argument(1), call.Argument(2), call.Argument(3))
+			if err != nil {
+				return nil, err
+			}
+			return n.write(call.Argument(0).ToInteger(), buf, call.Argument(4))
+		})
+	case "read":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			buf, err := n.window(call.Argument(1), call.Argument(2), call.Argument(3))
+			if err != nil {
+				return nil, err
+			}
+			return n.read(call.Argument(0).ToInteger(), buf, call.Argument(4))
+		})
+	case "open":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			return n.open(call.Argument(0).String(), int(call.Argument(1).ToInteger()), fs.FileMode(call.Argument(2).ToInteger()))
+		})
+	case "close":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			fd := call.Argument(0).ToInteger()
+			file, err := n.file(fd)
+			if err != nil {
+				return nil, err
+			}
+			delete(n.files, fd)
+			return nil, file.file.Close()
+		})
+	case "fstat":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			file, err := n.file(call.Argument(0).ToInteger())
+			if err != nil {
+				return nil, err
+			}
+			info, err := file.file.Stat()
+			if err != nil {
+				return nil, err
+			}
+			return n.stat(info), nil
+		})
+	case "stat", "lstat":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			name, err := n.resolve(call.Argument(0).String())
+			if err != nil {
+				return nil, err
+			}
+			info, err := fs.Stat(n.fsys, name)
+			if err != nil {
+				return nil, err
+			}
+			return n.stat(info), nil
+		})
+	case "readdir":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			name, err := n.resolve(call.Argument(0).String())
+			if err != nil {
+				return nil, err
+			}
+			entries, err := fs.ReadDir(n.fsys, name)
+			if err != nil {
+				return nil, err
+			}
+			names := make([]interface{}, len(entries))
+			for i, entry := range entries {
+				names[i] = entry.Name()
+			}
+			return n.vm.NewArray(names...), nil
+		})
+	case "mkdir":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			wfs, name, err := n.writable(call.Argument(0).String())
+			if err != nil {
+				return nil, err
+			}
+			return nil, wfs.Mkdir(name, fs.FileMode(call.Argument(1).ToInteger()))
+		})
+	case "rmdir", "unlink":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			wfs, name, err := n.writable(call.Argument(0).String())
+			if err != nil {
+				return nil, err
+			}
+			return nil, wfs.Remove(name)
+		})
+	case "rename":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			wfs, from, err := n.writable(call.Argument(0).String())
+			if err != nil {
+				return nil, err
+			}
+			to, err := n.resolve(call.Argument(1).String())
+			if err != nil {
+				return nil, err
+			}
+			return nil, wfs.Rename(from, to)
+		})
+	case "ftruncate":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			file, err := n.file(call.Argument(0).ToInteger())
+			if err != nil {
+				return nil, err
+			}
+			return nil, truncateFile(file.file, call.Argument(1).ToInteger())
+		})
+	case "truncate":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			wfs, name, err := n.writable(call.Argument(0).String())
+			if err != nil {
+				return nil, err
+			}
+			file, err := wfs.OpenFile(name, os.O_WRONLY, 0)
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			return nil, truncateFile(file, call.Argument(1).ToInteger())
+		})
+	case "fsync":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			file, err := n.file(call.Argument(0).ToInteger())
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := file.file.(interface{ Sync() error }); ok {
+				return nil, s.Sync()
+			}
+			return nil, nil
+		})
+	case "chmod", "chown", "fchmod", "fchown", "lchown", "link", "readlink", "symlink", "utimes":
+		f = n.async(func(call goja.FunctionCall) (interface{}, error) {
+			return nil, syscall.ENOSYS
+		})
+	default:
+		return goja.Undefined()
+	}
+	if n.funcs == nil {
+		n.funcs = map[string]goja.Value{}
+	}
+	n.funcs[key] = n.vm.ToValue(f)
+	return n.funcs[key]
+}
+
+func (n *NodeFS) Set(key string, val goja.Value) bool {
+	return false
+}
+
+func (n *NodeFS) Delete(key string) bool {
+	return false
+}
+
+func (n *NodeFS) Has(key string) bool {
+	for _, k := range n.Keys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NodeFS) Keys() []string {
+	return []string{
+		"constants", "writeSync", "write", "read", "open", "close", "fstat", "stat", "lstat",
+		"readdir", "mkdir", "rmdir", "unlink", "rename", "ftruncate", "truncate", "fsync",
+		"chmod", "chown", "fchmod", "fchown", "lchown", "link", "readlink", "symlink", "utimes",
+	}
+}
+
+// async wraps fn as a Node.js style asynchronous function,
+// calling the callback passed as last argument with the outcome of fn.
+func (n *NodeFS) async(fn func(call goja.FunctionCall) (interface{}, error)) func(goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		callback, ok := goja.AssertFunction(call.Argument(len(call.Arguments) - 1))
+		if !ok {
+			panic(n.vm.NewTypeError("fs: callback must be a function"))
+		}
+		result, err := fn(call)
+		if err != nil {
+			callback(goja.Undefined(), n.newError(err))
+		} else {
+			callback(goja.Undefined(), goja.Null(), n.vm.ToValue(result))
+		}
+		return goja.Undefined()
+	}
+}
+
+// newError converts err into a JS Error carrying a Node.js error code.
+func (n *NodeFS) newError(err error) *goja.Object {
+	e := n.vm.NewGoError(err)
+	e.Set("code", errorCode(err))
+	return e
+}
+
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "ENOENT"
+	case errors.Is(err, fs.ErrExist):
+		return "EEXIST"
+	case errors.Is(err, fs.ErrPermission):
+		return "EACCES"
+	case errors.Is(err, fs.ErrClosed):
+		return "EBADF"
+	case errors.Is(err, fs.ErrInvalid):
+		return "EINVAL"
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EBADF, syscall.EISDIR, syscall.ENOTDIR, syscall.ENOTEMPTY,
+		syscall.EROFS, syscall.ENOSYS, syscall.EINVAL, syscall.ENOSPC,
+	} {
+		if errors.Is(err, errno) {
+			return errnoCodes[errno]
+		}
+	}
+	return "EIO"
+}
+
+var errnoCodes = map[syscall.Errno]string{
+	syscall.EBADF:     "EBADF",
+	syscall.EISDIR:    "EISDIR",
+	syscall.ENOTDIR:   "ENOTDIR",
+	syscall.ENOTEMPTY: "ENOTEMPTY",
+	syscall.EROFS:     "EROFS",
+	syscall.ENOSYS:    "ENOSYS",
+	syscall.EINVAL:    "EINVAL",
+	syscall.ENOSPC:    "ENOSPC",
+}
+
+// resolve converts a guest path into a name valid for fs.FS,
+// resolving relative paths against the current directory.
+func (n *NodeFS) resolve(p string) (string, error) {
+	if n.fsys == nil {
+		return "", syscall.ENOSYS
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(n.cwd, p)
+	}
+	name := strings.TrimPrefix(path.Clean(p), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: p, Err: fs.ErrInvalid}
+	}
+	return name, nil
+}
+
+func (n *NodeFS) writable(p string) (WritableFS, string, error) {
+	name, err := n.resolve(p)
+	if err != nil {
+		return nil, "", err
+	}
+	wfs, ok := n.fsys.(WritableFS)
+	if !ok {
+		return nil, "", syscall.EROFS
+	}
+	return wfs, name, nil
+}
+
+func (n *NodeFS) file(fd int64) (*nodeFile, error) {
+	file, ok := n.files[fd]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return file, nil
+}
+
+func (n *NodeFS) open(p string, flag int, perm fs.FileMode) (int64, error) {
+	directory := flag&nodeDirectory != 0
+	flag &^= nodeDirectory
+
+	var file fs.File
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		wfs, name, err := n.writable(p)
+		if err != nil {
+			return 0, err
+		}
+		if file, err = wfs.OpenFile(name, flag, perm); err != nil {
+			return 0, err
+		}
+	} else {
+		name, err := n.resolve(p)
+		if err != nil {
+			return 0, err
+		}
+		if file, err = n.fsys.Open(name); err != nil {
+			return 0, err
+		}
+	}
+	if directory {
+		info, err := file.Stat()
+		if err == nil && !info.IsDir() {
+			err = syscall.ENOTDIR
+		}
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+	fd := n.nextFd
+	n.nextFd++
+	n.files[fd] = &nodeFile{file: file, flag: flag}
+	return fd, nil
+}
+
+func (n *NodeFS) write(fd int64, buf []byte, position goja.Value) (int, error) {
+	switch fd {
+	case 1, 2:
+		return n.streams().writer(fd).Write(buf)
+	}
+	file, err := n.file(fd)
+	if err != nil {
+		return 0, err
+	}
+	if !goja.IsNull(position) && !goja.IsUndefined(position) {
+		w, ok := file.file.(io.WriterAt)
+		if !ok {
+			return 0, syscall.ESPIPE
+		}
+		return w.WriteAt(buf, position.ToInteger())
+	}
+	w, ok := file.file.(io.Writer)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	return w.Write(buf)
+}
+
+func (n *NodeFS) read(fd int64, buf []byte, position goja.Value) (int, error) {
+	var read int
+	if fd == 0 {
+		read, err := n.streams().reader(fd).Read(buf)
+		if err == io.EOF {
+			err = nil
+		}
+		return read, err
+	}
+	file, err := n.file(fd)
+	if err != nil {
+		return 0, err
+	}
+	if !goja.IsNull(position) && !goja.IsUndefined(position) {
+		r, ok := file.file.(io.ReaderAt)
+		if !ok {
+			return 0, syscall.ESPIPE
+		}
+		read, err = r.ReadAt(buf, position.ToInteger())
+	} else {
+		read, err = file.file.Read(buf)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return read, err
+}
+
+// streams returns the standard streams of the running Go program.
+func (n *NodeFS) streams() *stdio {
+	if len(n.active) == 0 {
+		return &stdio{}
+	}
+	return n.active[len(n.active)-1].streams()
+}
+
+// window returns the bytes of the typed array buf between offset and offset+length.
+func (n *NodeFS) window(buf, offset, length goja.Value) ([]byte, error) {
+	b := typedArrayBytes(n.vm, buf)
+	start, l := offset.ToInteger(), length.ToInteger()
+	if start < 0 || l < 0 || start+l > int64(len(b)) {
+		return nil, syscall.EINVAL
+	}
+	return b[start : start+l], nil
+}
+
+func (n *NodeFS) stat(info fs.FileInfo) *goja.Object {
+	mode := uint32(info.Mode().Perm())
+	switch {
+	case info.IsDir():
+		mode |= uint32(syscall.S_IFDIR)
+	case info.Mode()&fs.ModeSymlink != 0:
+		mode |= uint32(syscall.S_IFLNK)
+	case info.Mode()&fs.ModeNamedPipe != 0:
+		mode |= uint32(syscall.S_IFIFO)
+	case info.Mode()&fs.ModeSocket != 0:
+		mode |= uint32(syscall.S_IFSOCK)
+	case info.Mode()&fs.ModeCharDevice != 0:
+		mode |= uint32(syscall.S_IFCHR)
+	default:
+		mode |= uint32(syscall.S_IFREG)
+	}
+	mtime := info.ModTime().UnixNano() / 1e6
+	isDir := info.IsDir()
+
+	obj := n.vm.NewObject()
+	obj.Set("dev", 0)
+	obj.Set("ino", 0)
+	obj.Set("mode", mode)
+	obj.Set("nlink", 1)
+	obj.Set("uid", 0)
+	obj.Set("gid", 0)
+	obj.Set("rdev", 0)
+	obj.Set("size", info.Size())
+	obj.Set("blksize", 4096)
+	obj.Set("blocks", (info.Size()+511)/512)
+	obj.Set("atimeMs", mtime)
+	obj.Set("mtimeMs", mtime)
+	obj.Set("ctimeMs", mtime)
+	obj.Set("isDirectory", func(goja.FunctionCall) goja.Value {
+		return n.vm.ToValue(isDir)
+	})
+	return obj
+}
+
+// pathObject returns the path object used by Go guests to resolve file names.
+func (n *NodeFS) pathObject() *goja.Object {
+	obj := n.vm.NewObject()
+	obj.Set("resolve", func(call goja.FunctionCall) goja.Value {
+		p := n.cwd
+		for _, arg := range call.Arguments {
+			if s := arg.String(); path.IsAbs(s) {
+				p = s
+			} else {
+				p = path.Join(p, s)
+			}
+		}
+		return n.vm.ToValue(path.Clean(p))
+	})
+	return obj
+}
+
+func truncateFile(file fs.File, size int64) error {
+	t, ok := file.(interface{ Truncate(int64) error })
+	if !ok {
+		return syscall.EINVAL
+	}
+	return t.Truncate(size)
+}
+
+// typedArrayBytes returns the bytes viewed by the typed array v.
+func typedArrayBytes(vm *goja.Runtime, v goja.Value) []byte {
+	obj, ok := v.(*goja.Object)
+	if !ok {
+		return nil
+	}
+	buffer := obj.Get("buffer")
+	if buffer == nil {
+		return nil
+	}
+	ar, ok := buffer.Export().(goja.ArrayBuffer)
+	if !ok {
+		return nil
+	}
+	b := ar.Bytes()
+	offset := obj.Get("byteOffset").ToInteger()
+	length := obj.Get("byteLength").ToInteger()
+	if offset < 0 || length < 0 || offset+length > int64(len(b)) {
+		return nil
+	}
+	return b[offset : offset+length]
+}
+
+// NodeProcess implements the subset of the Node.js process object used by Go guests.
+type NodeProcess struct {
+	vm *goja.Runtime
+	fs *NodeFS
+}
+
+func (p *NodeProcess) Get(key string) goja.Value {
+	switch key {
+	case "pid", "ppid":
+		return p.vm.ToValue(-1)
+	case "getuid", "getgid", "geteuid", "getegid":
+		return p.vm.ToValue(func(goja.FunctionCall) goja.Value {
+			return p.vm.ToValue(-1)
+		})
+	case "getgroups", "umask":
+		return p.vm.ToValue(func(goja.FunctionCall) goja.Value {
+			panic(p.fs.newError(syscall.ENOSYS))
+		})
+	case "cwd":
+		return p.vm.ToValue(func(goja.FunctionCall) goja.Value {
+			return p.vm.ToValue(p.fs.cwd)
+		})
+	case "chdir":
+		return p.vm.ToValue(func(call goja.FunctionCall) goja.Value {
+			dir := call.Argument(0).String()
+			name, err := p.fs.resolve(dir)
+			if err != nil {
+				panic(p.fs.newError(err))
+			}
+			info, err := fs.Stat(p.fs.fsys, name)
+			if err != nil {
+				panic(p.fs.newError(err))
+			}
+			if !info.IsDir() {
+				panic(p.fs.newError(syscall.ENOTDIR))
+			}
+			if name == "." {
+				name = ""
+			}
+			p.fs.cwd = "/" + name
+			return goja.Undefined()
+		})
+	}
+	return goja.Undefined()
+}
+
+func (p *NodeProcess) Set(key string, val goja.Value) bool {
+	return false
+}
+
+func (p *NodeProcess) Delete(key string) bool {
+	return false
+}
+
+func (p *NodeProcess) Has(key string) bool {
+	for _, k := range p.Keys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *NodeProcess) Keys() []string {
+	return []string{"pid", "ppid", "getuid", "getgid", "geteuid", "getegid", "getgroups", "umask", "cwd", "chdir"}
+}
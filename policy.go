@@ -0,0 +1,57 @@
+package wasm
+
+import (
+	"strings"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// ImportPolicy lists the imports modules may request, by module name.
+// The name "*" allows every import of a module, so that
+//
+//	ImportPolicy{"wasi_snapshot_preview1": {"*"}, "env": {"log"}}
+//
+// lets modules use WASI and env.log only.
+type ImportPolicy map[string][]string
+
+// WithImportPolicy rejects the instantiation of modules requesting imports p does not allow.
+func WithImportPolicy(p ImportPolicy) Option {
+	return func(cfg *runtimeConfig) {
+		cfg.imports = p
+	}
+}
+
+// allows reports whether p allows the import name of module.
+func (p ImportPolicy) allows(module, name string) bool {
+	for _, allowed := range p[module] {
+		if allowed == "*" || allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an ImportError listing the imports of module p does not allow.
+func (p ImportPolicy) check(module *wasmer.Module) error {
+	var denied []string
+	for _, imp := range module.Imports() {
+		if !p.allows(imp.Module(), imp.Name()) {
+			denied = append(denied, imp.Module()+"."+imp.Name())
+		}
+	}
+	if len(denied) > 0 {
+		return &ImportError{Imports: denied}
+	}
+	return nil
+}
+
+// ImportError is the error of instantiating a module that requests imports
+// the import policy of the runtime does not allow. Scripts see a LinkError.
+type ImportError struct {
+	// Imports are the denied imports, as module.name.
+	Imports []string
+}
+
+func (e *ImportError) Error() string {
+	return "module requests imports that are not allowed: " + strings.Join(e.Imports, ", ")
+}
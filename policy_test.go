@@ -0,0 +1,54 @@
+package wasm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestImportPolicy(t *testing.T) {
+	b := wat(t, `(module
+	  (import "env" "log" (func))
+	  (import "env" "secret" (func))
+	  (import "go" "debug" (func))
+	  (import "wasi_snapshot_preview1" "fd_write" (func (param i32 i32 i32 i32) (result i32))))`)
+	vm := goja.New()
+	Enable(vm, WithImportPolicy(ImportPolicy{"wasi_snapshot_preview1": {"*"}, "env": {"log"}}))
+	vm.Set("bytes", vm.NewArrayBuffer(b))
+	v, err := vm.RunString(`
+	  const noop = () => 0;
+	  const imports = {env: {log: noop, secret: noop}, go: {debug: noop}, wasi_snapshot_preview1: {fd_write: noop}};
+	  let result;
+	  try {
+	    new WebAssembly.Instance(new WebAssembly.Module(bytes), imports);
+	  } catch (e) {
+	    result = [e instanceof WebAssembly.LinkError, e.message];
+	  }
+	  result;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{true, "WebAssembly.Instance: module requests imports that are not allowed: env.secret, go.debug"}
+	if got := v.Export(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// embedders see the denied imports
+	module, err := NewModule(vm, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the policy is checked before the imports
+	_, err = NewInstance(vm, module, nil)
+	if err, ok := err.(*ImportError); !ok || !reflect.DeepEqual(err.Imports, []string{"env.secret", "go.debug"}) {
+		t.Errorf("NewInstance: got %v, want an ImportError denying env.secret and go.debug", err)
+	}
+
+	// modules requesting allowed imports only are instantiated
+	vm.Set("bytes", vm.NewArrayBuffer(wat(t, `(module (import "env" "log" (func)))`)))
+	if _, err := vm.RunString(`new WebAssembly.Instance(new WebAssembly.Module(bytes), imports)`); err != nil {
+		t.Errorf("allowed imports: %v", err)
+	}
+}
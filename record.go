@@ -0,0 +1,404 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// hostCall is the record of a call to a host function.
+// Values are stored as their bits, their kinds are given by the function type.
+//
+// A call during which the host called back into the guest is recorded as one record
+// per callback, followed by the records of the calls the guest made during the callback,
+// and finally the record of the call itself.
+type hostCall struct {
+	Import  string
+	Args    []uint64
+	Results []uint64
+	Err     string
+	// Memory are the accesses of the host to the guest memory during the call, in order,
+	// since the last callback if any
+	Memory []memoryAccess
+	// Callback is the export of the guest the host called back, in the record of a callback
+	Callback string
+}
+
+// memoryAccess is a span of guest memory the host read or wrote, with the bytes read or written.
+type memoryAccess struct {
+	Offset uint32
+	Data   []byte
+	Write  bool
+}
+
+// hostFunction is a function implemented by the host.
+// It keeps its implementation so that it can be intercepted.
+type hostFunction struct {
+	*wasmer.Function
+	typ *wasmer.FunctionType
+	fn  func([]wasmer.Value) ([]wasmer.Value, error)
+}
+
+func newHostFunction(store *wasmer.Store, typ *wasmer.FunctionType, fn func([]wasmer.Value) ([]wasmer.Value, error)) *hostFunction {
+	return &hostFunction{
+		Function: wasmer.NewFunction(store, typ, fn),
+		typ:      typ,
+		fn:       fn,
+	}
+}
+
+// hostInterceptor is called instead of the host functions of a guest.
+type hostInterceptor interface {
+	call(name string, fn *hostFunction, args []wasmer.Value, memory *memoryTrace) ([]wasmer.Value, error)
+	// reenter is called when the host calls the export of the guest,
+	// and returns the function to call once the guest returns
+	reenter(export string, memory *memoryTrace) func()
+	// failure returns the error that made the guest trap, if any
+	failure() error
+}
+
+// guestError returns the error of a guest call, replacing the trap
+// of a failed interceptor by the error that caused it.
+func guestError(h hostInterceptor, err error) error {
+	if err != nil && h != nil {
+		if failure := h.failure(); failure != nil {
+			return failure
+		}
+	}
+	return err
+}
+
+// Recorder logs the host calls of a guest to a file that a Replayer reads back.
+// Each call records the import name, arguments, results
+// and the guest memory the host functions read and wrote.
+type Recorder struct {
+	enc   *gob.Encoder
+	err   error
+	depth int
+}
+
+// NewRecorder returns a recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: gob.NewEncoder(w)}
+}
+
+// Err returns the first error writing the recording.
+func (r *Recorder) Err() error {
+	return r.err
+}
+
+func (r *Recorder) failure() error {
+	return nil
+}
+
+func (r *Recorder) call(name string, fn *hostFunction, args []wasmer.Value, memory *memoryTrace) ([]wasmer.Value, error) {
+	memory.start()
+	r.depth++
+	results, err := fn.fn(args)
+	r.depth--
+
+	c := hostCall{
+		Import: name,
+		Args:   valueBits(args),
+		Memory: memory.stop(),
+	}
+	if err != nil {
+		c.Err = err.Error()
+	} else {
+		c.Results = valueBits(results)
+	}
+	r.encode(&c)
+	return results, err
+}
+
+func (r *Recorder) reenter(export string, memory *memoryTrace) func() {
+	// the guest entered outside of host calls is entered again by the code replayed
+	if r.depth == 0 {
+		return func() {}
+	}
+	// the calls the guest makes during the callback are recorded on their own
+	r.encode(&hostCall{Callback: export, Memory: memory.stop()})
+	depth := r.depth
+	r.depth = 0
+	return func() {
+		r.depth = depth
+		memory.start()
+	}
+}
+
+func (r *Recorder) encode(c *hostCall) {
+	if r.err == nil {
+		r.err = r.enc.Encode(c)
+	}
+}
+
+// Replayer feeds the host calls of a recording back to a guest,
+// which runs without calling the host.
+// The guest traps when it makes a call that differs from the recording.
+type Replayer struct {
+	dec   *gob.Decoder
+	err   error
+	calls int
+}
+
+// NewReplayer returns a replayer reading the recording from r.
+func NewReplayer(r io.Reader) *Replayer {
+	return &Replayer{dec: gob.NewDecoder(r)}
+}
+
+// Err returns the error that stopped the replay, if the guest diverged from the recording.
+func (r *Replayer) Err() error {
+	return r.err
+}
+
+func (r *Replayer) failure() error {
+	return r.err
+}
+
+func (r *Replayer) call(name string, fn *hostFunction, args []wasmer.Value, memory *memoryTrace) ([]wasmer.Value, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	r.calls++
+
+	calls := r.calls
+	var c hostCall
+	for {
+		if err := r.dec.Decode(&c); err != nil {
+			if err == io.EOF {
+				r.err = fmt.Errorf("replay: call %d to %s is not in the recording", calls, name)
+			} else {
+				r.err = fmt.Errorf("replay: %w", err)
+			}
+			return nil, r.err
+		}
+		if c.Callback == "" {
+			break
+		}
+		// the host called back into the guest, which makes the calls recorded next
+		if memory.callback == nil {
+			r.err = fmt.Errorf("replay: call %d to %s calls back into %s, which the guest does not support", calls, name, c.Callback)
+			return nil, r.err
+		}
+		if r.replayMemory(calls, name, c.Memory, memory) != nil {
+			return nil, r.err
+		}
+		if err := memory.callback(c.Callback); err != nil && r.err == nil {
+			r.err = fmt.Errorf("replay: callback of call %d to %s: %w", calls, name, err)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		c = hostCall{}
+	}
+	if bits := valueBits(args); c.Import != name || !equalBits(c.Args, bits) {
+		r.err = fmt.Errorf("replay: call %d is %s%v, recorded %s%v", calls, name, bits, c.Import, c.Args)
+		return nil, r.err
+	}
+	if r.replayMemory(calls, name, c.Memory, memory) != nil {
+		return nil, r.err
+	}
+	if c.Err != "" {
+		return nil, fmt.Errorf("%s", c.Err)
+	}
+	results := fn.typ.Results()
+	if len(c.Results) != len(results) {
+		r.err = fmt.Errorf("replay: call %d to %s has %d results, recorded %d", calls, name, len(results), len(c.Results))
+		return nil, r.err
+	}
+	values := make([]wasmer.Value, len(results))
+	for i, bits := range c.Results {
+		values[i] = bitsValue(bits, results[i].Kind())
+	}
+	return values, nil
+}
+
+func (r *Replayer) reenter(string, *memoryTrace) func() {
+	return func() {}
+}
+
+// replayMemory replays the accesses of call number n to name.
+// The guest must hold what the host read, as the recorded results depend on it.
+func (r *Replayer) replayMemory(n int, name string, accesses []memoryAccess, memory *memoryTrace) error {
+	mem := memory.bytes()
+	for _, a := range accesses {
+		if uint64(a.Offset)+uint64(len(a.Data)) > uint64(len(mem)) {
+			r.err = fmt.Errorf("replay: call %d to %s accesses memory out of bounds", n, name)
+			return r.err
+		}
+		if a.Write {
+			copy(mem[a.Offset:], a.Data)
+		} else if !bytes.Equal(mem[a.Offset:int(a.Offset)+len(a.Data)], a.Data) {
+			r.err = fmt.Errorf("replay: call %d to %s reads memory at %d that differs from the recording", n, name, a.Offset)
+			return r.err
+		}
+	}
+	return nil
+}
+
+// intercept returns funcs with their host functions replaced by calls to h.
+// The functions named in keep, which end the guest, are left as they are.
+func intercept(h hostInterceptor, funcs map[string]wasmer.IntoExtern, memory *memoryTrace, keep ...string) (map[string]wasmer.IntoExtern, error) {
+	wrapped := make(map[string]wasmer.IntoExtern, len(funcs))
+outer:
+	for name, f := range funcs {
+		wrapped[name] = f
+		fn, ok := f.(*hostFunction)
+		if !ok {
+			continue
+		}
+		for _, k := range keep {
+			if name == k {
+				continue outer
+			}
+		}
+		name := name
+		// the wrapper does not keep the function wrapped alive, see WasmInstance.link
+		fn = &hostFunction{typ: fn.typ, fn: fn.fn}
+		wrapper, err := newTrappingFunction(fn.typ, func(args []wasmer.Value) ([]wasmer.Value, error) {
+			return h.call(name, fn, args, memory)
+		})
+		if err != nil {
+			return nil, err
+		}
+		wrapped[name] = wrapper
+	}
+	return wrapped, nil
+}
+
+func valueBits(values []wasmer.Value) []uint64 {
+	bits := make([]uint64, len(values))
+	for i, v := range values {
+		switch v.Kind() {
+		case wasmer.I32:
+			bits[i] = uint64(uint32(v.I32()))
+		case wasmer.I64:
+			bits[i] = uint64(v.I64())
+		case wasmer.F32:
+			bits[i] = uint64(math.Float32bits(v.F32()))
+		case wasmer.F64:
+			bits[i] = math.Float64bits(v.F64())
+		}
+	}
+	return bits
+}
+
+func bitsValue(bits uint64, kind wasmer.ValueKind) wasmer.Value {
+	switch kind {
+	case wasmer.I64:
+		return wasmer.NewI64(int64(bits))
+	case wasmer.F32:
+		return wasmer.NewF32(math.Float32frombits(uint32(bits)))
+	case wasmer.F64:
+		return wasmer.NewF64(math.Float64frombits(bits))
+	}
+	return wasmer.NewI32(int32(uint32(bits)))
+}
+
+func equalBits(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// memoryTrace is the memory of a guest as interceptors see it. While a Recorder records
+// a call, it collects the accesses of the host functions, which mark them through
+// the memory helpers of the guest. A nil memoryTrace has no memory and traces nothing.
+//
+// The guest itself changes its memory when the host calls back into it, see Recorder.reenter:
+// the accesses of a call are traced up to the callback, and again once the guest returns.
+type memoryTrace struct {
+	data     func() []byte
+	tracing  bool
+	accesses []memoryAccess
+	// pending is the index of the first access whose data may not be copied yet:
+	// writes are marked before the host writes, and copied at the next read
+	pending int
+	// callback calls an export of the guest as the host does when it calls back into it,
+	// nil if the guest does not support callbacks
+	callback func(export string) error
+}
+
+// bytes returns the memory of the guest.
+func (t *memoryTrace) bytes() []byte {
+	if t == nil || t.data == nil {
+		return nil
+	}
+	return t.data()
+}
+
+// start starts tracing the accesses to the memory.
+func (t *memoryTrace) start() {
+	if t != nil {
+		t.tracing = true
+		t.accesses = nil
+		t.pending = 0
+	}
+}
+
+// stop stops tracing and returns the accesses since start.
+func (t *memoryTrace) stop() []memoryAccess {
+	if t == nil {
+		return nil
+	}
+	t.flush()
+	t.tracing = false
+	accesses := t.accesses
+	t.accesses = nil
+	return accesses
+}
+
+// read marks length bytes at offset as read by the host.
+func (t *memoryTrace) read(offset, length int64) {
+	t.mark(offset, length, false)
+}
+
+// write marks length bytes at offset as written by the host,
+// which must write them before it reads guest memory again.
+func (t *memoryTrace) write(offset, length int64) {
+	t.mark(offset, length, true)
+}
+
+func (t *memoryTrace) mark(offset, length int64, write bool) {
+	if t == nil || !t.tracing {
+		return
+	}
+	if !write {
+		t.flush()
+	}
+	mem := t.bytes()
+	if offset < 0 || length <= 0 || offset+length > int64(len(mem)) {
+		// the access fails
+		return
+	}
+	// contiguous accesses of the same kind are merged to keep recordings compact
+	if n := len(t.accesses); n > 0 {
+		last := &t.accesses[n-1]
+		if last.Write == write && int64(last.Offset)+int64(len(last.Data)) == offset {
+			last.Data = append(last.Data, mem[offset:offset+length]...)
+			return
+		}
+	}
+	t.accesses = append(t.accesses, memoryAccess{Offset: uint32(offset), Data: append([]byte(nil), mem[offset:offset+length]...), Write: write})
+}
+
+// flush copies the data of the pending writes.
+func (t *memoryTrace) flush() {
+	mem := t.bytes()
+	for i := t.pending; i < len(t.accesses); i++ {
+		if a := &t.accesses[i]; a.Write {
+			copy(a.Data, mem[a.Offset:])
+		}
+	}
+	t.pending = len(t.accesses)
+}
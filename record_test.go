@@ -0,0 +1,174 @@
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func TestMemoryTrace(t *testing.T) {
+	mem := make([]byte, 64)
+	copy(mem[8:], "input")
+	trace := &memoryTrace{data: func() []byte { return mem }}
+
+	trace.read(0, 4)
+	trace.start()
+	trace.read(8, 2)
+	trace.read(10, 3)
+	// writes are copied once done, at the next read
+	trace.write(16, 2)
+	trace.write(18, 2)
+	copy(mem[16:], "abcd")
+	trace.read(16, 1)
+	trace.write(32, 4)
+	copy(mem[32:], "last")
+	trace.read(100, 1)
+	got := trace.stop()
+	trace.read(8, 1)
+
+	want := []memoryAccess{
+		{Offset: 8, Data: []byte("input")},
+		{Offset: 16, Data: []byte("abcd"), Write: true},
+		{Offset: 16, Data: []byte("a")},
+		{Offset: 32, Data: []byte("last"), Write: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReplayMemory(t *testing.T) {
+	var recording bytes.Buffer
+	mem := make([]byte, 16)
+	copy(mem, "in")
+	trace := &memoryTrace{data: func() []byte { return mem }}
+	fn := &hostFunction{
+		typ: wasmer.NewFunctionType(wasmer.NewValueTypes(), wasmer.NewValueTypes(wasmer.I32)),
+		fn: func([]wasmer.Value) ([]wasmer.Value, error) {
+			trace.read(0, 2)
+			trace.write(8, 3)
+			copy(mem[8:], "out")
+			return []wasmer.Value{wasmer.NewI32(7)}, nil
+		},
+	}
+	rec := NewRecorder(&recording)
+	for i := 0; i < 2; i++ {
+		if _, err := rec.call("f", fn, nil, trace); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mem = make([]byte, 16)
+	copy(mem, "in")
+	rep := NewReplayer(bytes.NewReader(recording.Bytes()))
+	results, err := rep.call("f", fn, nil, trace)
+	if err != nil || results[0].I32() != 7 || string(mem[8:11]) != "out" {
+		t.Fatalf("got %v, %v and memory %q", results, err, mem)
+	}
+	// the host would read something else
+	copy(mem, "no")
+	if _, err := rep.call("f", fn, nil, trace); err == nil || !strings.Contains(err.Error(), "differs from the recording") {
+		t.Errorf("got %v, want a divergence", err)
+	}
+}
+
+func TestReplayCallback(t *testing.T) {
+	var recording bytes.Buffer
+	mem := make([]byte, 16)
+	trace := &memoryTrace{data: func() []byte { return mem }}
+	i32 := wasmer.NewFunctionType(wasmer.NewValueTypes(), wasmer.NewValueTypes(wasmer.I32))
+	var h hostInterceptor
+	// g is called by the guest during the callback, which writes what g returns
+	g := &hostFunction{typ: i32, fn: func([]wasmer.Value) ([]wasmer.Value, error) {
+		return []wasmer.Value{wasmer.NewI32(2)}, nil
+	}}
+	guest := func(string) error {
+		results, err := h.call("g", g, nil, trace)
+		if err == nil {
+			mem[4] = byte(results[0].I32())
+		}
+		return err
+	}
+	// f writes memory, calls back into the guest and reads what it wrote
+	f := &hostFunction{typ: i32, fn: func([]wasmer.Value) ([]wasmer.Value, error) {
+		trace.write(0, 1)
+		mem[0] = 1
+		leave := h.reenter("cb", trace)
+		guest("cb")
+		leave()
+		trace.read(4, 1)
+		return []wasmer.Value{wasmer.NewI32(int32(mem[4]) + 1)}, nil
+	}}
+
+	h = NewRecorder(&recording)
+	if results, err := h.call("f", f, nil, trace); err != nil || results[0].I32() != 3 {
+		t.Fatalf("got %v, %v", results, err)
+	}
+
+	mem = make([]byte, 16)
+	rep := NewReplayer(bytes.NewReader(recording.Bytes()))
+	h = rep
+	// without callbacks, the replay cannot go on
+	if _, err := rep.call("f", f, nil, trace); err == nil || !strings.Contains(err.Error(), "calls back into cb") {
+		t.Fatalf("got %v, want an error about the callback", err)
+	}
+
+	mem = make([]byte, 16)
+	rep = NewReplayer(bytes.NewReader(recording.Bytes()))
+	h = rep
+	trace.callback = guest
+	results, err := rep.call("f", f, nil, trace)
+	if err != nil || results[0].I32() != 3 || mem[0] != 1 || mem[4] != 2 {
+		t.Fatalf("got %v, %v and memory %v", results, err, mem)
+	}
+	if rep.calls != 2 {
+		t.Errorf("replayed %d calls, want 2", rep.calls)
+	}
+}
+
+func TestReplayGoCallbacks(t *testing.T) {
+	// the program calls main when it starts, which calls back into the program
+	// until depth reaches 0, from the JS handler of each event
+	src := fmt.Sprintf(funcOfWat, dispatchWat+`
+	  (data (i32.const 80) "main")
+	  (func (export "_initialize")
+	    (call $start)
+	    (call $valueCall (i32.const 200) (i64.const `+tinyGoGlobal+`) (i32.const 80) (i32.const 4) (i32.const 0) (i32.const 0) (i32.const 0)))`)
+	run := func(h hostInterceptor) int64 {
+		vm := newTinyGoRuntime(t, src)
+		v, err := vm.RunString(`
+		  var main = () => cb(2);
+		  var handle = (self, args) => args[0] === 0 ? "" : String(cb(args[0] - 1));
+		  new Go();
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.Export().(*GoClass).instance.host = h
+		vm.Set("go", v)
+		v, err = vm.RunString(`
+		  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject);
+		  go.run(instance);
+		  instance.exports.handled.value;
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.ToInteger()
+	}
+	var recording bytes.Buffer
+	rec := NewRecorder(&recording)
+	if handled := run(rec); rec.Err() != nil || handled != 3 {
+		t.Fatalf("recorded %d events: %v", handled, rec.Err())
+	}
+
+	// the replay handles the events the host caused during its calls again
+	rep := NewReplayer(bytes.NewReader(recording.Bytes()))
+	if handled := run(rep); rep.Err() != nil || handled != 3 {
+		t.Errorf("replayed %d events: %v", handled, rep.Err())
+	}
+}
@@ -0,0 +1,158 @@
+package wasm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// stdio holds the standard streams of a guest.
+// Nil streams fall back to the streams of the host process,
+// except stdin which then reads as empty.
+type stdio struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// SetStdin sets the reader the guest reads its standard input from.
+func (s *stdio) SetStdin(r io.Reader) {
+	s.stdin = r
+}
+
+// SetStdout sets the writer the guest writes its standard output to.
+func (s *stdio) SetStdout(w io.Writer) {
+	s.flush(s.stdout)
+	s.stdout = w
+}
+
+// SetStderr sets the writer the guest writes its standard error to.
+func (s *stdio) SetStderr(w io.Writer) {
+	s.flush(s.stderr)
+	s.stderr = w
+}
+
+func (s *stdio) reader(fd int64) io.Reader {
+	if fd != 0 || s.stdin == nil {
+		return strings.NewReader("")
+	}
+	return s.stdin
+}
+
+func (s *stdio) writer(fd int64) io.Writer {
+	switch fd {
+	case 1:
+		if s.stdout != nil {
+			return s.stdout
+		}
+		return os.Stdout
+	case 2:
+		if s.stderr != nil {
+			return s.stderr
+		}
+		return os.Stderr
+	}
+	return nil
+}
+
+// flush writes out the incomplete line buffered by w, if any.
+func (s *stdio) flush(w io.Writer) {
+	if lw, ok := w.(*lineWriter); ok {
+		lw.Flush()
+	}
+}
+
+// Flush writes out incomplete lines buffered for JS callbacks.
+func (s *stdio) Flush() {
+	s.flush(s.stdout)
+	s.flush(s.stderr)
+}
+
+// setFromJS sets the stream named key from a JS value.
+// Output streams accept a function called with every decoded line,
+// stdin accepts a string, an ArrayBuffer or a typed array.
+// null and undefined restore the default stream.
+func (s *stdio) setFromJS(vm *goja.Runtime, key string, val goja.Value) bool {
+	if val == nil || goja.IsUndefined(val) || goja.IsNull(val) {
+		switch key {
+		case "stdin":
+			s.SetStdin(nil)
+		case "stdout":
+			s.SetStdout(nil)
+		case "stderr":
+			s.SetStderr(nil)
+		default:
+			return false
+		}
+		return true
+	}
+	switch key {
+	case "stdin":
+		switch v := val.Export().(type) {
+		case string:
+			s.SetStdin(strings.NewReader(v))
+		case goja.ArrayBuffer:
+			s.SetStdin(bytes.NewReader(append([]byte(nil), v.Bytes()...)))
+		default:
+			b := typedArrayBytes(vm, val)
+			if b == nil {
+				panic(vm.NewTypeError("stdin must be a string, an ArrayBuffer or a typed array"))
+			}
+			s.SetStdin(bytes.NewReader(append([]byte(nil), b...)))
+		}
+	case "stdout", "stderr":
+		fn, ok := goja.AssertFunction(val)
+		if !ok {
+			panic(vm.NewTypeError(key + " must be a function"))
+		}
+		w := &lineWriter{vm: vm, fn: fn}
+		if key == "stdout" {
+			s.SetStdout(w)
+		} else {
+			s.SetStderr(w)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// lineWriter calls a JS function with every complete line written to it.
+type lineWriter struct {
+	vm  *goja.Runtime
+	fn  goja.Callable
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		if err := w.emit(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush calls the function with the incomplete line written so far, if any.
+func (w *lineWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := string(w.buf)
+	w.buf = nil
+	return w.emit(line)
+}
+
+func (w *lineWriter) emit(line string) error {
+	_, err := w.fn(goja.Undefined(), w.vm.ToValue(line))
+	return err
+}
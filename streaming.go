@@ -0,0 +1,234 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// wasmMagic starts every binary module.
+var wasmMagic = []byte{0, 'a', 's', 'm'}
+
+// DefaultMaxModuleSize is the size of the largest module read from a reader or
+// a response, unless the runtime sets another limit with WithMaxModuleSize.
+const DefaultMaxModuleSize = 1 << 30
+
+// ErrModuleTooLarge is the error of reading a module larger than the maximum size.
+var ErrModuleTooLarge = errors.New("module is larger than the maximum size")
+
+// WithMaxModuleSize sets the size of the largest module NewModuleReader,
+// WebAssembly.compileStreaming and WebAssembly.instantiateStreaming read, in bytes.
+func WithMaxModuleSize(n int64) Option {
+	return func(cfg *runtimeConfig) {
+		cfg.maxModuleSize = n
+	}
+}
+
+// maxModuleSize returns the size of the largest module vm reads.
+func maxModuleSize(vm *goja.Runtime) int64 {
+	if n := configOf(vm).maxModuleSize; n > 0 {
+		return n
+	}
+	return DefaultMaxModuleSize
+}
+
+// CompileReader reads the module of r into memory and compiles it, like CompileReaderSize
+// with DefaultMaxModuleSize.
+func CompileReader(r io.Reader) (*CompiledModule, error) {
+	return CompileReaderSize(r, DefaultMaxModuleSize)
+}
+
+// CompileReaderSize reads the module of r into memory and compiles it. Reading stops with
+// ErrModuleTooLarge once more than maxSize bytes are read.
+// The header is checked as soon as it is read, so that a stream that is not
+// a module fails without being read to the end. Reading and compiling do not
+// overlap: wasmer compiles whole modules, so r is buffered until it is drained
+// and compiled afterwards.
+func CompileReaderSize(r io.Reader, maxSize int64) (*CompiledModule, error) {
+	b, err := readModule(r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(b)
+}
+
+// NewModuleReader reads the module of r into memory and compiles it into a module of vm,
+// through the cache of vm if any. See CompileReaderSize and WithMaxModuleSize.
+func NewModuleReader(vm *goja.Runtime, r io.Reader) (*WasmModule, error) {
+	b, err := readModule(r, maxModuleSize(vm))
+	if err != nil {
+		return nil, err
+	}
+	return NewModule(vm, b)
+}
+
+// readModule reads a module of at most maxSize bytes from r.
+func readModule(r io.Reader, maxSize int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(len(wasmMagic))); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("module is truncated")
+		}
+		return nil, err
+	}
+	if !bytes.Equal(buf.Bytes(), wasmMagic) {
+		return nil, errors.New("not a WebAssembly module")
+	}
+	// one byte past the limit tells a module of maxSize bytes from a larger one
+	if _, err := buf.ReadFrom(io.LimitReader(r, maxSize-int64(buf.Len())+1)); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > maxSize {
+		return nil, ErrModuleTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// enableStreaming defines compileStreaming and instantiateStreaming on wasmObj.
+// Their source is a Response-like object, with an arrayBuffer method and
+// an application/wasm content type, or a promise of one. Despite their names,
+// they read the whole body before compiling it, see CompileReaderSize.
+func enableStreaming(vm *goja.Runtime, wasmObj *goja.Object) {
+	wasmObj.Set("compileStreaming", func(arg goja.FunctionCall, vm *goja.Runtime) goja.Value {
+		promise, resolve, reject := vm.NewPromise()
+		responseBytes(vm, "WebAssembly.compileStreaming", arg.Argument(0), func(b []byte) {
+			module, err := NewModule(vm, b)
+			if err != nil {
+				reject(vm.NewTypeError("WebAssembly.compileStreaming: " + err.Error()))
+				return
+			}
+			resolve(module.Object())
+		}, reject)
+		return vm.ToValue(promise)
+	})
+
+	wasmObj.Set("instantiateStreaming", func(arg goja.FunctionCall, vm *goja.Runtime) goja.Value {
+		promise, resolve, reject := vm.NewPromise()
+		imports := arg.Argument(1)
+		responseBytes(vm, "WebAssembly.instantiateStreaming", arg.Argument(0), func(b []byte) {
+			module, err := NewModule(vm, b)
+			if err != nil {
+				reject(vm.NewTypeError("WebAssembly.instantiateStreaming: " + err.Error()))
+				return
+			}
+			instance, err := NewInstance(vm, module, imports)
+			if err != nil {
+				reject(instantiateError(vm, "WebAssembly.instantiateStreaming", err))
+				return
+			}
+			result := vm.NewObject()
+			result.Set("module", module.Object())
+			result.Set("instance", instance.Object())
+			resolve(result)
+		}, reject)
+		return vm.ToValue(promise)
+	})
+}
+
+// responseBytes waits for source, a Response-like object or a promise of one,
+// and passes the body to then. Failures are passed to reject, including bodies
+// larger than the maximum module size, which a content-length header announces
+// before the body is read.
+func responseBytes(vm *goja.Runtime, method string, source goja.Value, then func([]byte), reject func(interface{})) {
+	await(vm, source, func(v goja.Value) {
+		response, ok := v.(*goja.Object)
+		if !ok {
+			reject(vm.NewTypeError(method + ": argument 1 must be a Response"))
+			return
+		}
+		if ok := response.Get("ok"); ok != nil && !goja.IsUndefined(ok) && !ok.ToBoolean() {
+			reject(vm.NewTypeError(method + ": response is not ok"))
+			return
+		}
+		if contentType := responseContentType(vm, response); contentType != "application/wasm" {
+			reject(vm.NewTypeError(method + ": response has content type " + contentType + ", expected application/wasm"))
+			return
+		}
+		maxSize := maxModuleSize(vm)
+		if n, err := strconv.ParseInt(responseHeader(vm, response, "content-length"), 10, 64); err == nil && n > maxSize {
+			reject(rangeError(vm, method+": "+ErrModuleTooLarge.Error()))
+			return
+		}
+		arrayBuffer, ok := goja.AssertFunction(response.Get("arrayBuffer"))
+		if !ok {
+			reject(vm.NewTypeError(method + ": response must have an arrayBuffer method"))
+			return
+		}
+		body, err := arrayBuffer(response)
+		if err != nil {
+			reject(errorReason(err))
+			return
+		}
+		await(vm, body, func(v goja.Value) {
+			b := bufferSourceBytes(vm, v)
+			if b == nil {
+				reject(vm.NewTypeError(method + ": response body must be an ArrayBuffer"))
+				return
+			}
+			if int64(len(b)) > maxSize {
+				reject(rangeError(vm, method+": "+ErrModuleTooLarge.Error()))
+				return
+			}
+			then(b)
+		}, reject)
+	}, reject)
+}
+
+// responseContentType returns the media type of the content-type header of response.
+func responseContentType(vm *goja.Runtime, response *goja.Object) string {
+	mediaType := strings.SplitN(responseHeader(vm, response, "content-type"), ";", 2)[0]
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// responseHeader returns the header name of response, read from a Headers-like object
+// or a plain object, or "" if it has none.
+func responseHeader(vm *goja.Runtime, response *goja.Object, name string) string {
+	headers, ok := response.Get("headers").(*goja.Object)
+	if !ok {
+		return ""
+	}
+	var v goja.Value
+	if get, ok := goja.AssertFunction(headers.Get("get")); ok {
+		v, _ = get(headers, vm.ToValue(name))
+	} else {
+		for _, key := range headers.Keys() {
+			if strings.EqualFold(key, name) {
+				v = headers.Get(key)
+			}
+		}
+	}
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return ""
+	}
+	return strings.TrimSpace(v.String())
+}
+
+// await calls then with the value of v once it is resolved, or reject with the reason it is rejected.
+func await(vm *goja.Runtime, v goja.Value, then func(goja.Value), reject func(interface{})) {
+	resolve, _ := goja.AssertFunction(vm.Get("Promise").ToObject(vm).Get("resolve"))
+	p, err := resolve(vm.Get("Promise"), v)
+	if err != nil {
+		reject(errorReason(err))
+		return
+	}
+	promiseThen, _ := goja.AssertFunction(p.ToObject(vm).Get("then"))
+	promiseThen(p, vm.ToValue(func(call goja.FunctionCall) goja.Value {
+		then(call.Argument(0))
+		return goja.Undefined()
+	}), vm.ToValue(func(call goja.FunctionCall) goja.Value {
+		reject(call.Argument(0))
+		return goja.Undefined()
+	}))
+}
+
+// errorReason returns the value to reject a promise with for err.
+func errorReason(err error) interface{} {
+	if ex, ok := err.(*goja.Exception); ok {
+		return ex.Value()
+	}
+	return err
+}
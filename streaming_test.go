@@ -0,0 +1,72 @@
+package wasm
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestCompileReaderSize(t *testing.T) {
+	b := wat(t, `(module (func (export "f")))`)
+	size := int64(len(b))
+	for _, c := range []struct {
+		r       io.Reader
+		maxSize int64
+		err     string
+	}{
+		{bytes.NewReader(b), size, ""},
+		{bytes.NewReader(b), size - 1, ErrModuleTooLarge.Error()},
+		{bytes.NewReader(b), 2, ErrModuleTooLarge.Error()},
+		{strings.NewReader("\x00as"), size, "module is truncated"},
+		{strings.NewReader("(module)"), size, "not a WebAssembly module"},
+		// the header is checked before the rest is read
+		{io.MultiReader(strings.NewReader("nope"), errReader{}), size, "not a WebAssembly module"},
+	} {
+		_, err := CompileReaderSize(c.r, c.maxSize)
+		if got := ""; err != nil {
+			got = err.Error()
+			if got != c.err {
+				t.Errorf("maxSize %d: got %q, want %q", c.maxSize, got, c.err)
+			}
+		} else if c.err != "" {
+			t.Errorf("maxSize %d: got no error, want %q", c.maxSize, c.err)
+		}
+	}
+}
+
+// errReader fails every read.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestStreamingMaxSize(t *testing.T) {
+	b := wat(t, `(module (func (export "f")))`)
+	vm := goja.New()
+	Enable(vm, WithMaxModuleSize(int64(len(b))))
+	vm.Set("small", vm.NewArrayBuffer(b))
+	vm.Set("large", vm.NewArrayBuffer(append(b, 0)))
+	v, err := vm.RunString(`
+	  const results = [];
+	  const response = (body, headers) => ({
+	    headers: Object.assign({"content-type": "application/wasm"}, headers),
+	    arrayBuffer() { results.push("read"); return body },
+	  });
+	  const report = (p) => p.then(() => results.push("compiled"), (e) => results.push(e.name));
+	  report(WebAssembly.compileStreaming(response(small)))
+	    .then(() => report(WebAssembly.compileStreaming(response(large))))
+	    .then(() => report(WebAssembly.compileStreaming(response(small, {"Content-Length": String(small.byteLength + 1)}))));
+	  results;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the announced length is rejected without reading the body
+	if got, want := v.String(), "read,compiled,read,RangeError,RangeError"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
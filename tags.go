@@ -0,0 +1,285 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dop251/goja"
+)
+
+// Tags and exceptions implement the JS API of the exception-handling proposal.
+// wasmer 1.0.4 cannot compile modules using the proposal, which Compile rejects,
+// so tags only describe the exceptions scripts and host functions throw: they unwind
+// through wasm frames, which cannot catch them, and reach the caller of the guest.
+
+// errExceptions is the error of compiling a module that uses exception handling.
+var errExceptions = errors.New("exception handling is not supported by this runtime")
+
+// tagTypes are the value types of tag parameters.
+var tagTypes = []string{"i32", "i64", "f32", "f64", "externref", "anyfunc"}
+
+// checkSections returns an error if the binary module b has sections, imports or
+// exports wasmer cannot compile. Unknown sections and tag imports would make wasmer
+// abort the process rather than fail.
+func checkSections(b []byte) error {
+	if len(b) < 8 || !bytes.Equal(b[:4], wasmMagic) {
+		return nil
+	}
+	r := &wasmReader{b: b, off: 8}
+	for !r.done() && r.err == nil {
+		id := r.byte()
+		s := &wasmReader{b: r.bytes(int(r.u32()))}
+		var err error
+		switch {
+		case id == tagSection:
+			return errExceptions
+		case id > tagSection:
+			return fmt.Errorf("unknown section id %d", id)
+		case id == importSection:
+			err = checkImports(s)
+		case id == exportSection:
+			err = checkExports(s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkImports returns an error if the import section s imports a tag or an unknown kind.
+func checkImports(s *wasmReader) error {
+	for n := s.u32(); n > 0 && s.err == nil; n-- {
+		s.bytes(int(s.u32()))
+		s.bytes(int(s.u32()))
+		switch kind := s.byte(); kind {
+		case 0:
+			s.u32()
+		case 1:
+			s.byte()
+			s.limits()
+		case 2:
+			s.limits()
+		case 3:
+			s.byte()
+			s.byte()
+		case 4:
+			return errExceptions
+		default:
+			if s.err == nil {
+				return fmt.Errorf("unknown import kind %d", kind)
+			}
+		}
+	}
+	return nil
+}
+
+// checkExports returns an error if the export section s exports a tag or an unknown kind.
+func checkExports(s *wasmReader) error {
+	for n := s.u32(); n > 0 && s.err == nil; n-- {
+		s.bytes(int(s.u32()))
+		switch kind := s.byte(); {
+		case kind == 4:
+			return errExceptions
+		case kind > 4 && s.err == nil:
+			return fmt.Errorf("unknown export kind %d", kind)
+		}
+		s.u32()
+	}
+	return nil
+}
+
+// enableTags defines the Tag and Exception constructors on wasmObj.
+func enableTags(vm *goja.Runtime, wasmObj *goja.Object) {
+	wasmObj.Set("Tag", func(c goja.ConstructorCall, vm *goja.Runtime) *goja.Object {
+		desc, ok := c.Argument(0).(*goja.Object)
+		if !ok {
+			panic(vm.NewTypeError("WebAssembly.Tag: argument 1 must be a tag type"))
+		}
+		params, ok := desc.Get("parameters").(*goja.Object)
+		if !ok {
+			panic(vm.NewTypeError("WebAssembly.Tag: parameters must be an array of value types"))
+		}
+		var types []string
+		if err := vm.ExportTo(params, &types); err != nil {
+			panic(vm.NewTypeError("WebAssembly.Tag: parameters must be an array of value types"))
+		}
+		for _, typ := range types {
+			if !isTagType(typ) {
+				panic(vm.NewTypeError("WebAssembly.Tag: invalid value type " + strconv.Quote(typ)))
+			}
+		}
+		obj := vm.NewDynamicObject(&WasmTag{vm: vm, params: types})
+		obj.SetPrototype(c.This.Prototype())
+		return obj
+	})
+
+	wasmObj.Set("Exception", func(c goja.ConstructorCall, vm *goja.Runtime) *goja.Object {
+		tag, ok := c.Argument(0).Export().(*WasmTag)
+		if !ok {
+			panic(vm.NewTypeError("WebAssembly.Exception: argument 1 must be a WebAssembly.Tag"))
+		}
+		payload, ok := c.Argument(1).(*goja.Object)
+		if !ok {
+			panic(vm.NewTypeError("WebAssembly.Exception: argument 2 must be an array"))
+		}
+		var values []goja.Value
+		if err := vm.ExportTo(payload, &values); err != nil || len(values) != len(tag.params) {
+			panic(vm.NewTypeError("WebAssembly.Exception: payload must have " + strconv.Itoa(len(tag.params)) + " values"))
+		}
+		e := &WasmException{vm: vm, tag: tag, args: make([]goja.Value, len(values))}
+		for i, v := range values {
+			e.args[i] = tagValue(vm, v, tag.params[i])
+		}
+		if opts, ok := c.Argument(2).(*goja.Object); ok && opts.Get("traceStack") != nil && opts.Get("traceStack").ToBoolean() {
+			var b bytes.Buffer
+			for _, frame := range vm.CaptureCallStack(0, nil) {
+				b.WriteString("\tat ")
+				frame.Write(&b)
+				b.WriteByte('\n')
+			}
+			e.stack = b.String()
+		}
+		obj := vm.NewDynamicObject(e)
+		obj.SetPrototype(c.This.Prototype())
+		return obj
+	})
+}
+
+func isTagType(typ string) bool {
+	for _, t := range tagTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValue converts v to a value of the parameter type typ.
+func tagValue(vm *goja.Runtime, v goja.Value, typ string) goja.Value {
+	switch typ {
+	case "i32":
+		return vm.ToValue(int32(v.ToInteger()))
+	case "i64":
+		return vm.ToValue(v.ToInteger())
+	case "f32":
+		return vm.ToValue(float32(v.ToFloat()))
+	case "f64":
+		return vm.ToValue(v.ToFloat())
+	}
+	return v
+}
+
+// WasmTag is a WebAssembly.Tag, the type of exceptions.
+type WasmTag struct {
+	vm     *goja.Runtime
+	params []string
+}
+
+func (t *WasmTag) Get(key string) goja.Value {
+	switch key {
+	case "type":
+		return t.vm.ToValue(func(goja.FunctionCall) goja.Value {
+			params := make([]interface{}, len(t.params))
+			for i, p := range t.params {
+				params[i] = p
+			}
+			desc := t.vm.NewObject()
+			desc.Set("parameters", t.vm.NewArray(params...))
+			return desc
+		})
+	case "toString":
+		return t.vm.ToValue(func(goja.FunctionCall) goja.Value {
+			return t.vm.ToValue("WebAssembly.Tag")
+		})
+	}
+	return goja.Undefined()
+}
+
+func (t *WasmTag) Set(key string, val goja.Value) bool {
+	return false
+}
+
+func (t *WasmTag) Delete(key string) bool {
+	return false
+}
+
+func (t *WasmTag) Has(key string) bool {
+	return false
+}
+
+func (t *WasmTag) Keys() []string {
+	return []string{}
+}
+
+// WasmException is a WebAssembly.Exception, thrown with the arguments of its tag.
+type WasmException struct {
+	vm    *goja.Runtime
+	tag   *WasmTag
+	args  []goja.Value
+	stack string
+}
+
+// Tag returns the tag of e.
+func (e *WasmException) Tag() *WasmTag {
+	return e.tag
+}
+
+// Args returns the arguments of e.
+func (e *WasmException) Args() []goja.Value {
+	return e.args
+}
+
+func (e *WasmException) Get(key string) goja.Value {
+	switch key {
+	case "getArg":
+		return e.vm.ToValue(func(call goja.FunctionCall) goja.Value {
+			if tag, ok := call.Argument(0).Export().(*WasmTag); !ok || tag != e.tag {
+				panic(e.vm.NewTypeError("WebAssembly.Exception.getArg(): argument 1 must be the tag of the exception"))
+			}
+			i := call.Argument(1).ToInteger()
+			if i < 0 || i >= int64(len(e.args)) {
+				panic(rangeError(e.vm, "WebAssembly.Exception.getArg(): index "+strconv.FormatInt(i, 10)+" out of range"))
+			}
+			return e.args[i]
+		})
+	case "is":
+		return e.vm.ToValue(func(call goja.FunctionCall) goja.Value {
+			tag, ok := call.Argument(0).Export().(*WasmTag)
+			if !ok {
+				panic(e.vm.NewTypeError("WebAssembly.Exception.is(): argument 1 must be a WebAssembly.Tag"))
+			}
+			return e.vm.ToValue(tag == e.tag)
+		})
+	case "stack":
+		if e.stack != "" {
+			return e.vm.ToValue(e.stack)
+		}
+	case "toString":
+		return e.vm.ToValue(func(goja.FunctionCall) goja.Value {
+			return e.vm.ToValue("WebAssembly.Exception")
+		})
+	}
+	return goja.Undefined()
+}
+
+func (e *WasmException) Set(key string, val goja.Value) bool {
+	return false
+}
+
+func (e *WasmException) Delete(key string) bool {
+	return false
+}
+
+func (e *WasmException) Has(key string) bool {
+	return key == "stack" && e.stack != ""
+}
+
+func (e *WasmException) Keys() []string {
+	if e.stack != "" {
+		return []string{"stack"}
+	}
+	return []string{}
+}
@@ -0,0 +1,117 @@
+package wasm
+
+import (
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestCheckSections(t *testing.T) {
+	header := []byte{0, 'a', 's', 'm', 1, 0, 0, 0}
+	for name, c := range map[string]struct {
+		sections []byte
+		err      string
+	}{
+		// a type section for func () and an import of env.t as a tag of that type
+		"tag import":          {[]byte{1, 4, 1, 0x60, 0, 0, 2, 10, 1, 3, 'e', 'n', 'v', 1, 't', 4, 0, 0}, errExceptions.Error()},
+		"tag export":          {[]byte{7, 5, 1, 1, 't', 4, 0}, errExceptions.Error()},
+		"tag section":         {[]byte{1, 4, 1, 0x60, 0, 0, 13, 3, 1, 0, 0}, errExceptions.Error()},
+		"unknown section":     {[]byte{14, 0}, "unknown section id 14"},
+		"unknown import kind": {[]byte{2, 8, 1, 1, 'm', 1, 'f', 5, 0, 0}, "unknown import kind 5"},
+		"unknown export kind": {[]byte{7, 5, 1, 1, 'f', 5, 0}, "unknown export kind 5"},
+		"imports and exports": {wat(t, `(module
+		  (import "env" "f" (func))
+		  (import "env" "t" (table 1 funcref))
+		  (import "env" "m" (memory 1 2))
+		  (import "env" "g" (global (mut i32)))
+		  (func (export "h"))
+		  (export "f" (func 0))
+		  (export "t" (table 0))
+		  (export "m" (memory 0))
+		  (export "g" (global 0)))`)[8:], ""},
+	} {
+		err := checkSections(append(header, c.sections...))
+		if got := ""; err != nil {
+			got = err.Error()
+			if got != c.err {
+				t.Errorf("%s: got %q, want %q", name, got, c.err)
+			}
+		} else if c.err != "" {
+			t.Errorf("%s: got no error, want %q", name, c.err)
+		}
+	}
+
+	// wasmer aborts the process on tag imports, which scripts must not reach
+	vm := goja.New()
+	Enable(vm)
+	v, err := vm.RunString(`
+	  const header = [0, 97, 115, 109, 1, 0, 0, 0];
+	  const messages = [];
+	  for (const sections of [
+	    [1, 4, 1, 0x60, 0, 0, 2, 10, 1, 3, 101, 110, 118, 1, 116, 4, 0, 0],
+	    [7, 5, 1, 1, 116, 4, 0],
+	    [1, 4, 1, 0x60, 0, 0, 13, 3, 1, 0, 0],
+	  ]) {
+	    try {
+	      new WebAssembly.Module(new Uint8Array(header.concat(sections)));
+	      messages.push("compiled");
+	    } catch (e) {
+	      messages.push(e instanceof TypeError ? e.message : String(e));
+	    }
+	  }
+	  messages;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "WebAssembly.Module: " + errExceptions.Error()
+	for i, message := range v.Export().([]interface{}) {
+		if message != want {
+			t.Errorf("module %d: got %q, want %q", i, message, want)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	v, err := vm.RunString(`
+	  const failed = [];
+	  const check = (name, ok) => { if (!ok) failed.push(name) };
+	  const throws = (name, type, f) => {
+	    try { f(); failed.push(name) } catch (e) { check(name, e instanceof type) }
+	  };
+
+	  const tag = new WebAssembly.Tag({parameters: ["i32", "f32", "externref"]});
+	  const other = new WebAssembly.Tag({parameters: []});
+	  check("tag prototype", tag instanceof WebAssembly.Tag);
+	  check("type", tag.type().parameters.join() === "i32,f32,externref");
+	  throws("no descriptor", TypeError, () => new WebAssembly.Tag());
+	  throws("no parameters", TypeError, () => new WebAssembly.Tag({}));
+	  throws("invalid type", TypeError, () => new WebAssembly.Tag({parameters: ["v128"]}));
+
+	  const payload = {};
+	  const e = new WebAssembly.Exception(tag, [2.7, 0.1, payload]);
+	  check("exception prototype", e instanceof WebAssembly.Exception);
+	  check("i32 argument", e.getArg(tag, 0) === 2);
+	  check("f32 argument", e.getArg(tag, 1) === Math.fround(0.1));
+	  check("externref argument", e.getArg(tag, 2) === payload);
+	  check("is", e.is(tag) && !e.is(other));
+	  check("no stack", !("stack" in e));
+	  throws("getArg of another tag", TypeError, () => e.getArg(other, 0));
+	  throws("getArg out of range", RangeError, () => e.getArg(tag, 3));
+	  throws("is without a tag", TypeError, () => e.is({}));
+	  throws("no tag", TypeError, () => new WebAssembly.Exception({}, []));
+	  throws("payload length", TypeError, () => new WebAssembly.Exception(tag, [1]));
+	  check("traceStack", typeof new WebAssembly.Exception(other, [], {traceStack: true}).stack === "string");
+
+	  try { throw e } catch (caught) { check("thrown", caught === e) }
+	  failed.join(",");
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := v.String(); failed != "" {
+		t.Errorf("failed checks: %s", failed)
+	}
+}
@@ -0,0 +1,460 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// isTinyGo reports whether module was compiled by TinyGo.
+// The imports of TinyGo programs take their arguments as parameters,
+// while the standard Go toolchain passes a single stack pointer.
+func isTinyGo(module *wasmer.Module) bool {
+	for _, imp := range module.Imports() {
+		switch imp.Module() {
+		case "gojs", "env":
+		default:
+			continue
+		}
+		if !strings.HasPrefix(imp.Name(), "syscall/js.") && !strings.HasPrefix(imp.Name(), "runtime.") {
+			continue
+		}
+		typ := imp.Type().IntoFunctionType()
+		if typ == nil {
+			continue
+		}
+		params := typ.Params()
+		if len(params) != 1 || params[0].Kind() != wasmer.I32 || len(typ.Results()) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// tinyGoRef is a reference to a JS value returned to a TinyGo program.
+type tinyGoRef uint64
+
+// tinyGoFunc is the implementation of a TinyGo import. Arguments are widened
+// to int64, floats and references are passed as their bits.
+// The result is converted to the result type declared by the module.
+type tinyGoFunc func(args []int64) interface{}
+
+// tinyGoImports returns the imports of module implemented for TinyGo programs,
+// using the function types declared by the module.
+func tinyGoImports(store *wasmer.Store, module *wasmer.Module, data *GoInstance) *wasmer.ImportObject {
+	data.reset()
+	goFuncs := tinyGoRuntime(data)
+	wasiFuncs := tinyGoWasi(data)
+
+	namespaces := map[string]map[string]wasmer.IntoExtern{}
+	for _, imp := range module.Imports() {
+		if imp.Name() == "proc_exit" && (imp.Module() == "wasi_snapshot_preview1" || imp.Module() == "wasi_unstable") {
+			trap, err := newExitTrap()
+			if err != nil {
+				panic(data.vm.NewGoError(err))
+			}
+			data.exitTrap = trap
+			if namespaces[imp.Module()] == nil {
+				namespaces[imp.Module()] = map[string]wasmer.IntoExtern{}
+			}
+			namespaces[imp.Module()][imp.Name()] = trap.fn
+			continue
+		}
+		var fn tinyGoFunc
+		switch imp.Module() {
+		case "gojs", "env":
+			fn = goFuncs[imp.Name()]
+		case "wasi_snapshot_preview1", "wasi_unstable":
+			fn = wasiFuncs[imp.Name()]
+		}
+		typ := imp.Type().IntoFunctionType()
+		if fn == nil || typ == nil {
+			continue
+		}
+		if namespaces[imp.Module()] == nil {
+			namespaces[imp.Module()] = map[string]wasmer.IntoExtern{}
+		}
+		namespaces[imp.Module()][imp.Name()] = newTinyGoFunction(store, typ, fn)
+	}
+
+	importObject := wasmer.NewImportObject()
+	for name, namespace := range namespaces {
+		importObject.Register(name, data.link(store, namespace))
+	}
+	return importObject
+}
+
+func newTinyGoFunction(store *wasmer.Store, typ *wasmer.FunctionType, fn tinyGoFunc) *hostFunction {
+	params := make([]wasmer.ValueKind, len(typ.Params()))
+	for i, p := range typ.Params() {
+		params[i] = p.Kind()
+	}
+	results := make([]wasmer.ValueKind, len(typ.Results()))
+	for i, r := range typ.Results() {
+		results[i] = r.Kind()
+	}
+	ty := wasmer.NewFunctionType(wasmer.NewValueTypes(params...), wasmer.NewValueTypes(results...))
+
+	return newHostFunction(store, ty, func(args []wasmer.Value) (res []wasmer.Value, err error) {
+		// panics must not unwind through the wasm frames, they are turned into traps
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(error); ok {
+					err = e
+				} else {
+					err = fmt.Errorf("%v", r)
+				}
+			}
+		}()
+
+		ints := make([]int64, len(args))
+		for i, arg := range args {
+			switch arg.Kind() {
+			case wasmer.I32:
+				ints[i] = int64(arg.I32())
+			case wasmer.I64:
+				ints[i] = arg.I64()
+			case wasmer.F32:
+				ints[i] = int64(math.Float64bits(float64(arg.F32())))
+			case wasmer.F64:
+				ints[i] = int64(math.Float64bits(arg.F64()))
+			}
+		}
+		result := fn(ints)
+		if len(results) == 0 {
+			return []wasmer.Value{}, nil
+		}
+		switch results[0] {
+		case wasmer.I32:
+			return []wasmer.Value{wasmer.NewI32(int32(tinyGoInt(result)))}, nil
+		case wasmer.I64:
+			return []wasmer.Value{wasmer.NewI64(tinyGoInt(result))}, nil
+		case wasmer.F32:
+			return []wasmer.Value{wasmer.NewF32(float32(tinyGoFloat(result)))}, nil
+		default:
+			return []wasmer.Value{wasmer.NewF64(tinyGoFloat(result))}, nil
+		}
+	})
+}
+
+func tinyGoInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case tinyGoRef:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case bool:
+		if v {
+			return 1
+		}
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+func tinyGoFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case tinyGoRef:
+		return math.Float64frombits(uint64(v))
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return 0
+}
+
+func (d *GoInstance) tinyGoString(ptr, l int64) string {
+	return string(d.readBytes(ptr, l))
+}
+
+func (d *GoInstance) tinyGoValue(ref int64) goja.Value {
+	return d.unboxValue(uint64(ref))
+}
+
+func (d *GoInstance) tinyGoValues(ptr, l int64) []goja.Value {
+	values := make([]goja.Value, l)
+	for i := range values {
+		values[i] = d.loadValue(int32(ptr + int64(i)*8))
+	}
+	return values
+}
+
+// tinyGoCall stores the outcome of a call into JS at addr, followed by a success flag.
+func (d *GoInstance) tinyGoCall(addr int64, fn func() (goja.Value, error)) {
+	result, err := tinyGoTry(fn)
+	if err != nil {
+		d.storeValue(int32(addr), d.errorValue(err))
+		d.setUint8(int32(addr+8), 0)
+		return
+	}
+	d.storeValue(int32(addr), result)
+	d.setUint8(int32(addr+8), 1)
+}
+
+// tinyGoTry calls fn, returning the JS errors raised by the call itself, such as calling
+// a method of undefined, as errors like those thrown by the function called.
+func tinyGoTry(fn func() (goja.Value, error)) (result goja.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case *goja.Exception:
+				err = r
+			case goja.Value:
+				err = &thrownValue{value: r}
+			default:
+				panic(r)
+			}
+		}
+	}()
+	return fn()
+}
+
+// tinyGoWake runs the scheduler of a TinyGo program once the sleep it requested with
+// sleepTicks has elapsed. Like wasm_exec.js, it schedules the scheduler with setTimeout,
+// so that the runtime runs scripts meanwhile. Deterministic programs advance their
+// virtual clock and run the scheduler right away instead, until no goroutine sleeps
+// or the program exits. It returns ErrInterrupted if stopped reports true first.
+func (d *GoInstance) tinyGoWake(stopped func() bool) error {
+	for d.sleep != nil && !d.exited {
+		if stopped() {
+			return ErrInterrupted
+		}
+		timeout := *d.sleep
+		d.sleep = nil
+		scheduler, err := d.inst.Exports.GetFunction("go_scheduler")
+		if err != nil {
+			return nil
+		}
+		if !d.deterministic {
+			return d.tinyGoTimeout(scheduler, timeout)
+		}
+		d.system.Sleep(timeout)
+		if _, err := scheduler(); err != nil {
+			return err
+		}
+		d.checkExit()
+	}
+	return nil
+}
+
+// errNoSetTimeout is the error of a TinyGo program sleeping in a runtime without setTimeout.
+var errNoSetTimeout = errors.New("setTimeout is not defined: TinyGo programs that sleep need an event loop, or the deterministic option")
+
+// tinyGoTimeout runs scheduler, the scheduler of the program, with the setTimeout function
+// of the runtime once timeout has elapsed, unless the program has exited or been replaced by then.
+func (d *GoInstance) tinyGoTimeout(scheduler wasmer.NativeFunction, timeout time.Duration) error {
+	setTimeout, ok := goja.AssertFunction(d.vm.Get("setTimeout"))
+	if !ok {
+		return errNoSetTimeout
+	}
+	inst := d.inst
+	callback := d.vm.ToValue(func(goja.FunctionCall) goja.Value {
+		if !d.exited && d.inst == inst {
+			d.runGuest("go_scheduler", scheduler)
+		}
+		return goja.Undefined()
+	})
+	_, err := setTimeout(goja.Undefined(), callback, d.vm.ToValue(float64(timeout)/float64(time.Millisecond)))
+	return err
+}
+
+func tinyGoRuntime(data *GoInstance) map[string]tinyGoFunc {
+	return map[string]tinyGoFunc{
+		// func ticks() float64
+		"runtime.ticks": func(args []int64) interface{} {
+			return float64(data.system.Nanotime()) / float64(time.Millisecond)
+		},
+		// func sleepTicks(timeout float64)
+		"runtime.sleepTicks": func(args []int64) interface{} {
+			// the program returns to the host, which runs its scheduler after the timeout, see tinyGoWake
+			timeout := time.Duration(tinyGoFloat(tinyGoRef(args[0])) * float64(time.Millisecond))
+			data.sleep = &timeout
+			return nil
+		},
+		// func finalizeRef(v ref)
+		"syscall/js.finalizeRef": func(args []int64) interface{} {
+			data.finalizeRef(uint32(args[0]))
+			return nil
+		},
+		// func stringVal(value string) ref
+		"syscall/js.stringVal": func(args []int64) interface{} {
+			return tinyGoRef(data.boxValue(data.vm.ToValue(data.tinyGoString(args[0], args[1]))))
+		},
+		// func valueGet(v ref, p string) ref
+		"syscall/js.valueGet": func(args []int64) interface{} {
+			o := data.tinyGoValue(args[0]).ToObject(data.vm)
+			return tinyGoRef(data.boxValue(data.get(o, data.tinyGoString(args[1], args[2]))))
+		},
+		// func valueSet(v ref, p string, x ref)
+		"syscall/js.valueSet": func(args []int64) interface{} {
+			o := data.tinyGoValue(args[0]).ToObject(data.vm)
+			o.Set(data.tinyGoString(args[1], args[2]), data.tinyGoValue(args[3]))
+			return nil
+		},
+		// func valueDelete(v ref, p string)
+		"syscall/js.valueDelete": func(args []int64) interface{} {
+			o := data.tinyGoValue(args[0]).ToObject(data.vm)
+			o.Delete(data.tinyGoString(args[1], args[2]))
+			return nil
+		},
+		// func valueIndex(v ref, i int) ref
+		"syscall/js.valueIndex": func(args []int64) interface{} {
+			o := data.tinyGoValue(args[0]).ToObject(data.vm)
+			return tinyGoRef(data.boxValue(o.Get(strconv.FormatInt(args[1], 10))))
+		},
+		// valueSetIndex(v ref, i int, x ref)
+		"syscall/js.valueSetIndex": func(args []int64) interface{} {
+			o := data.tinyGoValue(args[0]).ToObject(data.vm)
+			o.Set(strconv.FormatInt(args[1], 10), data.tinyGoValue(args[2]))
+			return nil
+		},
+		// func valueCall(v ref, m string, args []ref) (ref, bool)
+		"syscall/js.valueCall": func(args []int64) interface{} {
+			data.tinyGoCall(args[0], func() (goja.Value, error) {
+				v := data.tinyGoValue(args[1])
+				name := data.tinyGoString(args[2], args[3])
+				m, ok := goja.AssertFunction(v.ToObject(data.vm).Get(name))
+				if !ok {
+					return nil, &thrownValue{value: data.vm.NewTypeError(name + " is not a function")}
+				}
+				return m(v, data.tinyGoValues(args[4], args[5])...)
+			})
+			return nil
+		},
+		// func valueInvoke(v ref, args []ref) (ref, bool)
+		"syscall/js.valueInvoke": func(args []int64) interface{} {
+			data.tinyGoCall(args[0], func() (goja.Value, error) {
+				fn, ok := goja.AssertFunction(data.tinyGoValue(args[1]))
+				if !ok {
+					return nil, &thrownValue{value: data.vm.NewTypeError("value is not a function")}
+				}
+				return fn(goja.Undefined(), data.tinyGoValues(args[2], args[3])...)
+			})
+			return nil
+		},
+		// func valueNew(v ref, args []ref) (ref, bool)
+		"syscall/js.valueNew": func(args []int64) interface{} {
+			data.tinyGoCall(args[0], func() (goja.Value, error) {
+				result, err := data.vm.New(data.tinyGoValue(args[1]), data.tinyGoValues(args[2], args[3])...)
+				return result, err
+			})
+			return nil
+		},
+		// func valueLength(v ref) int
+		"syscall/js.valueLength": func(args []int64) interface{} {
+			return data.tinyGoValue(args[0]).ToObject(data.vm).Get("length").ToInteger()
+		},
+		// valuePrepareString(v ref) (ref, int)
+		"syscall/js.valuePrepareString": func(args []int64) interface{} {
+			str := data.tinyGoValue(args[1]).String()
+			o, err := data.vm.New(data.vm.Get("Uint8Array"), data.vm.ToValue(data.vm.NewArrayBuffer([]byte(str))))
+			if err != nil {
+				panic(err)
+			}
+			data.storeValue(int32(args[0]), o)
+			data.setInt32(int32(args[0]+8), int64(len(str)))
+			return nil
+		},
+		// valueLoadString(v ref, b []byte)
+		"syscall/js.valueLoadString": func(args []int64) interface{} {
+			copy(data.writeBytes(args[1], args[2]), typedArrayBytes(data.vm, data.tinyGoValue(args[0])))
+			return nil
+		},
+		// func valueInstanceOf(v ref, t ref) bool
+		"syscall/js.valueInstanceOf": func(args []int64) interface{} {
+			re, _ := data.vm.RunProgram(preCompiledInstanceOf)
+			c, _ := goja.AssertFunction(re)
+			isInstanceof, err := c(goja.Null(), data.tinyGoValue(args[0]), data.tinyGoValue(args[1]))
+			return err == nil && isInstanceof.ToBoolean()
+		},
+		// func copyBytesToGo(dst []byte, src ref) (int, bool)
+		"syscall/js.copyBytesToGo": func(args []int64) interface{} {
+			src := typedArrayBytes(data.vm, data.tinyGoValue(args[4]))
+			if src == nil {
+				data.setUint8(int32(args[0]+4), 0)
+				return nil
+			}
+			n := copy(data.writeBytes(args[1], args[2]), src)
+			data.setInt32(int32(args[0]), int64(n))
+			data.setUint8(int32(args[0]+4), 1)
+			return nil
+		},
+		// func copyBytesToJS(dst ref, src []byte) (int, bool)
+		"syscall/js.copyBytesToJS": func(args []int64) interface{} {
+			dst := typedArrayBytes(data.vm, data.tinyGoValue(args[1]))
+			if dst == nil {
+				data.setUint8(int32(args[0]+4), 0)
+				return nil
+			}
+			n := copy(dst, data.readBytes(args[2], args[3]))
+			data.setInt32(int32(args[0]), int64(n))
+			data.setUint8(int32(args[0]+4), 1)
+			return nil
+		},
+	}
+}
+
+// tinyGoWasi returns the WASI functions imported by TinyGo programs targeting JS.
+func tinyGoWasi(data *GoInstance) map[string]tinyGoFunc {
+	return map[string]tinyGoFunc{
+		"fd_write": func(args []int64) interface{} {
+			fd, iovs, iovsLen, nwritten := args[0], args[1], args[2], args[3]
+			w := data.streams().writer(fd)
+			if w == nil {
+				return int64(wasiErrnoBadf)
+			}
+			written := int64(0)
+			for i := int64(0); i < iovsLen; i++ {
+				ptr := uint32(data.getInt32(int32(iovs + i*8)))
+				l := uint32(data.getInt32(int32(iovs + i*8 + 4)))
+				n, _ := w.Write(data.readBytes(int64(ptr), int64(l)))
+				written += int64(n)
+			}
+			data.setInt32(int32(nwritten), written)
+			return int64(wasiErrnoSuccess)
+		},
+		"fd_close": func(args []int64) interface{} {
+			return int64(wasiErrnoSuccess)
+		},
+		// the standard streams are the only files of TinyGo programs targeting JS
+		"fd_fdstat_get": func(args []int64) interface{} {
+			if uint32(args[0]) > 2 {
+				return int64(wasiErrnoBadf)
+			}
+			buf := data.writeBytes(args[1], 24)
+			for i := range buf {
+				buf[i] = 0
+			}
+			buf[0] = wasiFiletypeCharacterDevice
+			binary.LittleEndian.PutUint64(buf[8:], ^uint64(0))
+			binary.LittleEndian.PutUint64(buf[16:], ^uint64(0))
+			return int64(wasiErrnoSuccess)
+		},
+		"fd_seek": func(args []int64) interface{} {
+			if uint32(args[0]) > 2 {
+				return int64(wasiErrnoBadf)
+			}
+			return int64(wasiErrnoSpipe)
+		},
+		"random_get": func(args []int64) interface{} {
+			if _, err := io.ReadFull(data.system.Random, data.writeBytes(args[0], args[1])); err != nil {
+				return int64(wasiErrnoIO)
+			}
+			return int64(wasiErrnoSuccess)
+		},
+	}
+}
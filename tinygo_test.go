@@ -0,0 +1,213 @@
+package wasm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+// tinyGoGlobal is the reference of the global object in TinyGo programs.
+const tinyGoGlobal = "0x7FF8000100000005"
+
+func newTinyGoRuntime(t *testing.T, src string) *goja.Runtime {
+	t.Helper()
+	vm := goja.New()
+	Enable(vm)
+	m := vm.NewObject()
+	m.Set("exports", vm.NewObject())
+	RequireModuleLoader(vm, m)
+	vm.Set("Go", m.Get("exports").(*goja.Object).Get("Go"))
+	vm.Set("bytes", vm.NewArrayBuffer(wat(t, src)))
+	return vm
+}
+
+func TestTinyGoSleep(t *testing.T) {
+	vm := newTinyGoRuntime(t, `(module
+	  (import "gojs" "runtime.sleepTicks" (func $sleep (param f64)))
+	  (import "gojs" "runtime.ticks" (func $ticks (result f64)))
+	  (memory (export "memory") 1)
+	  (global $wakes (export "wakes") (mut i32) (i32.const 0))
+	  (global $start (mut f64) (f64.const 0))
+	  (global $elapsed (export "elapsed") (mut f64) (f64.const 0))
+	  (func (export "_start")
+	    (global.set $start (call $ticks))
+	    (call $sleep (f64.const 50)))
+	  (func (export "go_scheduler")
+	    (global.set $wakes (i32.add (global.get $wakes) (i32.const 1)))
+	    (global.set $elapsed (f64.sub (call $ticks) (global.get $start)))
+	    (if (i32.lt_u (global.get $wakes) (i32.const 3))
+	      (then (call $sleep (f64.const 50))))))`)
+	v, err := vm.RunString(`
+	  const go = new Go({deterministic: true});
+	  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject);
+	  go.run(instance);
+	  [instance.exports.wakes.value, instance.exports.elapsed.value].join(",");
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the scheduler runs after each sleep, on the virtual clock
+	if got := v.String(); got != "3,150" {
+		t.Errorf("wakes and elapsed milliseconds are %s, want 3,150", got)
+	}
+}
+
+func TestTinyGoCallErrors(t *testing.T) {
+	vm := newTinyGoRuntime(t, `(module
+	  (import "gojs" "syscall/js.valueGet" (func $valueGet (param i64 i32 i32) (result i64)))
+	  (import "gojs" "syscall/js.valueCall" (func $valueCall (param i32 i64 i32 i32 i32 i32 i32)))
+	  (import "gojs" "syscall/js.valueInvoke" (func $valueInvoke (param i32 i64 i32 i32 i32)))
+	  (memory (export "memory") 1)
+	  (data (i32.const 0) "notFunc")
+	  (data (i32.const 16) "missing")
+	  (func (export "_start")
+	    ;; a method the object does not have
+	    (call $valueCall (i32.const 100) (i64.const `+tinyGoGlobal+`) (i32.const 16) (i32.const 7) (i32.const 0) (i32.const 0) (i32.const 0))
+	    ;; a method of undefined
+	    (call $valueCall (i32.const 120) (i64.const 0) (i32.const 16) (i32.const 7) (i32.const 0) (i32.const 0) (i32.const 0))
+	    ;; a value that is not a function
+	    (call $valueInvoke (i32.const 140)
+	      (call $valueGet (i64.const `+tinyGoGlobal+`) (i32.const 0) (i32.const 7))
+	      (i32.const 0) (i32.const 0) (i32.const 0))))`)
+	v, err := vm.RunString(`
+	  var notFunc = 1;
+	  const go = new Go();
+	  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject);
+	  go.run(instance);
+	  go;
+	`)
+	if err != nil {
+		t.Fatalf("the program trapped: %v", err)
+	}
+	program := v.Export().(*GoClass).instance
+	for _, c := range []struct {
+		addr int32
+		want string
+	}{
+		{100, "TypeError: missing is not a function"},
+		{120, "TypeError"},
+		{140, "TypeError: value is not a function"},
+	} {
+		if ok := program.mem.Data()[c.addr+8]; ok != 0 {
+			t.Errorf("call at %d succeeded", c.addr)
+		}
+		if got := program.loadValue(c.addr).String(); !strings.HasPrefix(got, c.want) {
+			t.Errorf("call at %d threw %q, want %q", c.addr, got, c.want)
+		}
+	}
+}
+
+const tinyGoSleepWat = `(module
+  (import "gojs" "runtime.sleepTicks" (func $sleep (param f64)))
+  (memory (export "memory") 1)
+  (global $wakes (export "wakes") (mut i32) (i32.const 0))
+  (func (export "_start") (call $sleep (f64.const 50)))
+  (func (export "go_scheduler")
+    (global.set $wakes (i32.add (global.get $wakes) (i32.const 1)))
+    (if (i32.lt_u (global.get $wakes) (i32.const 3))
+      (then (call $sleep (f64.const 50))))))`
+
+func TestTinyGoTimeouts(t *testing.T) {
+	vm := newTinyGoRuntime(t, tinyGoSleepWat)
+	v, err := vm.RunString(`
+	  const timeouts = [];
+	  var setTimeout = (f, delay) => timeouts.push({f, delay});
+	  const go = new Go();
+	  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject);
+	  go.run(instance);
+	  // go.run returns before the scheduler runs, which the event loop runs later
+	  const states = [instance.exports.wakes.value + "/" + timeouts.length];
+	  while (timeouts.length > 0) {
+	    const timeout = timeouts.shift();
+	    timeout.f();
+	    states.push(timeout.delay + ":" + instance.exports.wakes.value);
+	  }
+	  states.join();
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.String(), "0/1,50:1,50:2,50:3"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// without an event loop, sleeping fails rather than blocking the runtime
+	vm = newTinyGoRuntime(t, tinyGoSleepWat)
+	_, err = vm.RunString(`
+	  const go = new Go();
+	  go.run(new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject));
+	`)
+	if err == nil || !strings.Contains(err.Error(), errNoSetTimeout.Error()) {
+		t.Errorf("got %v, want an error about setTimeout", err)
+	}
+}
+
+func TestTinyGoStdioFiles(t *testing.T) {
+	vm := newTinyGoRuntime(t, `(module
+	  (import "gojs" "runtime.ticks" (func (result f64)))
+	  (import "wasi_snapshot_preview1" "fd_fdstat_get" (func $fdstat (param i32 i32) (result i32)))
+	  (import "wasi_snapshot_preview1" "fd_seek" (func $seek (param i32 i64 i32 i32) (result i32)))
+	  (memory (export "memory") 1)
+	  (func (export "_start")
+	    (memory.fill (i32.const 0) (i32.const 0xff) (i32.const 128))
+	    ;; the errnos of the calls, from 200
+	    (i32.store8 (i32.const 200) (call $fdstat (i32.const 1) (i32.const 0)))
+	    (i32.store8 (i32.const 201) (call $fdstat (i32.const 3) (i32.const 64)))
+	    (i32.store8 (i32.const 202) (call $seek (i32.const 2) (i64.const 0) (i32.const 0) (i32.const 96)))
+	    (i32.store8 (i32.const 203) (call $seek (i32.const 3) (i64.const 0) (i32.const 0) (i32.const 96)))))`)
+	v, err := vm.RunString(`
+	  const go = new Go();
+	  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject);
+	  go.run(instance);
+	  const mem = new Uint8Array(instance.exports.memory.buffer);
+	  [Array.from(mem.subarray(200, 204)).join(" "), Array.from(mem.subarray(0, 24)).join(" "), mem[64], mem[96]].join();
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fdstat of stdout: a character device with every right; fd 3 is not open, and the streams cannot seek
+	errnos := fmt.Sprint(wasiErrnoSuccess, wasiErrnoBadf, wasiErrnoSpipe, wasiErrnoBadf)
+	fdstat := "2 0 0 0 0 0 0 0 255 255 255 255 255 255 255 255 255 255 255 255 255 255 255 255"
+	if got, want := v.String(), errnos+","+fdstat+",255,255"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestNodeShims(t *testing.T) {
+	// the program sets seen to the fs object of its global object
+	const src = `(module
+	  (import "gojs" "syscall/js.valueGet" (func $valueGet (param i64 i32 i32) (result i64)))
+	  (import "gojs" "syscall/js.valueSet" (func $valueSet (param i64 i32 i32 i64)))
+	  (memory (export "memory") 1)
+	  (data (i32.const 0) "fs")
+	  (data (i32.const 8) "seen")
+	  (func (export "_start")
+	    (call $valueSet (i64.const ` + tinyGoGlobal + `) (i32.const 8) (i32.const 4)
+	      (call $valueGet (i64.const ` + tinyGoGlobal + `) (i32.const 0) (i32.const 2)))))`
+	vm := newTinyGoRuntime(t, src)
+	v, err := vm.RunString(`
+	  const go = new Go();
+	  go.run(new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject));
+	  [typeof fs, typeof process, typeof path, typeof seen.writeSync].join();
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.String(), "undefined,undefined,undefined,function"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// the objects of the runtime take precedence
+	vm = newTinyGoRuntime(t, src)
+	v, err = vm.RunString(`
+	  var fs = {};
+	  const go = new Go();
+	  go.run(new WebAssembly.Instance(new WebAssembly.Module(bytes), go.importObject));
+	  seen === fs;
+	`)
+	if err != nil || !v.ToBoolean() {
+		t.Errorf("the program did not see the fs object of the runtime: %v, %v", v, err)
+	}
+}
@@ -0,0 +1,134 @@
+package wasm
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// Host functions returning an error would make wasmer-go free the trap twice.
+// A trapping function is a host function called through a wasm trampoline:
+// when it fails, the host function sets a flag and the trampoline traps.
+
+var (
+	trampolineMu sync.Mutex
+	trampolines  = map[string]*wasmer.Module{}
+)
+
+func valueKindName(kind wasmer.ValueKind) string {
+	switch kind {
+	case wasmer.I32:
+		return "i32"
+	case wasmer.I64:
+		return "i64"
+	case wasmer.F32:
+		return "f32"
+	case wasmer.F64:
+		return "f64"
+	case wasmer.AnyRef:
+		return "externref"
+	}
+	return "funcref"
+}
+
+// trampoline returns the module calling the function imported as host.f with signature typ,
+// compiled in the helper store.
+func trampoline(typ *wasmer.FunctionType) (*wasmer.Module, error) {
+	var params, results, args strings.Builder
+	for i, p := range typ.Params() {
+		params.WriteString(" " + valueKindName(p.Kind()))
+		args.WriteString(" (local.get " + strconv.Itoa(i) + ")")
+	}
+	for _, r := range typ.Results() {
+		results.WriteString(" " + valueKindName(r.Kind()))
+	}
+	sig := "(param" + params.String() + ") (result" + results.String() + ")"
+
+	trampolineMu.Lock()
+	defer trampolineMu.Unlock()
+	if module, ok := trampolines[sig]; ok {
+		return module, nil
+	}
+	b, err := wasmer.Wat2Wasm(`(module
+  (import "host" "f" (func $f ` + sig + `))
+  (global $failed (export "failed") (mut i32) (i32.const 0))
+  (func (export "f") ` + sig + `
+    (call $f` + args.String() + `)
+    (if (global.get $failed)
+      (then
+        (global.set $failed (i32.const 0))
+        unreachable))))`)
+	if err != nil {
+		return nil, err
+	}
+	module, err := wasmer.NewModule(helperStore(), b)
+	if err != nil {
+		return nil, err
+	}
+	trampolines[sig] = module
+	return module, nil
+}
+
+// trappingFunction is the trampoline of a host function.
+// It must be kept alive while the guest runs since wasmer-go releases
+// the trampoline instance and the host function when they are collected.
+type trappingFunction struct {
+	*wasmer.Function
+	instance *wasmer.Instance
+	host     *wasmer.Function
+}
+
+// newTrappingFunction returns a function with signature typ calling fn.
+// When fn returns an error, the function returns zero values to the trampoline,
+// which traps with "unreachable"; callers keep the error to report it.
+func newTrappingFunction(typ *wasmer.FunctionType, fn func([]wasmer.Value) ([]wasmer.Value, error)) (*trappingFunction, error) {
+	module, err := trampoline(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed *wasmer.Global
+	host := wasmer.NewFunction(helperStore(), typ, func(args []wasmer.Value) ([]wasmer.Value, error) {
+		results, err := fn(args)
+		if err == nil {
+			return results, nil
+		}
+		if err := failed.Set(int32(1), wasmer.I32); err != nil {
+			return nil, err
+		}
+		results = make([]wasmer.Value, len(typ.Results()))
+		for i, r := range typ.Results() {
+			results[i] = zeroValue(r.Kind())
+		}
+		return results, nil
+	})
+
+	importObject := wasmer.NewImportObject()
+	importObject.Register("host", map[string]wasmer.IntoExtern{"f": host})
+	instance, err := wasmer.NewInstance(module, importObject)
+	if err != nil {
+		return nil, err
+	}
+	if failed, err = instance.Exports.GetGlobal("failed"); err != nil {
+		return nil, err
+	}
+	f, err := instance.Exports.GetRawFunction("f")
+	if err != nil {
+		return nil, err
+	}
+	return &trappingFunction{Function: f, instance: instance, host: host}, nil
+}
+
+func zeroValue(kind wasmer.ValueKind) wasmer.Value {
+	switch kind {
+	case wasmer.I64:
+		return wasmer.NewI64(int64(0))
+	case wasmer.F32:
+		return wasmer.NewF32(float32(0))
+	case wasmer.F64:
+		return wasmer.NewF64(float64(0))
+	}
+	return wasmer.NewI32(int32(0))
+}
@@ -0,0 +1,123 @@
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// trapKinds are the kinds of traps, by the message of wasmer.
+var trapKinds = []struct {
+	message, kind string
+}{
+	{"unreachable", "unreachable"},
+	{"out of bounds", "out-of-bounds"},
+	{"integer divide by zero", "integer-divide-by-zero"},
+	{"integer overflow", "integer-overflow"},
+	{"call stack exhausted", "stack-overflow"},
+	{"indirect call type mismatch", "indirect-call-type-mismatch"},
+	{"uninitialized element", "uninitialized-element"},
+	{"invalid conversion to integer", "invalid-conversion"},
+}
+
+// maxTrapFrames caps the frames of a trap, which overflowing the stack fills with recursive calls.
+const maxTrapFrames = 20
+
+// unknownOffset is the offset of the frames wasmer cannot locate.
+const unknownOffset = math.MaxUint32
+
+// Trap is the error of a guest that trapped. Scripts see a WebAssembly.RuntimeError
+// with the kind of the trap and the frames of the guest in its stack.
+type Trap struct {
+	// Kind is the kind of the trap, such as "unreachable", "out-of-bounds",
+	// "integer-divide-by-zero" or "stack-overflow", or "unknown".
+	Kind    string
+	Message string
+	// Frames are the frames of the guest, innermost first. When the guest was called
+	// by a host function of another guest, the frames of the outer guest are missing:
+	// wasmer only reports the frames of the call that trapped.
+	Frames []Frame
+	// Omitted is the number of outer frames past the frames.
+	Omitted int
+}
+
+func (t *Trap) Error() string {
+	return t.Message
+}
+
+// Frame is a frame of a guest.
+type Frame struct {
+	FunctionIndex uint32
+	// Name is the name of the function in the name section of the module, if any.
+	Name string
+	// Offset is the offset of the instruction in the module, 0 if it is unknown.
+	Offset uint32
+}
+
+func (f Frame) String() string {
+	pos := fmt.Sprintf("wasm-function[%d]", f.FunctionIndex)
+	if f.Offset != 0 {
+		pos += fmt.Sprintf(":0x%x", f.Offset)
+	}
+	if f.Name != "" {
+		return f.Name + " (" + pos + ")"
+	}
+	return pos
+}
+
+// newTrap returns the trap of err, in the module described by info.
+func newTrap(err *wasmer.TrapError, info *moduleInfo) *Trap {
+	t := &Trap{Kind: "unknown", Message: err.Error()}
+	for _, k := range trapKinds {
+		if strings.Contains(t.Message, k.message) {
+			t.Kind = k.kind
+			break
+		}
+	}
+	trace := err.Trace()
+	if len(trace) > maxTrapFrames {
+		t.Omitted = len(trace) - maxTrapFrames
+		trace = trace[:maxTrapFrames]
+	}
+	for _, frame := range trace {
+		f := Frame{FunctionIndex: frame.FunctionIndex(), Name: info.name(frame.FunctionIndex())}
+		if off := frame.ModuleOffset(); off != unknownOffset {
+			f.Offset = info.offset(uint32(off))
+		}
+		t.Frames = append(t.Frames, f)
+	}
+	return t
+}
+
+// jsError returns the RuntimeError of vm for t. Its stack lists the frames of
+// the guest followed by the frames of the script that called it, without the frames
+// of outer guests, see Trap.Frames.
+func (t *Trap) jsError(vm *goja.Runtime) *goja.Object {
+	obj := wasmError(vm, "RuntimeError", t.Message)
+	obj.Set("kind", t.Kind)
+
+	var b bytes.Buffer
+	b.WriteString("RuntimeError: " + t.Message + "\n")
+	for _, frame := range t.Frames {
+		b.WriteString("\tat " + frame.String() + "\n")
+	}
+	if t.Omitted > 0 {
+		fmt.Fprintf(&b, "\t... %d more frames\n", t.Omitted)
+	}
+	frames := vm.CaptureCallStack(0, nil)
+	if len(frames) > 0 && frames[0].SrcName() == "<native>" {
+		// the function calling the guest
+		frames = frames[1:]
+	}
+	for _, frame := range frames {
+		b.WriteString("\tat ")
+		frame.Write(&b)
+		b.WriteByte('\n')
+	}
+	obj.DefineDataProperty("stack", vm.ToValue(b.String()), goja.FLAG_TRUE, goja.FLAG_FALSE, goja.FLAG_TRUE)
+	return obj
+}
@@ -0,0 +1,42 @@
+package wasm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+func TestTrapStack(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	vm.Set("bytes", vm.NewArrayBuffer(wat(t, `(module
+	  (import "env" "call" (func $call))
+	  (func $inner unreachable)
+	  (func $boom (export "boom") call $inner)
+	  (func $outer (export "outer") call $call))`)))
+	v, err := vm.RunString(`
+	  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), {env: {call: () => instance.exports.boom()}});
+	  const stacks = [];
+	  for (const f of [instance.exports.boom, instance.exports.outer]) {
+	    try { f() } catch (e) { stacks.push(e.kind + "\n" + e.stack) }
+	  }
+	  stacks;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stacks []string
+	if err := vm.ExportTo(v, &stacks); err != nil {
+		t.Fatal(err)
+	}
+	for _, stack := range stacks {
+		lines := strings.Split(stack, "\n")
+		if len(lines) < 4 || lines[0] != "unreachable" || !strings.HasPrefix(lines[1], "RuntimeError: ") {
+			t.Fatalf("stack is %q", stack)
+		}
+		if !strings.HasPrefix(lines[2], "\tat inner (wasm-function[1]:0x") || !strings.HasPrefix(lines[3], "\tat boom (wasm-function[2]:0x") {
+			t.Errorf("stack does not start with the frames of the guest: %q", stack)
+		}
+	}
+}
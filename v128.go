@@ -0,0 +1,596 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// wasmer 1.0.4 aborts the process when it reflects the v128 value type, which it does
+// for the imports and exports of modules. Compile gives the functions imported and
+// exported with v128 values adapters passing each value as two i64, its low and high
+// halves. Scripts cannot pass v128 values and get a TypeError, as in browsers, while
+// Call passes them as [16]byte. Exported v128 globals are hidden from wasmer.
+
+// errV128 is the error of scripts passing v128 values.
+const errV128 = "v128 values cannot be passed to or from JS"
+
+var errV128Globals = errors.New("v128 globals cannot be imported by this runtime")
+
+// value types of v128 and of its halves
+const (
+	v128Type = 0x7b
+	i64Type  = 0x7e
+)
+
+// v128Signatures are the signatures of the imports and exports of a module using v128,
+// imports by importKey, and its exported v128 globals, mutable if true.
+type v128Signatures struct {
+	Exports map[string]valueMarks
+	Imports map[string]valueMarks
+	Globals map[string]bool
+}
+
+// export returns the signature of the export name. s may be nil.
+func (s *v128Signatures) export(name string) valueMarks {
+	if s == nil {
+		return valueMarks{}
+	}
+	return s.Exports[name]
+}
+
+// imported returns the signature of the import module.name. s may be nil.
+func (s *v128Signatures) imported(module, name string) valueMarks {
+	if s == nil {
+		return valueMarks{}
+	}
+	return s.Imports[importKey(module, name)]
+}
+
+// global reports whether name is an exported v128 global, and if it is mutable. s may be nil.
+func (s *v128Signatures) global(name string) (mutable, ok bool) {
+	if s == nil {
+		return false, false
+	}
+	mutable, ok = s.Globals[name]
+	return mutable, ok
+}
+
+// v128Halves returns the low and high halves of v.
+func v128Halves(v [16]byte) (int64, int64) {
+	return int64(binary.LittleEndian.Uint64(v[:8])), int64(binary.LittleEndian.Uint64(v[8:]))
+}
+
+// v128Value returns the value with the halves lo and hi.
+func v128Value(lo, hi int64) [16]byte {
+	var v [16]byte
+	binary.LittleEndian.PutUint64(v[:8], uint64(lo))
+	binary.LittleEndian.PutUint64(v[8:], uint64(hi))
+	return v
+}
+
+// joinV128 converts the results r of an adapter with the signature sig, where v128
+// results are pairs of halves, to the results of the function it adapts.
+func joinV128(sig valueMarks, r interface{}) interface{} {
+	if !sig.any() {
+		return r
+	}
+	halves, ok := r.([]interface{})
+	if !ok {
+		halves = []interface{}{r}
+	}
+	results := make([]interface{}, 0, len(sig.Results))
+	for i := 0; i < len(sig.Results) && len(halves) > 0; i++ {
+		if sig.result(i) && len(halves) > 1 {
+			results = append(results, v128Value(halves[0].(int64), halves[1].(int64)))
+			halves = halves[2:]
+			continue
+		}
+		results = append(results, halves[0])
+		halves = halves[1:]
+	}
+	switch len(results) {
+	case 0:
+		return nil
+	case 1:
+		return results[0]
+	}
+	return results
+}
+
+type wasmFuncType struct {
+	params, results []byte
+}
+
+func (t wasmFuncType) hasV128() bool {
+	return bytes.IndexByte(t.params, v128Type) >= 0 || bytes.IndexByte(t.results, v128Type) >= 0
+}
+
+func (t wasmFuncType) marks() valueMarks {
+	sig := valueMarks{Params: make([]bool, len(t.params)), Results: make([]bool, len(t.results))}
+	for i, v := range t.params {
+		sig.Params[i] = v == v128Type
+	}
+	for i, v := range t.results {
+		sig.Results[i] = v == v128Type
+	}
+	return sig
+}
+
+// lowered returns t with v128 values split into halves.
+func (t wasmFuncType) lowered() wasmFuncType {
+	split := func(types []byte) []byte {
+		out := make([]byte, 0, len(types))
+		for _, v := range types {
+			if v == v128Type {
+				out = append(out, i64Type, i64Type)
+			} else {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+	return wasmFuncType{params: split(t.params), results: split(t.results)}
+}
+
+func (t wasmFuncType) encode() []byte {
+	b := appendU32([]byte{0x60}, uint32(len(t.params)))
+	b = append(b, t.params...)
+	b = appendU32(b, uint32(len(t.results)))
+	return append(b, t.results...)
+}
+
+type wasmImport struct {
+	module, name string
+	kind         byte
+	// desc is the description of imports other than functions
+	desc []byte
+	typ  uint32
+}
+
+type wasmExport struct {
+	name  string
+	kind  byte
+	index uint32
+}
+
+// lowerV128 returns the binary module b with adapters for the functions it imports and
+// exports with v128 values, the signatures of these functions, and the map of the code of
+// the returned module to b. It returns b if there are none or if it cannot be rewritten,
+// which wasmer reports. Functions calling an adapted import call its adapter instead.
+func lowerV128(b []byte) ([]byte, *v128Signatures, offsetMap, error) {
+	if !bytes.Contains(b, []byte{v128Type}) {
+		return b, nil, nil, nil
+	}
+	sections, err := splitSections(b)
+	if err != nil {
+		return b, nil, nil, nil
+	}
+	find := func(id byte) int {
+		for i, s := range sections {
+			if s.id == id {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var (
+		types     []wasmFuncType
+		imports   []wasmImport
+		funcTypes []uint32
+		globals   []byte
+		mutable   []bool
+		exports   []wasmExport
+		defined   uint32
+	)
+	r := &wasmReader{}
+	if i := find(typeSection); i >= 0 {
+		r = &wasmReader{b: sections[i].data}
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			if r.byte() != 0x60 {
+				return b, nil, nil, nil
+			}
+			var t wasmFuncType
+			t.params = r.bytes(int(r.u32()))
+			t.results = r.bytes(int(r.u32()))
+			types = append(types, t)
+		}
+	}
+	if i := find(importSection); i >= 0 && r.err == nil {
+		r = &wasmReader{b: sections[i].data}
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			imp := wasmImport{module: string(r.bytes(int(r.u32()))), name: string(r.bytes(int(r.u32()))), kind: r.byte()}
+			start := r.off
+			switch imp.kind {
+			case 0:
+				imp.typ = r.u32()
+				funcTypes = append(funcTypes, imp.typ)
+			case 1:
+				r.byte()
+				r.limits()
+			case 2:
+				r.limits()
+			case 3:
+				globals = append(globals, r.byte())
+				mutable = append(mutable, r.byte() == 1)
+				if globals[len(globals)-1] == v128Type {
+					return nil, nil, nil, errV128Globals
+				}
+			default:
+				return b, nil, nil, nil
+			}
+			imp.desc = r.b[start:r.off]
+			imports = append(imports, imp)
+		}
+	}
+	if i := find(functionSection); i >= 0 && r.err == nil {
+		r = &wasmReader{b: sections[i].data}
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			funcTypes = append(funcTypes, r.u32())
+			defined++
+		}
+	}
+	if i := find(globalSection); i >= 0 && r.err == nil {
+		r = &wasmReader{b: sections[i].data}
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			globals = append(globals, r.byte())
+			mutable = append(mutable, r.byte() == 1)
+			skipExpr(r)
+		}
+	}
+	if i := find(exportSection); i >= 0 && r.err == nil {
+		r = &wasmReader{b: sections[i].data}
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			exports = append(exports, wasmExport{name: string(r.bytes(int(r.u32()))), kind: r.byte(), index: r.u32()})
+		}
+	}
+	if r.err != nil {
+		return b, nil, nil, nil
+	}
+	for _, t := range funcTypes {
+		if int(t) >= len(types) {
+			return b, nil, nil, nil
+		}
+	}
+
+	sigs := &v128Signatures{Exports: map[string]valueMarks{}, Imports: map[string]valueMarks{}, Globals: map[string]bool{}}
+	var added []wasmFuncType
+	typeIndex := map[string]uint32{}
+	for i, t := range types {
+		if _, ok := typeIndex[string(t.encode())]; !ok {
+			typeIndex[string(t.encode())] = uint32(i)
+		}
+	}
+	// typeOf returns the index of t, added to the type section if needed
+	typeOf := func(t wasmFuncType) uint32 {
+		key := string(t.encode())
+		if i, ok := typeIndex[key]; ok {
+			return i
+		}
+		i := uint32(len(types) + len(added))
+		typeIndex[key] = i
+		added = append(added, t)
+		return i
+	}
+
+	next := uint32(len(funcTypes))
+	var adapterTypes, bodies []byte
+	addAdapter := func(typ uint32, body []byte) uint32 {
+		adapterTypes = appendU32(adapterTypes, typ)
+		bodies = appendU32(bodies, uint32(len(body)))
+		bodies = append(bodies, body...)
+		next++
+		return next - 1
+	}
+
+	// imports are adapted by functions with their type, called instead of them
+	remap := map[uint32]uint32{}
+	importsChanged := false
+	index := uint32(0)
+	for i, imp := range imports {
+		if imp.kind != 0 {
+			continue
+		}
+		if t := types[imp.typ]; t.hasV128() {
+			imports[i].typ = typeOf(t.lowered())
+			remap[index] = addAdapter(imp.typ, importAdapter(t, index))
+			sigs.Imports[importKey(imp.module, imp.name)] = t.marks()
+			importsChanged = true
+		}
+		index++
+	}
+
+	// exports are replaced by adapters with lowered types, v128 globals are hidden
+	exportsChanged := false
+	adapters := map[uint32]uint32{}
+	kept := exports[:0]
+	for _, e := range exports {
+		switch {
+		case e.kind == 0 && int(e.index) < len(funcTypes) && types[funcTypes[e.index]].hasV128():
+			t := types[funcTypes[e.index]]
+			target := e.index
+			if adapter, ok := remap[target]; ok {
+				target = adapter
+			}
+			adapter, ok := adapters[target]
+			if !ok {
+				adapter = addAdapter(typeOf(t.lowered()), exportAdapter(t, target))
+				adapters[target] = adapter
+			}
+			e.index = adapter
+			sigs.Exports[e.name] = t.marks()
+			exportsChanged = true
+		case e.kind == 3 && int(e.index) < len(globals) && globals[e.index] == v128Type:
+			sigs.Globals[e.name] = mutable[e.index]
+			exportsChanged = true
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if !importsChanged && !exportsChanged {
+		return b, nil, nil, nil
+	}
+
+	if len(added) > 0 {
+		var entries []byte
+		for _, t := range added {
+			entries = append(entries, t.encode()...)
+		}
+		sections = appendEntries(sections, typeSection, uint32(len(types)), uint32(len(added)), entries)
+	}
+	if importsChanged {
+		data := appendU32(nil, uint32(len(imports)))
+		for _, imp := range imports {
+			data = appendName(data, imp.module)
+			data = appendName(data, imp.name)
+			data = append(data, imp.kind)
+			if imp.kind == 0 {
+				data = appendU32(data, imp.typ)
+			} else {
+				data = append(data, imp.desc...)
+			}
+		}
+		sections[find(importSection)].data = data
+	}
+	sections = appendEntries(sections, functionSection, defined, next-uint32(len(funcTypes)), adapterTypes)
+	if i := find(exportSection); i >= 0 {
+		data := appendU32(nil, uint32(len(kept)))
+		for _, e := range kept {
+			data = appendName(data, e.name)
+			data = appendU32(append(data, e.kind), e.index)
+		}
+		sections[i].data = data
+	}
+	if len(remap) > 0 {
+		for i, s := range sections {
+			var data []byte
+			switch s.id {
+			case globalSection:
+				data, err = remapGlobals(s.data, remap)
+			case elementSection:
+				data, err = remapElements(s.data, remap)
+			case startSection:
+				r := &wasmReader{b: s.data}
+				data, err = appendU32(nil, remapIndex(remap, r.u32())), r.err
+			default:
+				continue
+			}
+			if err != nil {
+				return b, nil, nil, nil
+			}
+			sections[i].data = data
+		}
+	}
+	sections, shifts, err := rewriteCode(sections, func(body []byte) ([]byte, offsetMap, error) {
+		return remapBody(body, remap)
+	}, next-uint32(len(funcTypes)), bodies)
+	if err != nil {
+		return b, nil, nil, nil
+	}
+	// errors are reported at the offsets of b
+	if err := wasmer.ValidateModule(helperStore(), b); err != nil {
+		return nil, nil, nil, err
+	}
+	out, offsets := assembleModule(b[:8], sections, shifts)
+	return out, sigs, offsets, nil
+}
+
+// importAdapter returns the body of the function with type t calling fn, an import
+// with the lowered type of t.
+func importAdapter(t wasmFuncType, fn uint32) []byte {
+	var code []byte
+	for i, v := range t.params {
+		code = appendU32(append(code, 0x20), uint32(i))
+		if v == v128Type {
+			// i64x2.extract_lane 0, then 1
+			code = append(code, 0xfd, 0x1d, 0)
+			code = appendU32(append(code, 0x20), uint32(i))
+			code = append(code, 0xfd, 0x1d, 1)
+		}
+	}
+	code = appendU32(append(code, 0x10), fn)
+	if bytes.IndexByte(t.results, v128Type) < 0 {
+		return adapterBody(code, 0, nil, nil)
+	}
+	var push []byte
+	local := uint32(len(t.params))
+	for _, v := range t.results {
+		push = appendU32(append(push, 0x20), local)
+		local++
+		if v == v128Type {
+			// i64x2.splat, then i64x2.replace_lane 1
+			push = append(push, 0xfd, 0x12)
+			push = appendU32(append(push, 0x20), local)
+			push = append(push, 0xfd, 0x1e, 1)
+			local++
+		}
+	}
+	return adapterBody(code, uint32(len(t.params)), t.lowered().results, push)
+}
+
+// exportAdapter returns the body of the function with the lowered type of t calling fn,
+// a function with type t.
+func exportAdapter(t wasmFuncType, fn uint32) []byte {
+	var code []byte
+	local := uint32(0)
+	for _, v := range t.params {
+		code = appendU32(append(code, 0x20), local)
+		local++
+		if v == v128Type {
+			code = append(code, 0xfd, 0x12)
+			code = appendU32(append(code, 0x20), local)
+			code = append(code, 0xfd, 0x1e, 1)
+			local++
+		}
+	}
+	code = appendU32(append(code, 0x10), fn)
+	if bytes.IndexByte(t.results, v128Type) < 0 {
+		return adapterBody(code, 0, nil, nil)
+	}
+	var push []byte
+	for i, v := range t.results {
+		push = appendU32(append(push, 0x20), local+uint32(i))
+		if v == v128Type {
+			push = append(push, 0xfd, 0x1d, 0)
+			push = appendU32(append(push, 0x20), local+uint32(i))
+			push = append(push, 0xfd, 0x1d, 1)
+		}
+	}
+	return adapterBody(code, local, t.results, push)
+}
+
+// adapterBody returns the body of an adapter running code, which leaves results of the
+// types stored on the stack, then push, which pushes them converted from the locals
+// following the params parameters. The results are left as they are if push is nil.
+func adapterBody(code []byte, params uint32, stored, push []byte) []byte {
+	if push == nil {
+		body := append(appendU32(nil, 0), code...)
+		return append(body, 0x0b)
+	}
+	body := appendU32(nil, uint32(len(stored)))
+	for _, v := range stored {
+		body = append(body, 1, v)
+	}
+	body = append(body, code...)
+	for i := len(stored) - 1; i >= 0; i-- {
+		body = appendU32(append(body, 0x21), params+uint32(i))
+	}
+	body = append(body, push...)
+	return append(body, 0x0b)
+}
+
+func remapIndex(remap map[uint32]uint32, index uint32) uint32 {
+	if to, ok := remap[index]; ok {
+		return to
+	}
+	return index
+}
+
+// appendInstr appends the instruction read by r, with its function index remapped.
+func appendInstr(out []byte, r *wasmReader, remap map[uint32]uint32) ([]byte, byte) {
+	start := r.off
+	op := r.byte()
+	switch op {
+	case 0x10, 0x12, 0xd2:
+		return appendU32(append(out, op), remapIndex(remap, r.u32())), op
+	}
+	r.immediates(op)
+	if r.err != nil {
+		return out, op
+	}
+	return append(out, r.b[start:r.off]...), op
+}
+
+// remapExpr appends the constant expression read by r, with its function indices remapped.
+func remapExpr(out []byte, r *wasmReader, remap map[uint32]uint32) []byte {
+	for r.err == nil {
+		var op byte
+		if out, op = appendInstr(out, r, remap); op == 0x0b {
+			break
+		}
+	}
+	return out
+}
+
+func skipExpr(r *wasmReader) {
+	for r.err == nil {
+		op := r.byte()
+		if op == 0x0b {
+			return
+		}
+		r.immediates(op)
+	}
+}
+
+// remapBody returns the function body with its function indices remapped.
+// The offsets map the rewritten body to body after each instruction that moved.
+func remapBody(body []byte, remap map[uint32]uint32) ([]byte, offsetMap, error) {
+	if len(remap) == 0 {
+		return body, nil, nil
+	}
+	r := &wasmReader{b: body}
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		r.u32()
+		r.byte()
+	}
+	out := append([]byte(nil), body[:r.off]...)
+	var moved offsetMap
+	for !r.done() && r.err == nil {
+		start, size := r.off, len(out)
+		out, _ = appendInstr(out, r, remap)
+		if len(out)-size != r.off-start {
+			moved.add(len(out), r.off)
+		}
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return out, moved, nil
+}
+
+func remapGlobals(data []byte, remap map[uint32]uint32) ([]byte, error) {
+	r := &wasmReader{b: data}
+	n := r.u32()
+	out := appendU32(nil, n)
+	for ; n > 0 && r.err == nil; n-- {
+		out = append(out, r.byte(), r.byte())
+		out = remapExpr(out, r, remap)
+	}
+	return out, r.err
+}
+
+// remapElements returns the element section data with its function indices remapped.
+func remapElements(data []byte, remap map[uint32]uint32) ([]byte, error) {
+	r := &wasmReader{b: data}
+	n := r.u32()
+	out := appendU32(nil, n)
+	for ; n > 0 && r.err == nil; n-- {
+		flags := r.u32()
+		out = appendU32(out, flags)
+		if flags&3 == 2 {
+			// table index
+			out = appendU32(out, r.u32())
+		}
+		if flags&1 == 0 {
+			// offset of an active segment
+			out = remapExpr(out, r, remap)
+		}
+		if flags&3 != 0 {
+			// element kind or reference type
+			out = append(out, r.byte())
+		}
+		count := r.u32()
+		out = appendU32(out, count)
+		for ; count > 0 && r.err == nil; count-- {
+			if flags&4 != 0 {
+				out = remapExpr(out, r, remap)
+			} else {
+				out = appendU32(out, remapIndex(remap, r.u32()))
+			}
+		}
+	}
+	return out, r.err
+}
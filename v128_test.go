@@ -0,0 +1,141 @@
+package wasm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+const v128Wat = `(module
+  (import "env" "h" (func $h (param v128 i32) (result v128)))
+  (import "env" "plain" (func $plain (param i32) (result i32)))
+  (type $sig (func (param v128 i32) (result v128)))
+  (table 2 funcref)
+  (elem (i32.const 0) $h $swap)
+  (global $ref funcref (ref.func $h))
+  (global $g (export "g") (mut v128) (v128.const i64x2 1 2))
+  (func $id (export "id") (param v128) (result v128) local.get 0)
+  (func (export "add") (param i32 v128 v128 f64) (result v128 f64 i32)
+    local.get 1 local.get 2 i32x4.add local.get 3 local.get 0)
+  (func $swap (param v128 i32) (result v128)
+    local.get 0 local.get 0 i8x16.shuffle 8 9 10 11 12 13 14 15 0 1 2 3 4 5 6 7)
+  (func (export "callH") (param v128) (result v128) local.get 0 i32.const 0 call $h)
+  (func (export "callIndirect") (param v128 i32) (result v128)
+    local.get 0 i32.const 0 local.get 1 call_indirect (type $sig))
+  (func (export "viaPlain") (param i32) (result i32) local.get 0 call $plain)
+  (func (export "setRef") (table.set (i32.const 1) (global.get $ref)))
+  (export "h" (func $h)))`
+
+// v128Bytes returns the v128 value whose bytes start at first and increase by one.
+func v128Bytes(first byte) [16]byte {
+	var v [16]byte
+	for i := range v {
+		v[i] = first + byte(i)
+	}
+	return v
+}
+
+func newV128Instance(t *testing.T, vm *goja.Runtime, h interface{}) *WasmInstance {
+	t.Helper()
+	module, err := Compile(wat(t, v128Wat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := NewInstance(vm, module.attach(vm), vm.ToValue(map[string]interface{}{
+		"env": map[string]interface{}{"h": h, "plain": func(x int) int { return x + 1 }},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+func TestV128Call(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	instance := newV128Instance(t, vm, func(goja.FunctionCall) goja.Value { return nil })
+	a := v128Bytes(0)
+	if r, err := instance.Call("id", a); err != nil || r != a {
+		t.Errorf("id: got %v, %v, want %v", r, err, a)
+	}
+	var sum [16]byte
+	for i := range sum {
+		sum[i] = 2 * byte(i)
+	}
+	want := []interface{}{sum, 2.5, int32(7)}
+	if r, err := instance.Call("add", 7, a, a, 2.5); err != nil || !reflect.DeepEqual(r, want) {
+		t.Errorf("add: got %v, %v, want %v", r, err, want)
+	}
+	if r, err := instance.Call("viaPlain", 41); err != nil || r != int32(42) {
+		t.Errorf("viaPlain: got %v, %v", r, err)
+	}
+	if _, err := instance.Call("id", 5); err == nil || !strings.Contains(err.Error(), "[16]byte") {
+		t.Errorf("id(5): got %v, want an error about [16]byte", err)
+	}
+}
+
+func TestV128Imports(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	called := false
+	instance := newV128Instance(t, vm, func(goja.FunctionCall) goja.Value {
+		called = true
+		return nil
+	})
+	a := v128Bytes(0x10)
+	// the elements keep the functions that are not adapted
+	var swapped [16]byte
+	copy(swapped[:], a[8:])
+	copy(swapped[8:], a[:8])
+	if r, err := instance.Call("callIndirect", a, 1); err != nil || r != swapped {
+		t.Errorf("callIndirect(1): got %v, %v, want %v", r, err, swapped)
+	}
+	if _, err := instance.Call("setRef"); err != nil {
+		t.Fatal(err)
+	}
+
+	// calls, elements and ref.func in globals reach the adapter of the import, which
+	// throws like browsers do, rather than the lowered import with another signature
+	for _, c := range []struct {
+		name string
+		args []interface{}
+	}{
+		{"callH", []interface{}{a}},
+		{"callIndirect", []interface{}{a, 0}},
+		{"callIndirect", []interface{}{a, 1}},
+		{"h", []interface{}{a, 0}},
+	} {
+		if _, err := instance.Call(c.name, c.args...); err == nil || !strings.Contains(err.Error(), "TypeError: WebAssembly.FunctionCall: "+errV128) {
+			t.Errorf("%s%v: got %v, want a TypeError", c.name, c.args[1:], err)
+		}
+	}
+	if called {
+		t.Error("the JS function was called")
+	}
+}
+
+func TestV128Globals(t *testing.T) {
+	vm := goja.New()
+	Enable(vm)
+	vm.Set("bytes", vm.NewArrayBuffer(wat(t, v128Wat)))
+	v, err := vm.RunString(`
+	  const module = new WebAssembly.Module(bytes);
+	  const g = new WebAssembly.Instance(module, {env: {h: () => null, plain: (x) => x}}).exports.g;
+	  const failed = [];
+	  try { g.value; failed.push("get") } catch (e) { if (!(e instanceof TypeError)) throw e }
+	  try { g.value = 1; failed.push("set") } catch (e) { if (!(e instanceof TypeError)) throw e }
+	  if (WebAssembly.Module.exports(module).some(e => e.name === "g")) failed.push("exports");
+	  failed.join(",");
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := v.String(); failed != "" {
+		t.Errorf("failed checks: %s", failed)
+	}
+	if _, err := Compile(wat(t, `(module (import "env" "g" (global v128)))`)); err == nil {
+		t.Error("module importing a v128 global compiled")
+	}
+}
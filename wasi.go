@@ -0,0 +1,128 @@
+package wasm
+
+import (
+	"strconv"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// WASI errno values used by the host functions of this package.
+const (
+	wasiErrnoSuccess = 0
+	wasiErrnoBadf    = 8
+	wasiErrnoFault   = 21
+	wasiErrnoIO      = 29
+)
+
+// exitError is the error of a program that exited with a status code.
+type exitError int32
+
+func (e exitError) Error() string {
+	return "exit status " + strconv.Itoa(int(e))
+}
+
+// streams returns the standard streams of the instance,
+// which are those of the WASI object it was created with, if any.
+func (w *WasmInstance) streams() *stdio {
+	if w.wasiClass != nil {
+		return &w.wasiClass.stdio
+	}
+	return &w.stdio
+}
+
+// flushWasi forwards the output captured by WASI to the standard streams of the instance.
+func (w *WasmInstance) flushWasi() {
+	if w.wasi == nil {
+		return
+	}
+	if b := w.wasi.ReadStdout(); len(b) > 0 {
+		w.streams().writer(1).Write(b)
+	}
+	if b := w.wasi.ReadStderr(); len(b) > 0 {
+		w.streams().writer(2).Write(b)
+	}
+}
+
+// link returns funcs guarded and routed through the interceptor of the WASI object,
+// kept alive with the instance.
+func (w *WasmInstance) link(funcs map[string]wasmer.IntoExtern) map[string]wasmer.IntoExtern {
+	if w.guard == nil {
+		w.guard = &hostGuard{}
+		if w.wasiClass != nil {
+			w.guard.h = w.wasiClass.host
+		}
+	}
+	// wasmer-go keeps host functions until their finalizers run, so they must not
+	// reference the instance, which keeps them alive, unless an interceptor reads its memory
+	var memory *memoryTrace
+	if w.guard.h != nil {
+		memory = w.tracedMemory()
+	}
+	funcs, err := intercept(w.guard, funcs, memory)
+	if err != nil {
+		panic(w.vm.NewGoError(err))
+	}
+	w.imports = append(w.imports, funcs)
+	return funcs
+}
+
+// startError returns what to throw for err, the error of the WASI program of w.
+func (w *WasmInstance) startError(err error) interface{} {
+	err = guestError(w.guard, err)
+	if ex := hostThrow(w.vm, err); ex != nil {
+		return ex
+	}
+	return w.vm.NewGoError(err)
+}
+
+// memory returns the memory exported by the instance.
+func (w *WasmInstance) memory() []byte {
+	if w.instance == nil {
+		return nil
+	}
+	mem, err := w.instance.Exports.GetMemory("memory")
+	if err != nil {
+		return nil
+	}
+	return mem.Data()
+}
+
+// tracedMemory returns the memory of the instance, traced while its host calls are recorded.
+func (w *WasmInstance) tracedMemory() *memoryTrace {
+	if w.trace == nil {
+		w.trace = &memoryTrace{data: w.memory}
+	}
+	return w.trace
+}
+
+// wasiProcExit returns the proc_exit implementation of the instance.
+// onExit is called with the exit code if not nil.
+func (w *WasmInstance) wasiProcExit(store *wasmer.Store, onExit func(code int32)) *wasmer.Function {
+	trap, err := newExitTrap()
+	if err != nil {
+		panic(w.vm.NewGoError(err))
+	}
+	w.exitTrap = trap
+	w.onExit = onExit
+	return trap.fn
+}
+
+// checkExit records the exit status of the guest once it called proc_exit.
+func (w *WasmInstance) checkExit() {
+	if w.exitTrap == nil || w.exited {
+		return
+	}
+	if exited, code := w.exitTrap.status(); exited {
+		w.exited = true
+		w.exitCode = code
+		if w.onExit != nil {
+			w.onExit(code)
+		}
+	}
+}
+
+// finishCall is called after every call into the guest.
+func (w *WasmInstance) finishCall() {
+	w.checkExit()
+	w.flushWasi()
+}
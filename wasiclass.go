@@ -0,0 +1,364 @@
+package wasm
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+
+	"github.com/dop251/goja"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// WASIClass is the WASI object, modeled on the WASI class of Node's wasi module.
+type WASIClass struct {
+	vm *goja.Runtime
+	stdio
+
+	env          *wasmer.WasiEnvironment
+	preopens     map[string]fs.FS
+	returnOnExit bool
+
+	// args and environ are passed to the native implementation
+	args    []string
+	environ []string
+	// system is set when the native implementation is used instead of wasmer's
+	system *WASISystem
+	// host records or replays the host calls of the instance if set
+	host hostInterceptor
+
+	// instance is the instance created with the import object of this WASI
+	instance *WasmInstance
+	started  bool
+
+	importObject    goja.Value
+	getImportObject goja.Value
+	start           goja.Value
+	initialize      goja.Value
+}
+
+// newWASIClass creates the WASI object configured by opts, which accepts
+// args, env, preopens, returnOnExit, stdin, stdout and stderr.
+func newWASIClass(vm *goja.Runtime, opts *goja.Object) *WASIClass {
+	w := &WASIClass{
+		vm:           vm,
+		preopens:     map[string]fs.FS{},
+		returnOnExit: true,
+	}
+
+	var args []string
+	env := map[string]string{}
+	if d := configOf(vm).deterministic; d != nil {
+		w.SetDeterministic(*d)
+	}
+	if opts != nil {
+		if v := opts.Get("args"); v != nil && !goja.IsUndefined(v) {
+			if err := vm.ExportTo(v, &args); err != nil {
+				panic(vm.NewTypeError("WASI: options.args must be an array of strings"))
+			}
+		}
+		if v := opts.Get("env"); v != nil && !goja.IsUndefined(v) {
+			if err := vm.ExportTo(v, &env); err != nil {
+				panic(vm.NewTypeError("WASI: options.env must be an object"))
+			}
+		}
+		if v := opts.Get("preopens"); v != nil && !goja.IsUndefined(v) {
+			preopens, ok := v.(*goja.Object)
+			if !ok {
+				panic(vm.NewTypeError("WASI: options.preopens must be an object"))
+			}
+			// host directories are given by path if the runtime allows it,
+			// other file systems are Go values implementing fs.FS
+			hostPaths := configOf(vm).hostPreopens
+			for _, guest := range preopens.Keys() {
+				switch dir := preopens.Get(guest).Export().(type) {
+				case string:
+					if !hostPaths {
+						panic(vm.NewTypeError("WASI: options.preopens." + guest + ": host paths are not allowed in this runtime"))
+					}
+					w.Mount(guest, DirFS(dir))
+				case fs.FS:
+					w.Mount(guest, dir)
+				default:
+					panic(vm.NewTypeError("WASI: options.preopens." + guest + " must be a path or a file system"))
+				}
+			}
+		}
+		if v := opts.Get("returnOnExit"); v != nil && !goja.IsUndefined(v) {
+			w.returnOnExit = v.ToBoolean()
+		}
+		if v := opts.Get("native"); v != nil && v.ToBoolean() {
+			w.SetSystem(WASISystem{})
+		}
+		if d := deterministicFromJS(vm, opts.Get("deterministic")); d != nil {
+			w.SetDeterministic(*d)
+		}
+		for _, key := range []string{"stdin", "stdout", "stderr"} {
+			if v := opts.Get(key); v != nil {
+				w.setFromJS(vm, key, v)
+			}
+		}
+	}
+
+	w.args = args
+	programName := ""
+	if len(args) > 0 {
+		programName, args = args[0], args[1:]
+	}
+	builder := wasmer.NewWasiStateBuilder(programName).
+		CaptureStdout().
+		CaptureStderr()
+	for _, arg := range args {
+		builder.Argument(arg)
+	}
+	for _, key := range sortedKeys(env) {
+		builder.Environment(key, env[key])
+		w.environ = append(w.environ, key+"="+env[key])
+	}
+
+	var err error
+	w.env, err = builder.Finalize()
+	if err != nil {
+		panic(vm.NewTypeError("WASI: " + err.Error()))
+	}
+	return w
+}
+
+// Mount maps fsys to the guest path, replacing the file system mapped to it if any.
+// fsys is read-only unless it implements WritableFS.
+// It must be called before the instance is created.
+func (w *WASIClass) Mount(guest string, fsys fs.FS) {
+	w.preopens[guest] = fsys
+}
+
+// SetSystem makes the instance use the native WASI implementation of this package
+// instead of wasmer's, with the clocks, entropy and exit handler of sys.
+// It must be called before the instance is created.
+func (w *WASIClass) SetSystem(sys WASISystem) {
+	sys = sys.withDefaults()
+	w.system = &sys
+}
+
+// SetDeterministic makes the instance use the native WASI implementation
+// with the virtual clock and seeded entropy of d.
+func (w *WASIClass) SetDeterministic(d Deterministic) {
+	w.SetSystem(d.system())
+}
+
+// Record logs the host calls of the instance to r.
+// It selects the native WASI implementation if no system is set.
+// It must be called before the instance is created.
+func (w *WASIClass) Record(r *Recorder) {
+	w.intercept(r)
+}
+
+// Replay runs the instance with the host calls recorded by a Recorder instead of the host.
+// It selects the native WASI implementation if no system is set.
+// It must be called before the instance is created.
+func (w *WASIClass) Replay(r *Replayer) {
+	w.intercept(r)
+}
+
+func (w *WASIClass) intercept(h hostInterceptor) {
+	if w.system == nil {
+		w.SetSystem(WASISystem{})
+	}
+	w.host = h
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (w *WASIClass) Get(key string) goja.Value {
+	switch key {
+	case "getImportObject":
+		if w.getImportObject == nil {
+			w.getImportObject = w.vm.ToValue(func(goja.FunctionCall) goja.Value {
+				if w.importObject == nil {
+					w.importObject = w.vm.NewDynamicObject(&WASIImportObject{
+						vm:   w.vm,
+						wasi: w,
+					})
+				}
+				return w.importObject
+			})
+		}
+		return w.getImportObject
+	case "start":
+		if w.start == nil {
+			w.start = w.vm.ToValue(func(arg goja.FunctionCall, vm *goja.Runtime) goja.Value {
+				instance := w.checkInstance("WASI.start", arg.Argument(0))
+				if _, err := instance.instance.Exports.GetFunction("_initialize"); err == nil {
+					panic(vm.NewTypeError("WASI.start: instance must not export _initialize"))
+				}
+				start, err := instance.instance.Exports.GetFunction("_start")
+				if err != nil {
+					panic(vm.NewTypeError("WASI.start: instance must export _start"))
+				}
+				w.started = true
+
+				done, err := interruptible(vm, runtimeContext(vm), instance.instance)
+				if err != nil {
+					return stoppedResult(vm, err)
+				}
+				_, err = start()
+				stopped := done()
+				instance.finishCall()
+				if err != nil && stopped != nil {
+					return stoppedResult(vm, stopped)
+				}
+				if instance.exited {
+					if !w.returnOnExit {
+						panic(vm.NewGoError(exitError(instance.exitCode)))
+					}
+					return vm.ToValue(instance.exitCode)
+				}
+				if err != nil {
+					panic(instance.startError(err))
+				}
+				return vm.ToValue(0)
+			})
+		}
+		return w.start
+	case "initialize":
+		if w.initialize == nil {
+			w.initialize = w.vm.ToValue(func(arg goja.FunctionCall, vm *goja.Runtime) goja.Value {
+				instance := w.checkInstance("WASI.initialize", arg.Argument(0))
+				if _, err := instance.instance.Exports.GetFunction("_start"); err == nil {
+					panic(vm.NewTypeError("WASI.initialize: instance must not export _start"))
+				}
+				w.started = true
+
+				if initialize, err := instance.instance.Exports.GetFunction("_initialize"); err == nil {
+					done, err := interruptible(vm, runtimeContext(vm), instance.instance)
+					if err != nil {
+						return stoppedResult(vm, err)
+					}
+					_, err = initialize()
+					stopped := done()
+					instance.finishCall()
+					if err != nil && stopped != nil {
+						return stoppedResult(vm, stopped)
+					}
+					if err != nil {
+						panic(instance.startError(err))
+					}
+				}
+				return goja.Undefined()
+			})
+		}
+		return w.initialize
+	}
+	return goja.Undefined()
+}
+
+// checkInstance returns the instance passed to start or initialize,
+// which must have been created with the import object of w and not started yet.
+func (w *WASIClass) checkInstance(method string, v goja.Value) *WasmInstance {
+	instance, ok := v.Export().(*WasmInstance)
+	if !ok {
+		panic(w.vm.NewTypeError(method + ": argument 1 must be WebAssembly.Instance"))
+	}
+	if instance.wasiClass != w {
+		panic(w.vm.NewTypeError(method + ": instance was not created with the import object of this WASI"))
+	}
+	if w.started {
+		panic(w.vm.NewTypeError(method + ": WASI instance has already started"))
+	}
+	if _, err := instance.instance.Exports.GetMemory("memory"); err != nil {
+		panic(w.vm.NewTypeError(method + ": instance must export memory"))
+	}
+	return instance
+}
+
+func (w *WASIClass) Set(key string, val goja.Value) bool {
+	return w.setFromJS(w.vm, key, val)
+}
+
+func (w *WASIClass) Delete(key string) bool {
+	return false
+}
+
+func (w *WASIClass) Has(key string) bool {
+	for _, k := range w.Keys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *WASIClass) Keys() []string {
+	return []string{"getImportObject", "start", "initialize"}
+}
+
+// WASIImportObject is returned by WASI.getImportObject.
+type WASIImportObject struct {
+	vm *goja.Runtime
+
+	wasi *WASIClass
+}
+
+// Init returns the WASI imports of module for instance.
+func (w *WASIImportObject) Init(store *wasmer.Store, module *wasmer.Module, instance *WasmInstance) (*wasmer.ImportObject, error) {
+	if w.wasi.instance != nil {
+		return nil, errors.New("WASI import object is already used by another instance")
+	}
+	if w.wasi.system != nil {
+		if version := wasmer.GetWasiVersion(module); version != wasmer.WASI_VERSION_SNAPSHOT1 {
+			return nil, errors.New("native WASI supports only " + wasmer.WASI_VERSION_SNAPSHOT1.String() + " modules")
+		}
+		w.wasi.bind(instance)
+		funcs := wasiRuntime(store, instance, *w.wasi.system, w.wasi.args, w.wasi.environ)
+		importObject := wasmer.NewImportObject()
+		importObject.Register(wasmer.WASI_VERSION_SNAPSHOT1.String(), instance.link(funcs))
+		return importObject, nil
+	}
+
+	importObject, err := w.wasi.env.GenerateImportObject(store, module)
+	if err != nil {
+		return nil, err
+	}
+	w.wasi.bind(instance)
+	instance.wasi = w.wasi.env
+	return importObject, nil
+}
+
+// bind makes instance the instance of w.
+func (w *WASIClass) bind(instance *WasmInstance) {
+	w.instance = instance
+	instance.wasiClass = w
+	instance.wasiFS = newWasiFS(instance.streams, instance.tracedMemory(), wasiPreopens(w.preopens))
+}
+
+// unbind releases w from instance, which could not be created.
+func (w *WASIClass) unbind(instance *WasmInstance) {
+	if w.instance == instance {
+		w.instance = nil
+	}
+}
+
+func (w *WASIImportObject) Get(key string) goja.Value {
+	return goja.Undefined()
+}
+
+func (w *WASIImportObject) Set(key string, val goja.Value) bool {
+	return false
+}
+
+func (w *WASIImportObject) Delete(key string) bool {
+	return false
+}
+
+func (w *WASIImportObject) Has(key string) bool {
+	return false
+}
+
+func (w *WASIImportObject) Keys() []string {
+	return []string{}
+}
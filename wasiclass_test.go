@@ -0,0 +1,95 @@
+package wasm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+// wasiEchoWat prints its arguments and its environment, separated by NUL, on a line each,
+// then exits with status 7.
+const wasiEchoWat = `(module
+  (import "wasi_snapshot_preview1" "args_sizes_get" (func $argsSizes (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_get" (func $args (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "environ_sizes_get" (func $environSizes (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "environ_get" (func $environ (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 500) "\n")
+  (func $print (param $ptr i32) (param $len i32)
+    (i32.store (i32.const 16) (local.get $ptr))
+    (i32.store (i32.const 20) (local.get $len))
+    (i32.store (i32.const 24) (i32.const 500))
+    (i32.store (i32.const 28) (i32.const 1))
+    (drop (call $write (i32.const 1) (i32.const 16) (i32.const 2) (i32.const 32))))
+  (func (export "_start")
+    (drop (call $argsSizes (i32.const 0) (i32.const 4)))
+    (drop (call $args (i32.const 1024) (i32.const 2048)))
+    (call $print (i32.const 2048) (i32.sub (i32.load (i32.const 4)) (i32.const 1)))
+    (drop (call $environSizes (i32.const 0) (i32.const 4)))
+    (drop (call $environ (i32.const 1024) (i32.const 4096)))
+    (call $print (i32.const 4096) (i32.sub (i32.load (i32.const 4)) (i32.const 1)))
+    (call $exit (i32.const 7))))`
+
+func newWASIRuntime(t *testing.T, src string, opts ...Option) *goja.Runtime {
+	t.Helper()
+	vm := goja.New()
+	Enable(vm, opts...)
+	m := vm.NewObject()
+	m.Set("exports", vm.NewObject())
+	RequireModuleLoader(vm, m)
+	vm.Set("WASI", m.Get("exports").(*goja.Object).Get("WASI"))
+	vm.Set("bytes", vm.NewArrayBuffer(wat(t, src)))
+	return vm
+}
+
+func TestWASIClass(t *testing.T) {
+	for _, native := range []bool{false, true} {
+		vm := newWASIRuntime(t, wasiEchoWat)
+		vm.Set("native", native)
+		v, err := vm.RunString(`
+		  const lines = [];
+		  const wasi = new WASI({args: ["tool", "-v"], env: {HOME: "/", A: "1"}, native, stdout: line => lines.push(line)});
+		  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), wasi.getImportObject());
+		  const code = wasi.start(instance);
+		  [code, ...lines.map(l => l.replace(/\0/g, " "))].join("|");
+		`)
+		if err != nil {
+			t.Fatalf("native %v: %v", native, err)
+		}
+		if got, want := v.String(), "7|tool -v|A=1 HOME=/"; got != want {
+			t.Errorf("native %v: got %q, want %q", native, got, want)
+		}
+	}
+
+	vm := newWASIRuntime(t, wasiEchoWat)
+	v, err := vm.RunString(`
+	  const errors = [];
+	  const attempt = (f) => { try { f(); errors.push("ok") } catch (e) { errors.push(e.constructor.name + ": " + e.message) } };
+	  const wasi = new WASI({returnOnExit: false, stdout: () => {}});
+	  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), wasi.getImportObject());
+	  attempt(() => wasi.start(instance));
+	  attempt(() => wasi.start(instance));
+	  attempt(() => new WASI().start(instance));
+	  attempt(() => new WebAssembly.Instance(new WebAssembly.Module(bytes), wasi.getImportObject()));
+	  attempt(() => new WASI({args: "tool"}));
+	  attempt(() => new WASI({preopens: {"/": "/"}}));
+	  errors.join("\n");
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GoError: exit status 7",
+		"TypeError: WASI.start: WASI instance has already started",
+		"TypeError: WASI.start: instance was not created with the import object of this WASI",
+		"TypeError: WebAssembly.Instance: WASI import object is already used by another instance",
+		"TypeError: WASI: options.args must be an array of strings",
+		"TypeError: WASI: options.preopens./: host paths are not allowed in this runtime",
+	}
+	if got := strings.Split(v.String(), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,857 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// WASI errno values returned by the file system functions.
+const (
+	wasiErrnoAcces      = 2
+	wasiErrnoExist      = 20
+	wasiErrnoInval      = 28
+	wasiErrnoIsdir      = 31
+	wasiErrnoNoent      = 44
+	wasiErrnoNosys      = 52
+	wasiErrnoNotdir     = 54
+	wasiErrnoNotempty   = 55
+	wasiErrnoNotsock    = 57
+	wasiErrnoNotsup     = 58
+	wasiErrnoRofs       = 69
+	wasiErrnoSpipe      = 70
+	wasiErrnoXdev       = 75
+	wasiErrnoNotcapable = 76
+)
+
+// WASI file types.
+const (
+	wasiFiletypeUnknown         = 0
+	wasiFiletypeCharacterDevice = 2
+	wasiFiletypeDirectory       = 3
+	wasiFiletypeRegularFile     = 4
+	wasiFiletypeSymbolicLink    = 7
+)
+
+// WASI path_open flags.
+const (
+	wasiOflagCreat     = 1
+	wasiOflagDirectory = 2
+	wasiOflagExcl      = 4
+	wasiOflagTrunc     = 8
+
+	wasiFdflagAppend = 1
+
+	wasiRightFdRead  = 1 << 1
+	wasiRightFdWrite = 1 << 6
+)
+
+// wasiPreopen is a file system mapped to a guest path.
+type wasiPreopen struct {
+	guest string
+	fsys  fs.FS
+}
+
+// wasiFile is a file descriptor opened by the guest.
+type wasiFile struct {
+	fsys fs.FS
+	// name is the path of the file in fsys
+	name string
+	// preopen is the guest path of preopened directories
+	preopen string
+
+	file    fs.File
+	dir     bool
+	entries []fs.DirEntry
+}
+
+// wasiFS implements the fd and path functions of wasi_snapshot_preview1
+// on top of fs.FS, so that guests only see the file systems mapped to them.
+// It serves every function taking a file descriptor, so that guests running
+// on wasmer's WASI see a single table of file descriptors.
+// File descriptors 0, 1 and 2 are the standard streams of the instance.
+type wasiFS struct {
+	streams func() *stdio
+	memory  *memoryTrace
+
+	files  map[uint32]*wasiFile
+	nextFd uint32
+}
+
+func newWasiFS(streams func() *stdio, memory *memoryTrace, preopens []wasiPreopen) *wasiFS {
+	f := &wasiFS{
+		streams: streams,
+		memory:  memory,
+		files:   map[uint32]*wasiFile{},
+		nextFd:  3,
+	}
+	for _, p := range preopens {
+		f.add(&wasiFile{fsys: p.fsys, name: ".", preopen: p.guest, dir: true})
+	}
+	return f
+}
+
+func (f *wasiFS) add(file *wasiFile) uint32 {
+	fd := f.nextFd
+	f.nextFd++
+	f.files[fd] = file
+	return fd
+}
+
+// wasiFault is raised when the guest passes a pointer outside of its memory.
+type wasiFault struct{}
+
+// wasiMemory is the linear memory of the guest, bounds are checked on every access.
+// Accesses are marked as reads or writes on trace, see memoryTrace.
+type wasiMemory struct {
+	data  []byte
+	trace *memoryTrace
+}
+
+// slice returns l bytes at ptr, without marking them.
+func (m wasiMemory) slice(ptr, l uint32) []byte {
+	if uint64(ptr)+uint64(l) > uint64(len(m.data)) {
+		panic(wasiFault{})
+	}
+	return m.data[ptr : ptr+l]
+}
+
+// read returns l bytes at ptr that the host reads.
+func (m wasiMemory) read(ptr, l uint32) []byte {
+	b := m.slice(ptr, l)
+	m.trace.read(int64(ptr), int64(l))
+	return b
+}
+
+// write returns l bytes at ptr that the host writes.
+func (m wasiMemory) write(ptr, l uint32) []byte {
+	b := m.slice(ptr, l)
+	m.trace.write(int64(ptr), int64(l))
+	return b
+}
+
+func (m wasiMemory) uint32(ptr uint32) uint32 {
+	return binary.LittleEndian.Uint32(m.read(ptr, 4))
+}
+
+func (m wasiMemory) putUint8(ptr uint32, v uint8) {
+	m.write(ptr, 1)[0] = v
+}
+
+func (m wasiMemory) putUint16(ptr uint32, v uint16) {
+	binary.LittleEndian.PutUint16(m.write(ptr, 2), v)
+}
+
+func (m wasiMemory) putUint32(ptr uint32, v uint32) {
+	binary.LittleEndian.PutUint32(m.write(ptr, 4), v)
+}
+
+func (m wasiMemory) putUint64(ptr uint32, v uint64) {
+	binary.LittleEndian.PutUint64(m.write(ptr, 8), v)
+}
+
+// readIovecs returns the buffers described by the iovec array at iovs, which the host reads.
+func (m wasiMemory) readIovecs(iovs, iovsLen uint32) [][]byte {
+	bufs := make([][]byte, iovsLen)
+	for i := range bufs {
+		ptr := iovs + uint32(i)*8
+		bufs[i] = m.read(m.uint32(ptr), m.uint32(ptr+4))
+	}
+	return bufs
+}
+
+// writeIovecs returns the buffers described by the iovec array at iovs, which the host fills.
+func (m wasiMemory) writeIovecs(iovs, iovsLen uint32) [][]byte {
+	bufs := make([][]byte, iovsLen)
+	ptrs := make([]uint32, iovsLen)
+	for i := range bufs {
+		ptr := iovs + uint32(i)*8
+		ptrs[i] = m.uint32(ptr)
+		bufs[i] = m.slice(ptrs[i], m.uint32(ptr+4))
+	}
+	// the buffers are marked once the iovecs are read, see memoryTrace.write
+	for i, buf := range bufs {
+		m.trace.write(int64(ptrs[i]), int64(len(buf)))
+	}
+	return bufs
+}
+
+func (m wasiMemory) string(ptr, l uint32) string {
+	return string(m.read(ptr, l))
+}
+
+// wasiFunction returns a WASI function taking params and returning an errno.
+// Out of bounds memory accesses return EFAULT, other panics trap.
+func wasiFunction(store *wasmer.Store, memory *memoryTrace, params []wasmer.ValueKind, fn func(m wasiMemory, args []wasmer.Value) int32) *hostFunction {
+	return newHostFunction(
+		store,
+		wasmer.NewFunctionType(wasmer.NewValueTypes(params...), wasmer.NewValueTypes(wasmer.I32)),
+		func(args []wasmer.Value) (res []wasmer.Value, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					if _, ok := r.(wasiFault); ok {
+						res = []wasmer.Value{wasmer.NewI32(wasiErrnoFault)}
+						return
+					}
+					if e, ok := r.(error); ok {
+						err = e
+					} else {
+						err = fmt.Errorf("%v", r)
+					}
+				}
+			}()
+			return []wasmer.Value{wasmer.NewI32(fn(wasiMemory{data: memory.bytes(), trace: memory}, args))}, nil
+		},
+	)
+}
+
+func u32(v wasmer.Value) uint32 {
+	return uint32(v.I32())
+}
+
+// wasiErrno converts err to a WASI errno.
+func wasiErrno(err error) int32 {
+	switch {
+	case err == nil:
+		return wasiErrnoSuccess
+	case errors.Is(err, fs.ErrNotExist):
+		return wasiErrnoNoent
+	case errors.Is(err, fs.ErrExist):
+		return wasiErrnoExist
+	case errors.Is(err, fs.ErrPermission):
+		return wasiErrnoAcces
+	case errors.Is(err, fs.ErrClosed):
+		return wasiErrnoBadf
+	case errors.Is(err, fs.ErrInvalid):
+		return wasiErrnoInval
+	}
+	for errno, code := range wasiErrnos {
+		if errors.Is(err, errno) {
+			return code
+		}
+	}
+	return wasiErrnoIO
+}
+
+var wasiErrnos = map[syscall.Errno]int32{
+	syscall.EBADF:     wasiErrnoBadf,
+	syscall.EISDIR:    wasiErrnoIsdir,
+	syscall.ENOTDIR:   wasiErrnoNotdir,
+	syscall.ENOTEMPTY: wasiErrnoNotempty,
+	syscall.EROFS:     wasiErrnoRofs,
+	syscall.ENOSYS:    wasiErrnoNosys,
+	syscall.EINVAL:    wasiErrnoInval,
+	syscall.EXDEV:     wasiErrnoXdev,
+}
+
+func wasiFiletype(mode fs.FileMode) uint8 {
+	switch {
+	case mode.IsDir():
+		return wasiFiletypeDirectory
+	case mode.IsRegular():
+		return wasiFiletypeRegularFile
+	case mode&fs.ModeSymlink != 0:
+		return wasiFiletypeSymbolicLink
+	case mode&fs.ModeCharDevice != 0:
+		return wasiFiletypeCharacterDevice
+	}
+	return wasiFiletypeUnknown
+}
+
+// putFilestat writes the filestat of info at ptr.
+func (m wasiMemory) putFilestat(ptr uint32, info fs.FileInfo) {
+	m.slice(ptr, 64)
+	m.putUint64(ptr, 0)
+	m.putUint64(ptr+8, 0)
+	m.putUint8(ptr+16, wasiFiletype(info.Mode()))
+	m.putUint64(ptr+24, 1)
+	m.putUint64(ptr+32, uint64(info.Size()))
+	t := uint64(info.ModTime().UnixNano())
+	m.putUint64(ptr+40, t)
+	m.putUint64(ptr+48, t)
+	m.putUint64(ptr+56, t)
+}
+
+func (f *wasiFS) file(fd uint32) (*wasiFile, int32) {
+	file, ok := f.files[fd]
+	if !ok {
+		return nil, wasiErrnoBadf
+	}
+	return file, wasiErrnoSuccess
+}
+
+// check returns EBADF unless fd is open.
+func (f *wasiFS) check(fd uint32) int32 {
+	if fd <= 2 {
+		return wasiErrnoSuccess
+	}
+	_, errno := f.file(fd)
+	return errno
+}
+
+// resolve returns the name in the file system of dirfd of the guest path p relative to it.
+func (f *wasiFS) resolve(dirfd uint32, p string) (*wasiFile, string, int32) {
+	dir, errno := f.file(dirfd)
+	if errno != wasiErrnoSuccess {
+		return nil, "", errno
+	}
+	if !dir.dir {
+		return nil, "", wasiErrnoNotdir
+	}
+	// paths stay inside the directory of dirfd, as in other WASI runtimes
+	p = path.Clean(p)
+	if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return nil, "", wasiErrnoNotcapable
+	}
+	name := path.Join(dir.name, p)
+	if !fs.ValidPath(name) {
+		return nil, "", wasiErrnoNotcapable
+	}
+	return dir, name, wasiErrnoSuccess
+}
+
+func (f *wasiFS) writable(dir *wasiFile) (WritableFS, int32) {
+	wfs, ok := dir.fsys.(WritableFS)
+	if !ok {
+		return nil, wasiErrnoRofs
+	}
+	return wfs, wasiErrnoSuccess
+}
+
+func (f *wasiFS) read(fd uint32, bufs [][]byte) (uint32, int32) {
+	var r io.Reader
+	if fd == 0 {
+		r = f.streams().reader(0)
+	} else {
+		file, errno := f.file(fd)
+		if errno != wasiErrnoSuccess {
+			return 0, errno
+		}
+		if file.dir {
+			return 0, wasiErrnoIsdir
+		}
+		r = file.file
+	}
+	total := uint32(0)
+	for _, buf := range bufs {
+		n, err := r.Read(buf)
+		total += uint32(n)
+		if err == io.EOF || (err == nil && n < len(buf)) {
+			break
+		}
+		if err != nil {
+			return total, wasiErrno(err)
+		}
+	}
+	return total, wasiErrnoSuccess
+}
+
+func (f *wasiFS) write(fd uint32, bufs [][]byte) (uint32, int32) {
+	var w io.Writer
+	if fd == 1 || fd == 2 {
+		w = f.streams().writer(int64(fd))
+	} else {
+		file, errno := f.file(fd)
+		if errno != wasiErrnoSuccess {
+			return 0, errno
+		}
+		if file.dir {
+			return 0, wasiErrnoIsdir
+		}
+		var ok bool
+		if w, ok = file.file.(io.Writer); !ok {
+			return 0, wasiErrnoBadf
+		}
+	}
+	total := uint32(0)
+	for _, buf := range bufs {
+		n, err := w.Write(buf)
+		total += uint32(n)
+		if err != nil {
+			return total, wasiErrno(err)
+		}
+	}
+	return total, wasiErrnoSuccess
+}
+
+func (f *wasiFS) stat(fd uint32) (fs.FileInfo, int32) {
+	file, errno := f.file(fd)
+	if errno != wasiErrnoSuccess {
+		return nil, errno
+	}
+	var info fs.FileInfo
+	var err error
+	if file.file != nil {
+		info, err = file.file.Stat()
+	} else {
+		info, err = fs.Stat(file.fsys, file.name)
+	}
+	if err != nil {
+		return nil, wasiErrno(err)
+	}
+	return info, wasiErrnoSuccess
+}
+
+func (f *wasiFS) open(dirfd uint32, p string, oflags uint32, rights uint64, fdflags uint32) (uint32, int32) {
+	dir, name, errno := f.resolve(dirfd, p)
+	if errno != wasiErrnoSuccess {
+		return 0, errno
+	}
+
+	write := rights&wasiRightFdWrite != 0
+	if write || oflags&(wasiOflagCreat|wasiOflagTrunc) != 0 {
+		wfs, errno := f.writable(dir)
+		if errno != wasiErrnoSuccess {
+			return 0, errno
+		}
+		flag := os.O_WRONLY
+		if rights&wasiRightFdRead != 0 {
+			flag = os.O_RDWR
+		}
+		if oflags&wasiOflagCreat != 0 {
+			flag |= os.O_CREATE
+		}
+		if oflags&wasiOflagExcl != 0 {
+			flag |= os.O_EXCL
+		}
+		if oflags&wasiOflagTrunc != 0 {
+			flag |= os.O_TRUNC
+		}
+		if fdflags&wasiFdflagAppend != 0 {
+			flag |= os.O_APPEND
+		}
+		file, err := wfs.OpenFile(name, flag, 0666)
+		if err != nil {
+			return 0, wasiErrno(err)
+		}
+		return f.add(&wasiFile{fsys: dir.fsys, name: name, file: file}), wasiErrnoSuccess
+	}
+
+	info, err := fs.Stat(dir.fsys, name)
+	if err != nil {
+		return 0, wasiErrno(err)
+	}
+	if info.IsDir() {
+		return f.add(&wasiFile{fsys: dir.fsys, name: name, dir: true}), wasiErrnoSuccess
+	}
+	if oflags&wasiOflagDirectory != 0 {
+		return 0, wasiErrnoNotdir
+	}
+	file, err := dir.fsys.Open(name)
+	if err != nil {
+		return 0, wasiErrno(err)
+	}
+	return f.add(&wasiFile{fsys: dir.fsys, name: name, file: file}), wasiErrnoSuccess
+}
+
+// readdir writes the entries of fd starting at cookie to buf, as dirent structures followed by their names.
+func (f *wasiFS) readdir(m wasiMemory, fd uint32, buf, bufLen uint32, cookie uint64) (uint32, int32) {
+	file, errno := f.file(fd)
+	if errno != wasiErrnoSuccess {
+		return 0, errno
+	}
+	if !file.dir {
+		return 0, wasiErrnoNotdir
+	}
+	if cookie == 0 || file.entries == nil {
+		entries, err := fs.ReadDir(file.fsys, file.name)
+		if err != nil {
+			return 0, wasiErrno(err)
+		}
+		file.entries = entries
+	}
+
+	names := []string{".", ".."}
+	types := []uint8{wasiFiletypeDirectory, wasiFiletypeDirectory}
+	for _, entry := range file.entries {
+		names = append(names, entry.Name())
+		types = append(types, wasiFiletype(entry.Type()))
+	}
+
+	out := m.write(buf, bufLen)
+	used := uint32(0)
+	for i := cookie; i < uint64(len(names)) && used < bufLen; i++ {
+		// entries that do not fit are truncated, the guest retries with a larger buffer
+		var dirent [24]byte
+		binary.LittleEndian.PutUint64(dirent[0:], i+1)
+		binary.LittleEndian.PutUint32(dirent[16:], uint32(len(names[i])))
+		dirent[20] = types[i]
+		used += uint32(copy(out[used:], dirent[:]))
+		used += uint32(copy(out[used:], names[i]))
+	}
+	return used, wasiErrnoSuccess
+}
+
+// functions returns the functions of wasi_snapshot_preview1 taking file descriptors.
+// poll_oneoff waits for clocks with sys.
+func (f *wasiFS) functions(store *wasmer.Store, sys WASISystem) map[string]wasmer.IntoExtern {
+	i32, i64 := wasmer.I32, wasmer.I64
+	fn := func(params []wasmer.ValueKind, impl func(m wasiMemory, args []wasmer.Value) int32) wasmer.IntoExtern {
+		return wasiFunction(store, f.memory, params, impl)
+	}
+	params := func(kinds ...wasmer.ValueKind) []wasmer.ValueKind {
+		return kinds
+	}
+	// no file descriptor is a socket
+	notsock := func(m wasiMemory, args []wasmer.Value) int32 {
+		if errno := f.check(u32(args[0])); errno != wasiErrnoSuccess {
+			return errno
+		}
+		return wasiErrnoNotsock
+	}
+
+	return map[string]wasmer.IntoExtern{
+		"fd_advise": fn(params(i32, i64, i64, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			_, errno := f.stat(u32(args[0]))
+			return errno
+		}),
+		"fd_allocate": fn(params(i32, i64, i64), func(m wasiMemory, args []wasmer.Value) int32 {
+			return wasiErrnoNotsup
+		}),
+		"fd_close": fn(params(i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			fd := u32(args[0])
+			file, errno := f.file(fd)
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			delete(f.files, fd)
+			if file.file != nil {
+				return wasiErrno(file.file.Close())
+			}
+			return wasiErrnoSuccess
+		}),
+		"fd_datasync": fn(params(i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return f.sync(u32(args[0]))
+		}),
+		"fd_sync": fn(params(i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return f.sync(u32(args[0]))
+		}),
+		"fd_fdstat_get": fn(params(i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			fd, buf := u32(args[0]), u32(args[1])
+			m.slice(buf, 24)
+			if fd <= 2 {
+				m.putUint8(buf, wasiFiletypeCharacterDevice)
+			} else {
+				info, errno := f.stat(fd)
+				if errno != wasiErrnoSuccess {
+					return errno
+				}
+				m.putUint8(buf, wasiFiletype(info.Mode()))
+			}
+			m.putUint16(buf+2, 0)
+			// rights are not enforced, all of them are reported
+			m.putUint64(buf+8, ^uint64(0))
+			m.putUint64(buf+16, ^uint64(0))
+			return wasiErrnoSuccess
+		}),
+		"fd_fdstat_set_flags": fn(params(i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			if errno := f.check(u32(args[0])); errno != wasiErrnoSuccess {
+				return errno
+			}
+			return wasiErrnoNotsup
+		}),
+		"fd_fdstat_set_rights": fn(params(i32, i64, i64), func(m wasiMemory, args []wasmer.Value) int32 {
+			// rights are not enforced, see fd_fdstat_get
+			return f.check(u32(args[0]))
+		}),
+		"fd_filestat_get": fn(params(i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			fd, buf := u32(args[0]), u32(args[1])
+			if fd <= 2 {
+				m.slice(buf, 64)
+				for i := uint32(0); i < 64; i++ {
+					m.putUint8(buf+i, 0)
+				}
+				m.putUint8(buf+16, wasiFiletypeCharacterDevice)
+				return wasiErrnoSuccess
+			}
+			info, errno := f.stat(fd)
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			m.putFilestat(buf, info)
+			return wasiErrnoSuccess
+		}),
+		"fd_filestat_set_size": fn(params(i32, i64), func(m wasiMemory, args []wasmer.Value) int32 {
+			file, errno := f.file(u32(args[0]))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			t, ok := file.file.(interface{ Truncate(int64) error })
+			if !ok {
+				return wasiErrnoNotsup
+			}
+			return wasiErrno(t.Truncate(args[1].I64()))
+		}),
+		"fd_filestat_set_times": fn(params(i32, i64, i64, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return wasiErrnoNotsup
+		}),
+		"fd_pread": fn(params(i32, i32, i32, i64, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			file, errno := f.file(u32(args[0]))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			r, ok := file.file.(io.ReaderAt)
+			if !ok {
+				return wasiErrnoSpipe
+			}
+			offset := args[3].I64()
+			total := uint32(0)
+			for _, buf := range m.writeIovecs(u32(args[1]), u32(args[2])) {
+				n, err := r.ReadAt(buf, offset)
+				total += uint32(n)
+				offset += int64(n)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return wasiErrno(err)
+				}
+			}
+			m.putUint32(u32(args[4]), total)
+			return wasiErrnoSuccess
+		}),
+		"fd_prestat_get": fn(params(i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			file, ok := f.files[u32(args[0])]
+			if !ok || file.preopen == "" {
+				return wasiErrnoBadf
+			}
+			buf := u32(args[1])
+			m.putUint32(buf, 0)
+			m.putUint32(buf+4, uint32(len(file.preopen)))
+			return wasiErrnoSuccess
+		}),
+		"fd_prestat_dir_name": fn(params(i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			file, ok := f.files[u32(args[0])]
+			if !ok || file.preopen == "" {
+				return wasiErrnoBadf
+			}
+			copy(m.write(u32(args[1]), u32(args[2])), file.preopen)
+			return wasiErrnoSuccess
+		}),
+		"fd_pwrite": fn(params(i32, i32, i32, i64, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			file, errno := f.file(u32(args[0]))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			w, ok := file.file.(io.WriterAt)
+			if !ok {
+				return wasiErrnoSpipe
+			}
+			offset := args[3].I64()
+			total := uint32(0)
+			for _, buf := range m.readIovecs(u32(args[1]), u32(args[2])) {
+				n, err := w.WriteAt(buf, offset)
+				total += uint32(n)
+				offset += int64(n)
+				if err != nil {
+					return wasiErrno(err)
+				}
+			}
+			m.putUint32(u32(args[4]), total)
+			return wasiErrnoSuccess
+		}),
+		"fd_read": fn(params(i32, i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			n, errno := f.read(u32(args[0]), m.writeIovecs(u32(args[1]), u32(args[2])))
+			m.putUint32(u32(args[3]), n)
+			return errno
+		}),
+		"fd_readdir": fn(params(i32, i32, i32, i64, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			used, errno := f.readdir(m, u32(args[0]), u32(args[1]), u32(args[2]), uint64(args[3].I64()))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			m.putUint32(u32(args[4]), used)
+			return wasiErrnoSuccess
+		}),
+		"fd_renumber": fn(params(i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			from, to := u32(args[0]), u32(args[1])
+			file, errno := f.file(from)
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			old, errno := f.file(to)
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			if old.file != nil {
+				old.file.Close()
+			}
+			f.files[to] = file
+			delete(f.files, from)
+			return wasiErrnoSuccess
+		}),
+		"fd_seek": fn(params(i32, i64, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			pos, errno := f.seek(u32(args[0]), args[1].I64(), int(args[2].I32()))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			m.putUint64(u32(args[3]), uint64(pos))
+			return wasiErrnoSuccess
+		}),
+		"fd_tell": fn(params(i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			pos, errno := f.seek(u32(args[0]), 0, io.SeekCurrent)
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			m.putUint64(u32(args[1]), uint64(pos))
+			return wasiErrnoSuccess
+		}),
+		"fd_write": fn(params(i32, i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			n, errno := f.write(u32(args[0]), m.readIovecs(u32(args[1]), u32(args[2])))
+			m.putUint32(u32(args[3]), n)
+			return errno
+		}),
+		"path_create_directory": fn(params(i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			dir, name, errno := f.resolve(u32(args[0]), m.string(u32(args[1]), u32(args[2])))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			wfs, errno := f.writable(dir)
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			return wasiErrno(wfs.Mkdir(name, 0777))
+		}),
+		"path_filestat_get": fn(params(i32, i32, i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			dir, name, errno := f.resolve(u32(args[0]), m.string(u32(args[2]), u32(args[3])))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			info, err := fs.Stat(dir.fsys, name)
+			if err != nil {
+				return wasiErrno(err)
+			}
+			m.putFilestat(u32(args[4]), info)
+			return wasiErrnoSuccess
+		}),
+		"path_filestat_set_times": fn(params(i32, i32, i32, i32, i64, i64, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return wasiErrnoNotsup
+		}),
+		"path_link": fn(params(i32, i32, i32, i32, i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return wasiErrnoNotsup
+		}),
+		"path_open": fn(params(i32, i32, i32, i32, i32, i64, i64, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			p := m.string(u32(args[2]), u32(args[3]))
+			fd, errno := f.open(u32(args[0]), p, u32(args[4]), uint64(args[5].I64()), u32(args[7]))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			m.putUint32(u32(args[8]), fd)
+			return wasiErrnoSuccess
+		}),
+		"path_readlink": fn(params(i32, i32, i32, i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return wasiErrnoInval
+		}),
+		"path_remove_directory": fn(params(i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return f.remove(u32(args[0]), m.string(u32(args[1]), u32(args[2])), true)
+		}),
+		"path_rename": fn(params(i32, i32, i32, i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			dir, oldname, errno := f.resolve(u32(args[0]), m.string(u32(args[1]), u32(args[2])))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			newdir, newname, errno := f.resolve(u32(args[3]), m.string(u32(args[4]), u32(args[5])))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			if dir.fsys != newdir.fsys {
+				return wasiErrnoXdev
+			}
+			wfs, errno := f.writable(dir)
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			return wasiErrno(wfs.Rename(oldname, newname))
+		}),
+		"path_symlink": fn(params(i32, i32, i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return wasiErrnoNotsup
+		}),
+		"path_unlink_file": fn(params(i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return f.remove(u32(args[0]), m.string(u32(args[1]), u32(args[2])), false)
+		}),
+		"poll_oneoff": fn(params(i32, i32, i32, i32), func(m wasiMemory, args []wasmer.Value) int32 {
+			return f.pollOneoff(m, u32(args[0]), u32(args[1]), u32(args[2]), u32(args[3]), sys)
+		}),
+		"sock_accept":   fn(params(i32, i32, i32), notsock),
+		"sock_recv":     fn(params(i32, i32, i32, i32, i32, i32), notsock),
+		"sock_send":     fn(params(i32, i32, i32, i32, i32), notsock),
+		"sock_shutdown": fn(params(i32, i32), notsock),
+	}
+}
+
+func (f *wasiFS) sync(fd uint32) int32 {
+	file, errno := f.file(fd)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+	if s, ok := file.file.(interface{ Sync() error }); ok {
+		return wasiErrno(s.Sync())
+	}
+	return wasiErrnoSuccess
+}
+
+func (f *wasiFS) seek(fd uint32, offset int64, whence int) (int64, int32) {
+	if fd <= 2 {
+		return 0, wasiErrnoSpipe
+	}
+	file, errno := f.file(fd)
+	if errno != wasiErrnoSuccess {
+		return 0, errno
+	}
+	if file.dir {
+		return 0, wasiErrnoIsdir
+	}
+	s, ok := file.file.(io.Seeker)
+	if !ok {
+		return 0, wasiErrnoSpipe
+	}
+	pos, err := s.Seek(offset, whence)
+	if err != nil {
+		return 0, wasiErrno(err)
+	}
+	return pos, wasiErrnoSuccess
+}
+
+// remove removes the directory or the file at p.
+func (f *wasiFS) remove(dirfd uint32, p string, directory bool) int32 {
+	dir, name, errno := f.resolve(dirfd, p)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+	wfs, errno := f.writable(dir)
+	if errno != wasiErrnoSuccess {
+		return errno
+	}
+	info, err := fs.Stat(dir.fsys, name)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	if directory && !info.IsDir() {
+		return wasiErrnoNotdir
+	}
+	if !directory && info.IsDir() {
+		return wasiErrnoIsdir
+	}
+	return wasiErrno(wfs.Remove(name))
+}
+
+// wasiPreopens returns the file systems of preopens sorted by guest path.
+func wasiPreopens(preopens map[string]fs.FS) []wasiPreopen {
+	list := make([]wasiPreopen, 0, len(preopens))
+	for guest, fsys := range preopens {
+		list = append(list, wasiPreopen{guest: guest, fsys: fsys})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Compare(list[i].guest, list[j].guest) < 0
+	})
+	return list
+}
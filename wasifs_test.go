@@ -0,0 +1,286 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+var wasiTestFS = fstest.MapFS{
+	"a/b.txt": {Data: []byte("hello"), Mode: 0644, ModTime: time.Unix(1000, 0)},
+	"c.txt":   {Data: []byte("c")},
+}
+
+// wasiTest calls the functions of a wasiFS on its own memory.
+type wasiTest struct {
+	*testing.T
+	fs    *wasiFS
+	funcs map[string]wasmer.IntoExtern
+	mem   []byte
+}
+
+func newWasiTest(t *testing.T, fsys fs.FS) *wasiTest {
+	w := &wasiTest{T: t, mem: make([]byte, pageSize)}
+	w.fs = newWasiFS(func() *stdio { return &stdio{} }, &memoryTrace{data: func() []byte { return w.mem }}, []wasiPreopen{{guest: "/data", fsys: fsys}})
+	w.funcs = w.fs.functions(helperStore(), WASISystem{}.withDefaults())
+	return w
+}
+
+// call calls the function name with args, int64 values passed as i64 and others as i32.
+func (w *wasiTest) call(name string, args ...interface{}) int32 {
+	w.Helper()
+	values := make([]wasmer.Value, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case int64:
+			values[i] = wasmer.NewI64(arg)
+		case int:
+			values[i] = wasmer.NewI32(int32(arg))
+		}
+	}
+	results, err := w.funcs[name].(*hostFunction).fn(values)
+	if err != nil {
+		w.Fatalf("%s: %v", name, err)
+	}
+	return results[0].I32()
+}
+
+// path writes p to the memory and returns its address and length.
+func (w *wasiTest) path(p string) (int, int) {
+	copy(w.mem[1024:], p)
+	return 1024, len(p)
+}
+
+// open opens p relative to dirfd and returns its file descriptor.
+func (w *wasiTest) open(dirfd int, p string, oflags int, rights int64) (int, int32) {
+	ptr, l := w.path(p)
+	errno := w.call("path_open", dirfd, 0, ptr, l, oflags, rights, int64(0), 0, 0)
+	return int(binary.LittleEndian.Uint32(w.mem[0:])), errno
+}
+
+func TestWasiResolve(t *testing.T) {
+	w := newWasiTest(t, wasiTestFS)
+	dir, errno := w.open(3, "a", wasiOflagDirectory, 0)
+	if errno != wasiErrnoSuccess {
+		t.Fatalf("open a: %d", errno)
+	}
+	file, errno := w.open(3, "c.txt", 0, wasiRightFdRead)
+	if errno != wasiErrnoSuccess {
+		t.Fatalf("open c.txt: %d", errno)
+	}
+	for _, c := range []struct {
+		dirfd int
+		path  string
+		name  string
+		errno int32
+	}{
+		{3, "a/b.txt", "a/b.txt", wasiErrnoSuccess},
+		{3, "./a//b.txt", "a/b.txt", wasiErrnoSuccess},
+		{3, "a/../c.txt", "c.txt", wasiErrnoSuccess},
+		{3, ".", ".", wasiErrnoSuccess},
+		{3, "..", "", wasiErrnoNotcapable},
+		{3, "a/../../c.txt", "", wasiErrnoNotcapable},
+		{3, "/c.txt", "", wasiErrnoNotcapable},
+		{dir, "b.txt", "a/b.txt", wasiErrnoSuccess},
+		{dir, "../c.txt", "", wasiErrnoNotcapable},
+		{file, "x", "", wasiErrnoNotdir},
+		{42, "x", "", wasiErrnoBadf},
+	} {
+		_, name, errno := w.fs.resolve(uint32(c.dirfd), c.path)
+		if name != c.name || errno != c.errno {
+			t.Errorf("resolve(%d, %q) = %q, %d, want %q, %d", c.dirfd, c.path, name, errno, c.name, c.errno)
+		}
+	}
+	if _, errno := w.open(3, "a/../../c.txt", 0, wasiRightFdRead); errno != wasiErrnoNotcapable {
+		t.Errorf("path_open escaping the preopen: got %d, want %d", errno, wasiErrnoNotcapable)
+	}
+}
+
+func TestWasiLayouts(t *testing.T) {
+	w := newWasiTest(t, wasiTestFS)
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(w.mem[off:]) }
+	u64 := func(off int) uint64 { return binary.LittleEndian.Uint64(w.mem[off:]) }
+
+	// prestat: tag u8, name length u32 at 4
+	if errno := w.call("fd_prestat_get", 3, 64); errno != wasiErrnoSuccess || w.mem[64] != 0 || u32(68) != 5 {
+		t.Errorf("fd_prestat_get: %d, % x", errno, w.mem[64:72])
+	}
+	if errno := w.call("fd_prestat_dir_name", 3, 128, 5); errno != wasiErrnoSuccess || string(w.mem[128:133]) != "/data" {
+		t.Errorf("fd_prestat_dir_name: %d, %q", errno, w.mem[128:133])
+	}
+	if errno := w.call("fd_prestat_get", 4, 64); errno != wasiErrnoBadf {
+		t.Errorf("fd_prestat_get of a closed fd: %d", errno)
+	}
+
+	fd, errno := w.open(3, "a/b.txt", 0, wasiRightFdRead)
+	if errno != wasiErrnoSuccess {
+		t.Fatalf("open: %d", errno)
+	}
+	// fdstat: filetype u8, flags u16 at 2, rights u64 at 8 and 16
+	if errno := w.call("fd_fdstat_get", fd, 256); errno != wasiErrnoSuccess || w.mem[256] != wasiFiletypeRegularFile || u64(264) != ^uint64(0) {
+		t.Errorf("fd_fdstat_get: %d, % x", errno, w.mem[256:280])
+	}
+	// filestat: dev, ino, filetype u8 at 16, nlink at 24, size at 32, then atim, mtim and ctim
+	if errno := w.call("fd_filestat_get", fd, 512); errno != wasiErrnoSuccess {
+		t.Fatalf("fd_filestat_get: %d", errno)
+	}
+	mtime := uint64(time.Unix(1000, 0).UnixNano())
+	if w.mem[512+16] != wasiFiletypeRegularFile || u64(512+24) != 1 || u64(512+32) != 5 || u64(512+48) != mtime {
+		t.Errorf("filestat is % x", w.mem[512:576])
+	}
+
+	// dirents: next cookie u64, inode u64 at 8, name length u32 at 16, type u8 at 20, then the name
+	dir, _ := w.open(3, "a", wasiOflagDirectory, 0)
+	if errno := w.call("fd_readdir", dir, 2048, 256, int64(0), 0); errno != wasiErrnoSuccess {
+		t.Fatalf("fd_readdir: %d", errno)
+	}
+	off := 2048
+	for i, want := range []struct {
+		name string
+		typ  uint8
+	}{{".", wasiFiletypeDirectory}, {"..", wasiFiletypeDirectory}, {"b.txt", wasiFiletypeRegularFile}} {
+		n := int(u32(off + 16))
+		if u64(off) != uint64(i+1) || w.mem[off+20] != want.typ || string(w.mem[off+24:off+24+n]) != want.name {
+			t.Errorf("dirent %d is % x", i, w.mem[off:off+24+n])
+		}
+		off += 24 + n
+	}
+	if used := u32(0); int(used) != off-2048 {
+		t.Errorf("fd_readdir used %d bytes, want %d", used, off-2048)
+	}
+
+	if errno := w.call("fd_filestat_get", fd, pageSize-8); errno != wasiErrnoFault {
+		t.Errorf("fd_filestat_get past the memory: got %d, want %d", errno, wasiErrnoFault)
+	}
+}
+
+func TestWasiWritable(t *testing.T) {
+	// read-only file systems
+	w := newWasiTest(t, wasiTestFS)
+	for _, c := range []struct {
+		path   string
+		oflags int
+		rights int64
+	}{
+		{"c.txt", 0, wasiRightFdWrite},
+		{"new.txt", wasiOflagCreat, 0},
+		{"c.txt", wasiOflagTrunc, wasiRightFdRead},
+	} {
+		if _, errno := w.open(3, c.path, c.oflags, c.rights); errno != wasiErrnoRofs {
+			t.Errorf("open %s with oflags %d and rights %d: got %d, want %d", c.path, c.oflags, c.rights, errno, wasiErrnoRofs)
+		}
+	}
+	ptr, l := w.path("d")
+	if errno := w.call("path_create_directory", 3, ptr, l); errno != wasiErrnoRofs {
+		t.Errorf("path_create_directory: got %d, want %d", errno, wasiErrnoRofs)
+	}
+
+	dir := t.TempDir()
+	w = newWasiTest(t, DirFS(dir))
+	fd, errno := w.open(3, "new.txt", wasiOflagCreat, wasiRightFdWrite)
+	if errno != wasiErrnoSuccess {
+		t.Fatalf("open: %d", errno)
+	}
+	// one iovec at 64 pointing to the data at 128
+	copy(w.mem[128:], "written")
+	binary.LittleEndian.PutUint32(w.mem[64:], 128)
+	binary.LittleEndian.PutUint32(w.mem[68:], 7)
+	if errno := w.call("fd_write", fd, 64, 1, 0); errno != wasiErrnoSuccess || binary.LittleEndian.Uint32(w.mem) != 7 {
+		t.Fatalf("fd_write: %d", errno)
+	}
+	if errno := w.call("fd_close", fd); errno != wasiErrnoSuccess {
+		t.Fatalf("fd_close: %d", errno)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "new.txt")); err != nil || string(b) != "written" {
+		t.Errorf("file holds %q, %v", b, err)
+	}
+	ptr, l = w.path("d")
+	if errno := w.call("path_create_directory", 3, ptr, l); errno != wasiErrnoSuccess {
+		t.Errorf("path_create_directory: %d", errno)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "d")); err != nil || !info.IsDir() {
+		t.Errorf("directory was not created: %v", err)
+	}
+}
+
+func TestWasiFdSurface(t *testing.T) {
+	w := newWasiTest(t, wasiTestFS)
+	// the functions of wasi_snapshot_preview1 taking file descriptors, which wasmer's WASI must not see
+	for _, name := range []string{
+		"fd_advise", "fd_allocate", "fd_close", "fd_datasync", "fd_fdstat_get", "fd_fdstat_set_flags",
+		"fd_fdstat_set_rights", "fd_filestat_get", "fd_filestat_set_size", "fd_filestat_set_times",
+		"fd_pread", "fd_prestat_get", "fd_prestat_dir_name", "fd_pwrite", "fd_read", "fd_readdir",
+		"fd_renumber", "fd_seek", "fd_sync", "fd_tell", "fd_write", "path_create_directory",
+		"path_filestat_get", "path_filestat_set_times", "path_link", "path_open", "path_readlink",
+		"path_remove_directory", "path_rename", "path_symlink", "path_unlink_file", "poll_oneoff",
+		"sock_accept", "sock_recv", "sock_send", "sock_shutdown",
+	} {
+		if w.funcs[name] == nil {
+			t.Errorf("%s is not implemented", name)
+		}
+	}
+
+	for _, c := range []struct {
+		name  string
+		args  []interface{}
+		errno int32
+	}{
+		{"fd_fdstat_set_rights", []interface{}{3, int64(0), int64(0)}, wasiErrnoSuccess},
+		{"fd_fdstat_set_rights", []interface{}{42, int64(0), int64(0)}, wasiErrnoBadf},
+		{"fd_fdstat_set_flags", []interface{}{1, 0}, wasiErrnoNotsup},
+		{"fd_fdstat_set_flags", []interface{}{42, 0}, wasiErrnoBadf},
+		{"sock_shutdown", []interface{}{3, 0}, wasiErrnoNotsock},
+		{"sock_send", []interface{}{1, 0, 0, 0, 0}, wasiErrnoNotsock},
+		{"sock_recv", []interface{}{42, 0, 0, 0, 0, 0}, wasiErrnoBadf},
+	} {
+		if errno := w.call(c.name, c.args...); errno != c.errno {
+			t.Errorf("%s%v: got %d, want %d", c.name, c.args, errno, c.errno)
+		}
+	}
+
+	// subscriptions: userdata u64, tag u8 at 8, fd u32 at 16; events: userdata u64, errno u16 at 8
+	for i, fd := range []uint32{3, 42} {
+		sub := w.mem[4096+i*48:]
+		binary.LittleEndian.PutUint64(sub, uint64(i))
+		sub[8] = wasiEventtypeFdRead
+		binary.LittleEndian.PutUint32(sub[16:], fd)
+	}
+	if errno := w.call("poll_oneoff", 4096, 8192, 2, 0); errno != wasiErrnoSuccess || binary.LittleEndian.Uint32(w.mem) != 2 {
+		t.Fatalf("poll_oneoff: %d, %d events", errno, binary.LittleEndian.Uint32(w.mem))
+	}
+	for i, want := range []uint16{wasiErrnoSuccess, wasiErrnoBadf} {
+		if errno := binary.LittleEndian.Uint16(w.mem[8192+i*32+8:]); errno != want {
+			t.Errorf("event of fd subscription %d: got errno %d, want %d", i, errno, want)
+		}
+	}
+}
+
+func TestWasiFdSurfaceOnWasmer(t *testing.T) {
+	// the program polls the preopen, fd 3, and exits with the errno of the event
+	vm := newWASIRuntime(t, `(module
+	  (import "wasi_snapshot_preview1" "poll_oneoff" (func $poll (param i32 i32 i32 i32) (result i32)))
+	  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+	  (memory (export "memory") 1)
+	  (data (i32.const 8) "\01")
+	  (data (i32.const 16) "\03")
+	  (func (export "_start")
+	    (drop (call $poll (i32.const 0) (i32.const 64) (i32.const 1) (i32.const 128)))
+	    (call $exit (i32.load16_u (i32.const 72)))))`)
+	vm.Set("dataFS", wasiTestFS)
+	v, err := vm.RunString(`
+	  const wasi = new WASI({preopens: {"/data": dataFS}});
+	  wasi.start(new WebAssembly.Instance(new WebAssembly.Module(bytes), wasi.getImportObject()));
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ToInteger() != wasiErrnoSuccess {
+		t.Errorf("polling the preopen failed with errno %d", v.ToInteger())
+	}
+}
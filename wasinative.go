@@ -0,0 +1,241 @@
+package wasm
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// WASI clock ids.
+const (
+	wasiClockRealtime         = 0
+	wasiClockMonotonic        = 1
+	wasiClockProcessCputimeID = 2
+	wasiClockThreadCputimeID  = 3
+)
+
+// WASI poll_oneoff event types.
+const (
+	wasiEventtypeClock   = 0
+	wasiEventtypeFdRead  = 1
+	wasiEventtypeFdWrite = 2
+
+	wasiSubclockflagAbstime = 1
+)
+
+// WASISystem provides the system resources of the native WASI implementation.
+// Nil fields use the resources of the host.
+type WASISystem struct {
+	// Walltime returns the time of the realtime clock.
+	Walltime func() time.Time
+	// Nanotime returns the time of the monotonic clock.
+	Nanotime func() time.Duration
+	// Sleep blocks the guest while it polls for clock events.
+	Sleep func(d time.Duration)
+	// Random is the source of random_get.
+	Random io.Reader
+	// Exit is called when the guest calls proc_exit.
+	Exit func(code int32)
+}
+
+func (s WASISystem) withDefaults() WASISystem {
+	if s.Walltime == nil {
+		s.Walltime = time.Now
+	}
+	if s.Nanotime == nil {
+		start := time.Now()
+		s.Nanotime = func() time.Duration {
+			return time.Since(start)
+		}
+	}
+	if s.Sleep == nil {
+		s.Sleep = time.Sleep
+	}
+	if s.Random == nil {
+		s.Random = rand.Reader
+	}
+	return s
+}
+
+// now returns the time of the clock with the given id in nanoseconds.
+func (s WASISystem) now(id uint32) (uint64, int32) {
+	switch id {
+	case wasiClockRealtime:
+		return uint64(s.Walltime().UnixNano()), wasiErrnoSuccess
+	case wasiClockMonotonic, wasiClockProcessCputimeID, wasiClockThreadCputimeID:
+		return uint64(s.Nanotime()), wasiErrnoSuccess
+	}
+	return 0, wasiErrnoInval
+}
+
+// wasiRuntime returns the functions of wasi_snapshot_preview1 implemented in Go.
+// File descriptors are served by the wasiFS of the instance.
+func wasiRuntime(store *wasmer.Store, instance *WasmInstance, sys WASISystem, args, env []string) map[string]wasmer.IntoExtern {
+	i32, i64 := wasmer.I32, wasmer.I64
+	fn := func(params []wasmer.ValueKind, impl func(m wasiMemory, args []wasmer.Value) int32) wasmer.IntoExtern {
+		return wasiFunction(store, instance.tracedMemory(), params, impl)
+	}
+	params := func(kinds ...wasmer.ValueKind) []wasmer.ValueKind {
+		return kinds
+	}
+	notsup := func(m wasiMemory, args []wasmer.Value) int32 {
+		return wasiErrnoNotsup
+	}
+
+	funcs := instance.wasiFS.functions(store, sys)
+	for name, f := range map[string]wasmer.IntoExtern{
+		"args_get": fn(params(i32, i32), func(m wasiMemory, a []wasmer.Value) int32 {
+			m.putStrings(u32(a[0]), u32(a[1]), args)
+			return wasiErrnoSuccess
+		}),
+		"args_sizes_get": fn(params(i32, i32), func(m wasiMemory, a []wasmer.Value) int32 {
+			m.putUint32(u32(a[0]), uint32(len(args)))
+			m.putUint32(u32(a[1]), stringsSize(args))
+			return wasiErrnoSuccess
+		}),
+		"environ_get": fn(params(i32, i32), func(m wasiMemory, a []wasmer.Value) int32 {
+			m.putStrings(u32(a[0]), u32(a[1]), env)
+			return wasiErrnoSuccess
+		}),
+		"environ_sizes_get": fn(params(i32, i32), func(m wasiMemory, a []wasmer.Value) int32 {
+			m.putUint32(u32(a[0]), uint32(len(env)))
+			m.putUint32(u32(a[1]), stringsSize(env))
+			return wasiErrnoSuccess
+		}),
+		"clock_res_get": fn(params(i32, i32), func(m wasiMemory, a []wasmer.Value) int32 {
+			if _, errno := sys.now(u32(a[0])); errno != wasiErrnoSuccess {
+				return errno
+			}
+			m.putUint64(u32(a[1]), 1)
+			return wasiErrnoSuccess
+		}),
+		"clock_time_get": fn(params(i32, i64, i32), func(m wasiMemory, a []wasmer.Value) int32 {
+			t, errno := sys.now(u32(a[0]))
+			if errno != wasiErrnoSuccess {
+				return errno
+			}
+			m.putUint64(u32(a[2]), t)
+			return wasiErrnoSuccess
+		}),
+		"random_get": fn(params(i32, i32), func(m wasiMemory, a []wasmer.Value) int32 {
+			if _, err := io.ReadFull(sys.Random, m.write(u32(a[0]), u32(a[1]))); err != nil {
+				return wasiErrnoIO
+			}
+			return wasiErrnoSuccess
+		}),
+		"sched_yield": fn(params(), func(m wasiMemory, a []wasmer.Value) int32 {
+			return wasiErrnoSuccess
+		}),
+		"proc_raise": fn(params(i32), notsup),
+		"proc_exit":  instance.wasiProcExit(store, sys.Exit),
+	} {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+// putStrings writes strs as null terminated strings to buf and their addresses to list.
+func (m wasiMemory) putStrings(list, buf uint32, strs []string) {
+	for i, s := range strs {
+		m.putUint32(list+uint32(i)*4, buf)
+		b := m.write(buf, uint32(len(s))+1)
+		copy(b, s)
+		b[len(s)] = 0
+		buf += uint32(len(s)) + 1
+	}
+}
+
+func stringsSize(strs []string) uint32 {
+	size := uint32(0)
+	for _, s := range strs {
+		size += uint32(len(s)) + 1
+	}
+	return size
+}
+
+// pollOneoff waits for the subscriptions at in and writes their events to out.
+// Open file descriptors are always ready, clocks are waited for with sys.Sleep.
+func (f *wasiFS) pollOneoff(m wasiMemory, in, out, nsubscriptions, nevents uint32, sys WASISystem) int32 {
+	if nsubscriptions == 0 {
+		return wasiErrnoInval
+	}
+	m.slice(in, nsubscriptions*48)
+	m.slice(out, nsubscriptions*32)
+
+	type event struct {
+		userdata uint64
+		typ      uint8
+		errno    int32
+		timeout  uint64
+		ready    bool
+	}
+	events := make([]event, 0, nsubscriptions)
+	fdReady := false
+	for i := uint32(0); i < nsubscriptions; i++ {
+		sub := m.read(in+i*48, 48)
+		ev := event{userdata: binary.LittleEndian.Uint64(sub[0:]), typ: sub[8]}
+		switch ev.typ {
+		case wasiEventtypeClock:
+			id := binary.LittleEndian.Uint32(sub[16:])
+			timeout := binary.LittleEndian.Uint64(sub[24:])
+			if binary.LittleEndian.Uint16(sub[40:])&wasiSubclockflagAbstime != 0 {
+				t, errno := sys.now(id)
+				if errno != wasiErrnoSuccess {
+					ev.errno = errno
+				} else if timeout > t {
+					timeout -= t
+				} else {
+					timeout = 0
+				}
+			}
+			ev.timeout = timeout
+			ev.ready = ev.errno != wasiErrnoSuccess
+		case wasiEventtypeFdRead, wasiEventtypeFdWrite:
+			// files and the standard streams are always ready
+			ev.errno = f.check(binary.LittleEndian.Uint32(sub[16:]))
+			fdReady = true
+			ev.ready = true
+		default:
+			ev.errno = wasiErrnoInval
+			ev.ready = true
+		}
+		events = append(events, ev)
+	}
+
+	// without ready file descriptors, wait for the nearest clock
+	if !fdReady {
+		wait := ^uint64(0)
+		for _, ev := range events {
+			if ev.typ == wasiEventtypeClock && ev.errno == wasiErrnoSuccess && ev.timeout < wait {
+				wait = ev.timeout
+			}
+		}
+		if wait != ^uint64(0) && wait > 0 {
+			sys.Sleep(time.Duration(wait))
+		}
+		for i := range events {
+			if events[i].typ == wasiEventtypeClock && events[i].timeout <= wait {
+				events[i].ready = true
+			}
+		}
+	}
+
+	n := uint32(0)
+	for _, ev := range events {
+		if !ev.ready {
+			continue
+		}
+		ptr := out + n*32
+		m.putUint64(ptr, ev.userdata)
+		m.putUint16(ptr+8, uint16(ev.errno))
+		m.putUint8(ptr+10, ev.typ)
+		m.putUint64(ptr+16, 0)
+		m.putUint16(ptr+24, 0)
+		n++
+	}
+	m.putUint32(nevents, n)
+	return wasiErrnoSuccess
+}
@@ -0,0 +1,65 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestWASISystem(t *testing.T) {
+	vm := newWASIRuntime(t, `(module
+	  (import "wasi_snapshot_preview1" "clock_time_get" (func $time (param i32 i64 i32) (result i32)))
+	  (import "wasi_snapshot_preview1" "random_get" (func $random (param i32 i32) (result i32)))
+	  (import "wasi_snapshot_preview1" "poll_oneoff" (func $poll (param i32 i32 i32 i32) (result i32)))
+	  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+	  (memory (export "memory") 1)
+	  ;; a relative clock subscription of 2ms on the monotonic clock
+	  (data (i32.const 128) "\00\00\00\00\00\00\00\00\00\00\00\00\00\00\00\00\01\00\00\00\00\00\00\00\80\84\1e")
+	  (func (export "_start")
+	    (drop (call $time (i32.const 0) (i64.const 1) (i32.const 0)))
+	    (drop (call $time (i32.const 1) (i64.const 1) (i32.const 8)))
+	    (i32.store (i32.const 16) (call $time (i32.const 9) (i64.const 1) (i32.const 24)))
+	    (drop (call $random (i32.const 32) (i32.const 8)))
+	    (drop (call $poll (i32.const 128) (i32.const 256) (i32.const 1) (i32.const 40)))
+	    (call $exit (i32.const 3))))`)
+	w, err := vm.RunString(`new WASI()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slept time.Duration
+	exited := int32(-1)
+	w.Export().(*WASIClass).SetSystem(WASISystem{
+		Walltime: func() time.Time { return time.Unix(100, 0) },
+		Nanotime: func() time.Duration { return 42 },
+		Sleep:    func(d time.Duration) { slept += d },
+		Random:   bytes.NewReader([]byte("entropy!")),
+		Exit:     func(code int32) { exited = code },
+	})
+	vm.Set("wasi", w)
+	v, err := vm.RunString(`
+	  const instance = new WebAssembly.Instance(new WebAssembly.Module(bytes), wasi.getImportObject());
+	  [wasi.start(instance), instance.exports.memory.buffer];
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := v.Export().([]interface{})
+	mem := results[1].([]byte)
+	u64 := func(off int) uint64 { return binary.LittleEndian.Uint64(mem[off:]) }
+	if code := results[0].(int64); code != 3 || exited != 3 {
+		t.Errorf("exit status %d, Exit called with %d, want 3", code, exited)
+	}
+	if u64(0) != uint64(100*time.Second) || u64(8) != 42 {
+		t.Errorf("clocks read %d and %d", u64(0), u64(8))
+	}
+	if errno := binary.LittleEndian.Uint32(mem[16:]); errno != wasiErrnoInval {
+		t.Errorf("unknown clock: got errno %d, want %d", errno, wasiErrnoInval)
+	}
+	if string(mem[32:40]) != "entropy!" {
+		t.Errorf("random_get wrote %q", mem[32:40])
+	}
+	if slept != 2*time.Millisecond || binary.LittleEndian.Uint32(mem[40:]) != 1 {
+		t.Errorf("poll_oneoff slept %v and returned %d events", slept, binary.LittleEndian.Uint32(mem[40:]))
+	}
+}
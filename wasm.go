@@ -12,20 +12,30 @@ import (
 	"github.com/wasmerio/wasmer-go/wasmer"
 )
 
-var engine *wasmer.Engine
-
-func Enable(vm *goja.Runtime) {
-	engine = wasmer.NewEngine()
+func Enable(vm *goja.Runtime, opts ...Option) {
+	cfg := &runtimeConfig{interrupts: &interruptWatch{}, refs: newRefTable()}
+	for _, opt := range opts {
+		opt(cfg)
+	}
 
 	wasmObj := vm.NewObject()
+	wasmObj.DefineDataPropertySymbol(configSymbol, vm.ToValue(cfg), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_FALSE)
 
 	global := vm.GlobalObject()
 	global.DefineDataProperty("WebAssembly", wasmObj, 1, 1, 1)
 
 	wasmObj.Set("Module", func(c goja.ConstructorCall, vm *goja.Runtime) *goja.Object {
-		module := &WasmModule{}
+		b := bufferSourceBytes(vm, c.Argument(0))
+		if b == nil {
+			panic(vm.NewTypeError("WebAssembly.Module: argument 1 must be a buffer source"))
+		}
+		module, err := compile(vm, b)
+		if err != nil {
+			panic(vm.NewTypeError("WebAssembly.Module: " + err.Error()))
+		}
 		obj := vm.NewDynamicObject(module)
 		obj.SetPrototype(c.This.Prototype())
+		module.this = obj
 		return obj
 	})
 
@@ -46,38 +56,91 @@ func Enable(vm *goja.Runtime) {
 		return module.Imports()
 	})
 
-	wasmObj.Set("Instance", func(c goja.ConstructorCall, vm *goja.Runtime) *goja.Object {
-		mod := c.Argument(0).Export()
-		module, ok := mod.(*WasmModule)
-		if !ok {
-			panic(vm.NewTypeError("WebAssembly.Instance: argument 1 must be WebAssembly.Module"))
-		}
-
-		store := module.store
-
-		var importObject *wasmer.ImportObject
-		switch imp := c.Argument(1).Export().(type) {
-
-		case *GoImportObject:
-			importObject = imp.Init(store)
-
-		case map[string]interface{}:
-			importObject = wasmer.NewImportObject()
+	if key := cfg.serialization; len(key) > 0 {
+		module.Set("serialize", func(arg goja.FunctionCall) goja.Value {
+			module, ok := arg.Argument(0).Export().(*WasmModule)
+			if !ok {
+				panic(vm.NewTypeError("WebAssembly.Module.serialize(): argument 1 must be WebAssembly.Module"))
+			}
+			b, err := module.Compiled().Serialize(key)
+			if err != nil {
+				panic(vm.NewTypeError("WebAssembly.Module.serialize(): " + err.Error()))
+			}
+			return vm.ToValue(vm.NewArrayBuffer(b))
+		})
+		module.Set("deserialize", func(arg goja.FunctionCall) goja.Value {
+			b := bufferSourceBytes(vm, arg.Argument(0))
+			if b == nil {
+				panic(vm.NewTypeError("WebAssembly.Module.deserialize(): argument 1 must be a buffer source"))
+			}
+			compiled, err := DeserializeCompiled(b, key)
+			if err != nil {
+				panic(vm.NewTypeError("WebAssembly.Module.deserialize(): " + err.Error()))
+			}
+			return ModuleValue(vm, compiled)
+		})
+	}
 
-		default:
-			builder := wasmer.NewWasiStateBuilder(module.module.Name())
-			im, _ := builder.Finalize()
-			importObject, _ = im.GenerateImportObject(store, module.module)
+	wasmObj.Set("compile", func(arg goja.FunctionCall, vm *goja.Runtime) goja.Value {
+		promise, resolve, reject := vm.NewPromise()
+		b := bufferSourceBytes(vm, arg.Argument(0))
+		if b == nil {
+			reject(vm.NewTypeError("WebAssembly.compile: argument 1 must be a buffer source"))
+			return vm.ToValue(promise)
 		}
-		ins, err := wasmer.NewInstance(module.module, importObject)
+		module, err := compile(vm, b)
+		if err != nil {
+			reject(vm.NewTypeError("WebAssembly.compile: " + err.Error()))
+			return vm.ToValue(promise)
+		}
+		resolve(module.Object())
+		return vm.ToValue(promise)
+	})
 
+	wasmObj.Set("instantiate", func(arg goja.FunctionCall, vm *goja.Runtime) goja.Value {
+		promise, resolve, reject := vm.NewPromise()
+		// a module resolves to its instance, bytes to the compiled module and its instance
+		module, isModule := arg.Argument(0).Export().(*WasmModule)
+		if !isModule {
+			b := bufferSourceBytes(vm, arg.Argument(0))
+			if b == nil {
+				reject(vm.NewTypeError("WebAssembly.instantiate: argument 1 must be a buffer source or WebAssembly.Module"))
+				return vm.ToValue(promise)
+			}
+			var err error
+			if module, err = compile(vm, b); err != nil {
+				reject(vm.NewTypeError("WebAssembly.instantiate: " + err.Error()))
+				return vm.ToValue(promise)
+			}
+		}
+		instance, err := NewInstance(vm, module, arg.Argument(1))
 		if err != nil {
-			panic(vm.NewTypeError("WebAssembly.Instance: " + err.Error()))
+			reject(instantiateError(vm, "WebAssembly.instantiate", err))
+			return vm.ToValue(promise)
 		}
+		if isModule {
+			resolve(instance.Object())
+		} else {
+			result := vm.NewObject()
+			result.Set("module", module.Object())
+			result.Set("instance", instance.Object())
+			resolve(result)
+		}
+		return vm.ToValue(promise)
+	})
+
+	enableStreaming(vm, wasmObj)
+	enableErrors(vm, wasmObj)
+	enableTags(vm, wasmObj)
 
-		instance := &WasmInstance{
-			vm:       vm,
-			instance: ins,
+	wasmObj.Set("Instance", func(c goja.ConstructorCall, vm *goja.Runtime) *goja.Object {
+		module, ok := c.Argument(0).Export().(*WasmModule)
+		if !ok {
+			panic(vm.NewTypeError("WebAssembly.Instance: argument 1 must be WebAssembly.Module"))
+		}
+		instance, err := instantiate(vm, module, c.Argument(1))
+		if err != nil {
+			panic(instantiateError(vm, "WebAssembly.Instance", err))
 		}
 		obj := vm.NewDynamicObject(instance)
 		obj.SetPrototype(c.This.Prototype())
@@ -123,6 +186,14 @@ func Enable(vm *goja.Runtime) {
 						case "f64":
 							glob.kind = wasmer.F64
 							glob.val = float64(0)
+						case "externref":
+							glob.kind = wasmer.AnyRef
+							glob.val = c.Argument(1)
+						case "v128":
+							if !goja.IsUndefined(c.Argument(1)) {
+								panic(vm.NewTypeError("WebAssembly.Global: " + errV128))
+							}
+							glob.v128 = true
 						}
 					}
 				}
@@ -185,11 +256,24 @@ func Enable(vm *goja.Runtime) {
 			}
 		}
 
+		if initial > max {
+			panic(rangeError(vm, "WebAssembly.Memory(): Property 'maximum' must not be smaller than 'initial'"))
+		}
+		var handle *budgetHandle
+		if budget := configOf(vm).memories; budget != nil {
+			var err error
+			handle, err = budget.add(&budgetEntry{bytes: uint64(initial) * pageSize})
+			if err != nil {
+				panic(rangeError(vm, "WebAssembly.Memory(): "+err.Error()))
+			}
+		}
+
 		obj := vm.NewDynamicObject(&WasmMemory{
 			vm:      vm,
 			init:    initial,
 			current: initial,
 			max:     max,
+			handle:  handle,
 		})
 		obj.SetPrototype(c.This.Prototype())
 		return obj
@@ -206,8 +290,10 @@ func Enable(vm *goja.Runtime) {
 
 type WasmModule struct {
 	vm     *goja.Runtime
+	this   *goja.Object
 	module *wasmer.Module
 	store  *wasmer.Store
+	info   *moduleInfo
 
 	exports *goja.Object
 	imports *goja.Object
@@ -215,17 +301,28 @@ type WasmModule struct {
 
 func (w *WasmModule) Exports() *goja.Object {
 	if w.exports == nil {
-		w.exports = w.vm.NewArray(&WasmModuleExports{
+		w.exports = w.vm.NewDynamicArray(&WasmModuleExports{
 			vm:      w.vm,
-			exports: w.module.Exports(),
+			exports: moduleExports(w.module),
 		})
 	}
 	return w.exports
 }
 
+// moduleExports returns the exports of module, without those of the metering middleware.
+func moduleExports(module *wasmer.Module) []*wasmer.ExportType {
+	var exports []*wasmer.ExportType
+	for _, export := range module.Exports() {
+		if !isHiddenExport(export.Name()) {
+			exports = append(exports, export)
+		}
+	}
+	return exports
+}
+
 func (w *WasmModule) Imports() *goja.Object {
 	if w.imports == nil {
-		w.exports = w.vm.NewArray(&WasmModuleImports{
+		w.imports = w.vm.NewDynamicArray(&WasmModuleImports{
 			vm:      w.vm,
 			imports: w.module.Imports(),
 		})
@@ -239,7 +336,9 @@ func (w *WasmModule) Get(key string) goja.Value {
 	return goja.Undefined()
 }
 
-func (w *WasmModule) Set(key string, val goja.Value) bool
+func (w *WasmModule) Set(key string, val goja.Value) bool {
+	return false
+}
 
 func (w *WasmModule) Delete(key string) bool {
 	return false
@@ -270,6 +369,9 @@ func (w *WasmModuleExports) Get(idx int) goja.Value {
 	if len(w.exports) <= idx {
 		return goja.Undefined()
 	}
+	if w.cached == nil {
+		w.cached = map[int]goja.Value{}
+	}
 	if v, ok := w.cached[idx]; ok {
 		return v
 	}
@@ -333,9 +435,35 @@ func (w *WasmModuleImports) SetLen(int) bool {
 type WasmInstance struct {
 	this *goja.Object
 	vm   *goja.Runtime
+	stdio
 
 	store    *wasmer.Store
 	instance *wasmer.Instance
+	wasi     *wasmer.WasiEnvironment
+	// wasiClass is the WASI object the instance was created with, if any
+	wasiClass *WASIClass
+	// wasiFS implements the file system functions of WASI
+	wasiFS *wasiFS
+
+	// exited reports whether the program called proc_exit
+	exited   bool
+	exitCode int32
+	exitTrap *exitTrap
+	onExit   func(code int32)
+	// imports keeps the host functions alive, wasmer-go releases them when they are collected
+	imports []map[string]wasmer.IntoExtern
+	// guard calls the host functions of the instance, through the interceptor of wasiClass
+	guard *hostGuard
+	// trace is the memory of the instance as its host functions access it, see tracedMemory
+	trace *memoryTrace
+	// memoryHandle accounts for the memory in the limits of the runtime
+	memoryHandle *budgetHandle
+	// closed reports whether Close was called
+	closed bool
+	// info describes the module beyond what wasmer knows
+	info *moduleInfo
+	// refs holds the JS values the instance was given as externref
+	refs *refHolder
 
 	exports goja.Value
 }
@@ -345,8 +473,9 @@ func (w *WasmInstance) Get(key string) goja.Value {
 	case "exports":
 		if w.exports == nil {
 			w.exports = w.vm.NewDynamicObject(&InstanceExports{
-				vm:      w.vm,
-				exports: w.instance.Exports,
+				vm:       w.vm,
+				instance: w,
+				exports:  w.instance.Exports,
 			})
 		}
 		return w.exports
@@ -355,7 +484,7 @@ func (w *WasmInstance) Get(key string) goja.Value {
 }
 
 func (w *WasmInstance) Set(key string, val goja.Value) bool {
-	return false
+	return w.streams().setFromJS(w.vm, key, val)
 }
 
 func (w *WasmInstance) Delete(key string) bool {
@@ -378,35 +507,59 @@ func (w *WasmInstance) Keys() []string {
 var _ goja.DynamicObject
 
 type InstanceExports struct {
-	vm      *goja.Runtime
-	exports *wasmer.Exports
+	vm       *goja.Runtime
+	instance *WasmInstance
+	exports  *wasmer.Exports
 
 	cached map[string]goja.Value
 }
 
 func (in *InstanceExports) Get(key string) goja.Value {
-	val, err := in.exports.Get(key)
-	if err != nil {
+	if isHiddenExport(key) {
 		return goja.Undefined()
 	}
-
 	if in.cached == nil {
 		in.cached = map[string]goja.Value{}
 	}
 	if v, ok := in.cached[key]; ok {
 		return v
 	}
+	if mutable, ok := in.instance.info.v128().global(key); ok {
+		// hidden from wasmer, its value cannot be read anyway
+		o := wasmObject(in.vm, "Global", &WasmGlobal{vm: in.vm, v128: true, mutable: mutable})
+		in.cached[key] = o
+		return o
+	}
+	val, err := in.exports.Get(key)
+	if err != nil {
+		return goja.Undefined()
+	}
 
 	fn := val.IntoFunction()
 	if fn != nil {
+		sig := in.instance.info.externrefs().export(key)
+		v128 := in.instance.info.v128().export(key).any()
 		f := in.vm.ToValue(func(arg goja.FunctionCall, vm *goja.Runtime) goja.Value {
+			if in.instance.closed {
+				panic(vm.NewTypeError("WebAssembly.FunctionCall: " + errClosed.Error()))
+			}
+			if v128 {
+				panic(vm.NewTypeError("WebAssembly.FunctionCall: " + errV128))
+			}
 			fntyp := fn.Type()
+			if hasRefs(fntyp) {
+				panic(vm.NewTypeError("WebAssembly.FunctionCall: " + errReferenceTypes))
+			}
 
 			params := []interface{}{}
 			for i, typ := range fntyp.Params() {
 				if len(arg.Arguments) == i {
 					panic(vm.NewTypeError())
 				}
+				if sig.param(i) {
+					params = append(params, in.instance.refs.lower(arg.Arguments[i]))
+					continue
+				}
 				switch typ.Kind() {
 				case wasmer.I32:
 					var p int32
@@ -455,46 +608,61 @@ func (in *InstanceExports) Get(key string) goja.Value {
 				}
 
 			}
-			r, err := fn.Call(params...)
+			r, err := in.instance.call(runtimeContext(vm), fn, params)
+			if isStopped(err) {
+				return stoppedResult(vm, err)
+			}
+			if trap, ok := err.(*Trap); ok {
+				panic(trap.jsError(vm))
+			}
+			if ex := hostThrow(vm, err); ex != nil {
+				panic(ex)
+			}
 			if err != nil {
 				panic(vm.NewTypeError("WebAssembly.FunctionCall: " + err.Error()))
 			}
-			return vm.ToValue(r)
+			return vm.ToValue(in.instance.refs.liftResults(sig, r))
 		})
 
 		in.cached[key] = f
 		return f
 	}
 
-	glob := val.IntoGlobal()
-	if glob != nil {
-		o, _ := in.vm.RunString("new WebAssembly.Global()")
-		g := o.Export().(*WasmGlobal)
-		g.glob = glob
-		g.kind = glob.Type().ValueType().Kind()
-		g.val, _ = glob.Get()
-		return o
-	}
-
-	mem := val.IntoMemory()
-	if mem != nil {
+	var o *goja.Object
+	if glob := val.IntoGlobal(); glob != nil {
+		g := &WasmGlobal{
+			vm:      in.vm,
+			glob:    glob,
+			kind:    glob.Type().ValueType().Kind(),
+			mutable: glob.Type().Mutability() == wasmer.MUTABLE,
+		}
+		if in.instance.info.externrefs().export(key).result(0) {
+			g.refs = in.instance.refs
+		}
+		if g.kind != wasmer.AnyRef && g.kind != wasmer.FuncRef {
+			g.val, _ = glob.Get()
+		}
+		o = wasmObject(in.vm, "Global", g)
+	} else if mem := val.IntoMemory(); mem != nil {
 		limit := mem.Type().Limits()
-		o, _ := in.vm.RunString("new WebAssembly.Memory({initial:" + strconv.Itoa(int(limit.Minimum())) + ", maximum: " + strconv.Itoa(int(limit.Maximum())) + "})")
-		m := o.Export().(*WasmMemory)
-		m.memory = mem
-		return o
-	}
-
-	table := val.IntoTable()
-	if table != nil {
-		arg := in.vm.NewObject()
-		o, _ := in.vm.New(in.vm.GlobalObject().Get("WebAssembly").(*goja.Object).Get("Table"), arg)
-		t := o.Export().(*WasmTable)
-		t.table = table
-		return o
+		o = wasmObject(in.vm, "Memory", &WasmMemory{
+			vm:      in.vm,
+			memory:  mem,
+			handle:  in.instance.memoryHandle,
+			init:    limit.Minimum(),
+			current: limit.Minimum(),
+			max:     limit.Maximum(),
+		})
+	} else if table := val.IntoTable(); table != nil {
+		o = wasmObject(in.vm, "Table", &WasmTable{
+			vm:    in.vm,
+			table: table,
+		})
+	} else {
+		return goja.Undefined()
 	}
-
-	return goja.Undefined()
+	in.cached[key] = o
+	return o
 }
 
 func (i *InstanceExports) Set(key string, val goja.Value) bool {
@@ -524,14 +692,27 @@ type WasmGlobal struct {
 	kind    wasmer.ValueKind
 	mutable bool
 	glob    *wasmer.Global
+	// refs holds the value of an exported externref global, which wasm sees as a handle
+	refs *refHolder
+	// v128 globals cannot be read or written by scripts
+	v128 bool
 }
 
 func (w *WasmGlobal) Get(key string) goja.Value {
 	switch key {
 
 	case "value":
+		if w.v128 {
+			panic(w.vm.NewTypeError("WebAssembly.Global.value: " + errV128))
+		}
 		if w.glob != nil {
+			if w.kind == wasmer.AnyRef || w.kind == wasmer.FuncRef {
+				panic(w.vm.NewTypeError("WebAssembly.Global.value: " + errReferenceTypes))
+			}
 			v, _ := w.glob.Get()
+			if w.refs != nil {
+				return w.refs.lift(v.(int32))
+			}
 			return w.vm.ToValue(v)
 		}
 		return w.vm.ToValue(w.val)
@@ -558,8 +739,16 @@ func (w *WasmGlobal) Set(key string, val goja.Value) bool {
 			kind = w.glob.Type().ValueType().Kind()
 		}
 		var p interface{}
-		switch kind {
-		case wasmer.I32:
+		switch {
+		case w.v128:
+			panic(w.vm.NewTypeError("WebAssembly.Global.value: " + errV128))
+		case w.refs != nil:
+			p = w.refs.lower(val)
+		case kind == wasmer.AnyRef && w.glob == nil:
+			p = val
+		case kind == wasmer.AnyRef || kind == wasmer.FuncRef:
+			panic(w.vm.NewTypeError("WebAssembly.Global.value: " + errReferenceTypes))
+		case kind == wasmer.I32:
 			switch v := v.(type) {
 			case int64:
 				p = int32(v)
@@ -568,7 +757,7 @@ func (w *WasmGlobal) Set(key string, val goja.Value) bool {
 			default:
 				panic(w.vm.NewTypeError("WebAssembly.Global.value: argument 1 must be number"))
 			}
-		case wasmer.I64:
+		case kind == wasmer.I64:
 			switch v := v.(type) {
 			case int64:
 				p = v
@@ -577,7 +766,7 @@ func (w *WasmGlobal) Set(key string, val goja.Value) bool {
 			default:
 				panic(w.vm.NewTypeError("WebAssembly.Global.value: argument 1 must be number"))
 			}
-		case wasmer.F32:
+		case kind == wasmer.F32:
 			switch v := v.(type) {
 			case int64:
 				p = float32(v)
@@ -586,7 +775,7 @@ func (w *WasmGlobal) Set(key string, val goja.Value) bool {
 			default:
 				panic(w.vm.NewTypeError("WebAssembly.Global.value: argument 1 must be number"))
 			}
-		case wasmer.F64:
+		case kind == wasmer.F64:
 			switch v := v.(type) {
 			case int64:
 				p = float64(v)
@@ -629,6 +818,8 @@ type WasmMemory struct {
 	init    uint32
 	current uint32
 	max     uint32
+	// handle accounts for the memory in the limits of the runtime
+	handle *budgetHandle
 
 	grow goja.Value
 
@@ -649,7 +840,7 @@ func (w *WasmMemory) Get(key string) goja.Value {
 				ar := w.dummybuffer.Export().(goja.ArrayBuffer)
 				b := ar.Bytes()
 				dummy := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-				current := *(*reflect.SliceHeader)(unsafe.Pointer(&data))
+				current := (*reflect.SliceHeader)(unsafe.Pointer(&data))
 				dummy.Data = current.Data
 				dummy.Cap = current.Cap
 				dummy.Len = current.Len
@@ -667,9 +858,23 @@ func (w *WasmMemory) Get(key string) goja.Value {
 				g := arg.Argument(0).ToInteger()
 				if w.memory != nil {
 					s = uint32(w.memory.Size())
-					w.memory.Grow(wasmer.Pages(g))
 				}
-				w.current += uint32(g)
+				if g < 0 || uint64(s)+uint64(g) > uint64(w.max) {
+					panic(rangeError(vm, "WebAssembly.Memory.grow(): Maximum memory size exceeded"))
+				}
+				if budget := configOf(vm).memories; budget != nil {
+					if err := budget.grow(w.handle, s, uint32(g)); err != nil {
+						panic(rangeError(vm, "WebAssembly.Memory.grow(): "+err.Error()))
+					}
+					defer budget.refreshLimits()
+				}
+				if w.memory != nil {
+					if !w.memory.Grow(wasmer.Pages(g)) {
+						panic(rangeError(vm, "WebAssembly.Memory.grow(): Unable to grow instance memory"))
+					}
+					w.membuffer = nil
+				}
+				w.current = s + uint32(g)
 				return vm.ToValue(s)
 			})
 		}